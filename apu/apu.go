@@ -396,7 +396,7 @@ func (apu *APU) Get8(addr uint16) uint8 {
 		util.Trace0("\t<<<READ: NR52 Sound on/off>>>")
 		return util.BoolToU8(apu.enabled) << 7
 	}
-	log.Fatalf("Invalid memory access of Get8: at 0x%08x", addr)
+	log.Panicf("Invalid memory access of Get8: at 0x%08x", addr)
 	return 0
 }
 
@@ -522,7 +522,7 @@ func (apu *APU) Set8(addr uint16, valu8 uint8) {
 		return
 	}
 
-	log.Fatalf("Invalid memory access of Set8: 0x%02x at 0x%08x", val, addr)
+	log.Panicf("Invalid memory access of Set8: 0x%02x at 0x%08x", val, addr)
 }
 
 func (apu *APU) Update(tick uint) bool {
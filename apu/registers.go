@@ -0,0 +1,135 @@
+package apu
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ushitora-anqou/aqboy/ioreg"
+	"github.com/ushitora-anqou/aqboy/util"
+)
+
+// Registers returns the sound registers decoded from the settings of the
+// channels. The bits which the APU does not keep, i.e. the triggers, the
+// length enables of the channels 1 to 3, the Vin bits of NR50 and the
+// statuses of the channels in NR52, read as 0. The wave pattern RAM is not
+// included.
+func (apu *APU) Registers() []ioreg.Register {
+	var regs []ioreg.Register
+	regs = append(regs, apu.ch1.registers(1, 0xff10)...)
+	regs = append(regs, apu.ch2.registers(2, 0xff15)...)
+	regs = append(regs, apu.ch3.registers()...)
+	regs = append(regs, apu.ch4.registers()...)
+	return append(regs,
+		ioreg.Register{Addr: 0xff24, Name: "NR50", Value: uint8(apu.so1OutputLevel | apu.so2OutputLevel<<4), Fields: []ioreg.Field{
+			{Name: "Left volume", Value: fmt.Sprint(apu.so2OutputLevel)},
+			{Name: "Right volume", Value: fmt.Sprint(apu.so1OutputLevel)},
+		}},
+		ioreg.Register{Addr: 0xff25, Name: "NR51", Value: uint8(apu.outputTerminal), Fields: []ioreg.Field{
+			{Name: "Left", Value: channels(apu.outputTerminal >> 4)},
+			{Name: "Right", Value: channels(apu.outputTerminal)},
+		}},
+		ioreg.Register{Addr: 0xff26, Name: "NR52", Value: util.BoolToU8(apu.enabled) << 7, Fields: []ioreg.Field{
+			{Name: "Sound", Value: ioreg.OnOff(apu.enabled)},
+		}},
+	)
+}
+
+// channels returns the channels whose bits are set in the lower 4 bits of
+// val, e.g. "1 3".
+func channels(val int) string {
+	var names []string
+	for i := 0; i < 4; i++ {
+		if (val>>i)&1 != 0 {
+			names = append(names, fmt.Sprint(i+1))
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, " ")
+}
+
+var dutyNames = []string{"12.5%", "25%", "50%", "75%"}
+
+// registers returns NRx0 to NRx4 of the channel n at base. NRx0 is only
+// included for the channel 1, which has the sweep.
+func (ch *channelQuad) registers(n int, base uint16) []ioreg.Register {
+	name := func(i int) string { return fmt.Sprintf("NR%d%d", n, i) }
+	var regs []ioreg.Register
+	if n == 1 {
+		direction := "increase"
+		if (ch.sweepCfg>>3)&1 != 0 {
+			direction = "decrease"
+		}
+		regs = append(regs, ioreg.Register{Addr: base, Name: name(0), Value: uint8(ch.sweepCfg), Fields: []ioreg.Field{
+			{Name: "Pace", Value: fmt.Sprint((ch.sweepCfg >> 4) & 7)},
+			{Name: "Direction", Value: direction},
+			{Name: "Shift", Value: fmt.Sprint(ch.sweepCfg & 7)},
+		}})
+	}
+	return append(regs,
+		ioreg.Register{Addr: base + 1, Name: name(1), Value: uint8(ch.wavePatternDuty<<6 | ch.soundLength), Fields: []ioreg.Field{
+			{Name: "Duty", Value: dutyNames[ch.wavePatternDuty]},
+			{Name: "Length", Value: fmt.Sprint(ch.soundLength)},
+		}},
+		envelopeRegister(ch.env, base+2, name(2)),
+		ioreg.Register{Addr: base + 3, Name: name(3), Value: uint8(ch.freq)},
+		ioreg.Register{Addr: base + 4, Name: name(4), Value: uint8(ch.freq >> 8), Fields: []ioreg.Field{
+			{Name: "Period", Value: fmt.Sprintf("%d (%d Hz)", ch.freq, 131072/(2048-ch.freq))},
+		}},
+	)
+}
+
+func envelopeRegister(env *envelope, addr uint16, name string) ioreg.Register {
+	if env == nil {
+		env = &envelope{}
+	}
+	direction := "decrease"
+	if env.direction == 1 {
+		direction = "increase"
+	}
+	return ioreg.Register{Addr: addr, Name: name, Value: uint8(env.initVolume<<4 | env.direction<<3 | env.numSweep), Fields: []ioreg.Field{
+		{Name: "Volume", Value: fmt.Sprint(env.initVolume)},
+		{Name: "Direction", Value: direction},
+		{Name: "Pace", Value: fmt.Sprint(env.numSweep)},
+	}}
+}
+
+var outputLevelNames = []string{"mute", "100%", "50%", "25%"}
+
+func (ch *channelWave) registers() []ioreg.Register {
+	return []ioreg.Register{
+		{Addr: 0xff1a, Name: "NR30", Value: util.BoolToU8(ch.enabled) << 7, Fields: []ioreg.Field{
+			{Name: "DAC", Value: ioreg.OnOff(ch.enabled)},
+		}},
+		{Addr: 0xff1b, Name: "NR31", Value: uint8(ch.soundLength)},
+		{Addr: 0xff1c, Name: "NR32", Value: uint8(ch.outputLevel << 5), Fields: []ioreg.Field{
+			{Name: "Level", Value: outputLevelNames[ch.outputLevel]},
+		}},
+		{Addr: 0xff1d, Name: "NR33", Value: uint8(ch.freq)},
+		{Addr: 0xff1e, Name: "NR34", Value: uint8(ch.freq >> 8), Fields: []ioreg.Field{
+			{Name: "Period", Value: fmt.Sprintf("%d (%d Hz)", ch.freq, 65536/(2048-ch.freq))},
+		}},
+	}
+}
+
+func (ch *channelNoise) registers() []ioreg.Register {
+	width := "15 bits"
+	if ch.widthMode {
+		width = "7 bits"
+	}
+	return []ioreg.Register{
+		{Addr: 0xff20, Name: "NR41", Value: uint8(ch.soundLength), Fields: []ioreg.Field{
+			{Name: "Length", Value: fmt.Sprint(ch.soundLength)},
+		}},
+		envelopeRegister(ch.env, 0xff21, "NR42"),
+		{Addr: 0xff22, Name: "NR43", Value: uint8(ch.shiftAmount<<4 | int(util.BoolToU8(ch.widthMode))<<3 | ch.divisorCode), Fields: []ioreg.Field{
+			{Name: "Shift", Value: fmt.Sprint(ch.shiftAmount)},
+			{Name: "Width", Value: width},
+			{Name: "Divisor", Value: fmt.Sprint(ch.divisorCode)},
+		}},
+		{Addr: 0xff23, Name: "NR44", Value: util.BoolToU8(ch.soundLengthEnabled) << 6, Fields: []ioreg.Field{
+			{Name: "Length enable", Value: ioreg.OnOff(ch.soundLengthEnabled)},
+		}},
+	}
+}
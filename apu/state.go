@@ -0,0 +1,71 @@
+package apu
+
+import "github.com/ushitora-anqou/aqboy/util"
+
+// SavedState is the state of the APU, including the samples not yet pushed
+// to the frontend, saved by SaveState.
+type SavedState struct {
+	apu APU
+}
+
+// SaveState returns the state of the APU, which can be restored by
+// LoadState.
+func (apu *APU) SaveState() *SavedState {
+	s := &SavedState{apu: apu.clone()}
+	s.apu.buffer = append([]float32(nil), apu.buffer...)
+	return s
+}
+
+// LoadState restores the state saved by SaveState.
+func (apu *APU) LoadState(s *SavedState) {
+	buffer := apu.buffer // May be held by the frontend
+	*apu = s.apu.clone()
+	apu.buffer = buffer
+	copy(apu.buffer, s.apu.buffer)
+}
+
+// clone returns a copy of apu which shares nothing but the buffer with it.
+func (apu *APU) clone() APU {
+	c := *apu
+	c.ch1 = apu.ch1.clone()
+	c.ch2 = apu.ch2.clone()
+	c.ch3.freqTick = cloneTickCounter(apu.ch3.freqTick)
+	c.ch4.env = apu.ch4.env.clone()
+	c.ch4.freqTick = cloneTickCounter(apu.ch4.freqTick)
+	c.ch4.lengthTick = cloneTickCounter(apu.ch4.lengthTick)
+	c.tickSample = cloneTickCounter(apu.tickSample)
+	return c
+}
+
+func (ch channelQuad) clone() channelQuad {
+	ch.env = ch.env.clone()
+	ch.sweep = ch.sweep.clone()
+	ch.freqTick = cloneTickCounter(ch.freqTick)
+	return ch
+}
+
+func (e *envelope) clone() *envelope {
+	if e == nil {
+		return nil
+	}
+	c := *e
+	c.tick = cloneTickCounter(e.tick)
+	return &c
+}
+
+func (s *sweep) clone() *sweep {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	c.tick = cloneTickCounter(s.tick)
+	return &c
+}
+
+func cloneTickCounter(tc *util.TickCounter) *util.TickCounter {
+	if tc == nil {
+		return nil
+	}
+	c := *tc
+	return &c
+}
@@ -1,17 +1,37 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strings"
+
 	"github.com/ushitora-anqou/aqboy/apu"
 	"github.com/ushitora-anqou/aqboy/bus"
 	"github.com/ushitora-anqou/aqboy/constant"
 	"github.com/ushitora-anqou/aqboy/cpu"
+	"github.com/ushitora-anqou/aqboy/dap"
+	"github.com/ushitora-anqou/aqboy/debugger"
+	"github.com/ushitora-anqou/aqboy/eventlog"
+	"github.com/ushitora-anqou/aqboy/expr"
+	"github.com/ushitora-anqou/aqboy/gdbstub"
+	"github.com/ushitora-anqou/aqboy/ioreg"
 	"github.com/ushitora-anqou/aqboy/joypad"
 	"github.com/ushitora-anqou/aqboy/mmu"
 	"github.com/ushitora-anqou/aqboy/ppu"
+	"github.com/ushitora-anqou/aqboy/profiler"
+	"github.com/ushitora-anqou/aqboy/symbol"
+	"github.com/ushitora-anqou/aqboy/timeline"
 	"github.com/ushitora-anqou/aqboy/timer"
 	"github.com/ushitora-anqou/aqboy/window"
 )
 
+// ErrSourceBreakpoint is returned by Step when a source breakpoint, i.e.
+// "ld b, b", is executed without any debugger. See SetDebugMessageWriter.
+var ErrSourceBreakpoint = errors.New("Source breakpoint")
+
 type AQBoy struct {
 	bus    *bus.Bus
 	cpu    *cpu.CPU
@@ -22,6 +42,33 @@ type AQBoy struct {
 	joypad *joypad.Joypad
 	wind   window.Window
 	cnt    int
+	frames int
+	cycles uint64
+	steps  uint64 // Instructions executed since the power-on
+
+	symbols  *symbol.Table
+	profiler *profiler.Profiler
+	debugger *debugger.Debugger
+	gdb      *gdbstub.Server
+	dap      *dap.Server
+	closers  []func() error
+
+	timeline     *timeline.Recorder
+	timelineFrom int // The frames to be recorded in the timeline
+	timelineTo   int
+	timelineOut  io.Writer
+
+	history     []snapshot // Oldest first
+	historySize int
+	replaying   bool // See replay
+
+	freezes []mmu.Poke
+
+	rom          []uint8
+	crashDir     string
+	executed     []executedInst // Ring buffer of the last instructions
+	executedNext int
+	executedFull bool
 }
 
 func NewAQBoy(wind window.Window, rom []uint8) (*AQBoy, error) {
@@ -40,44 +87,440 @@ func NewAQBoy(wind window.Window, rom []uint8) (*AQBoy, error) {
 	// Build up the bus
 	bus.Register(cpu, mmu, ppu, wind, timer, apu, joypad)
 
-	return &AQBoy{bus, cpu, ppu, mmu, timer, apu, joypad, wind, 0}, nil
+	return &AQBoy{
+		bus:    bus,
+		cpu:    cpu,
+		ppu:    ppu,
+		mmu:    mmu,
+		timer:  timer,
+		apu:    apu,
+		joypad: joypad,
+		wind:   wind,
+		rom:    rom,
+	}, nil
+}
+
+// Close releases the resources opened for debugging facilities such as the
+// instruction trace. It should be called once the emulation is over.
+func (a *AQBoy) Close() error {
+	var firstErr error
+	for _, closer := range a.closers {
+		if err := closer(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	a.closers = nil
+	return firstErr
+}
+
+// crashError decorates err, which stopped the emulation, with the guest call stack.
+func (a *AQBoy) crashError(err error) error {
+	var stack strings.Builder
+	for i, frame := range a.cpu.CallStack() {
+		fmt.Fprintf(&stack, "\n  #%d %v%s", i, frame, a.label(frame.TargetBank, frame.Target))
+	}
+	pc := a.cpu.PC()
+	bank := a.mmu.Bank(pc)
+	return fmt.Errorf("%w\nCall stack (PC=%02x:%04x%s):%s", err, bank, pc, a.label(bank, pc), stack.String())
+}
+
+// label returns " Main.loop+3" for bank:addr, or "" if it is unknown.
+func (a *AQBoy) label(bank int, addr uint16) string {
+	if a.symbols != nil {
+		if name := a.symbols.Symbolize(bank, addr); name != "" {
+			return " " + name
+		}
+	}
+	return ""
+}
+
+// LoadSymbols loads labels from an RGBDS .sym or .map file, and uses them in
+// the trace, the errors and the profiler.
+func (a *AQBoy) LoadSymbols(filename string) error {
+	symbols := symbol.NewTable()
+	if err := symbols.LoadFile(filename); err != nil {
+		return err
+	}
+	a.symbols = symbols
+	a.cpu.SetSymbolizer(symbols)
+	if a.profiler != nil {
+		a.profiler.SetSymbolizer(symbols)
+	}
+	if a.debugger != nil {
+		a.debugger.SetSymbols(symbols)
+	}
+	if a.dap != nil {
+		a.dap.SetSymbols(symbols)
+	}
+	return nil
+}
+
+// SetTraceWriter enables the per-instruction CPU trace. See cpu.SetTraceWriter.
+func (a *AQBoy) SetTraceWriter(w io.Writer) {
+	a.cpu.SetTraceWriter(w)
+}
+
+// UseDMGRegisters starts the CPU with the registers of a DMG after the boot
+// ROM instead of a CGB, e.g. to compare the trace with a log of
+// gameboy-doctor. It must be called before the emulation starts.
+func (a *AQBoy) UseDMGRegisters() {
+	state := a.cpu.Snapshot()
+	state.Registers = cpu.DMGRegisters
+	a.cpu.Restore(state)
+}
+
+// SetTraceFilter makes the trace show only the instructions before which cond
+// is true. Passing nil shows all of them.
+func (a *AQBoy) SetTraceFilter(cond *expr.Expr) {
+	if cond == nil {
+		a.cpu.SetTraceFilter(nil)
+		return
+	}
+	m := debugMachine{a}
+	a.cpu.SetTraceFilter(func() bool { return cond.True(m) })
+}
+
+// SetDebugMessageWriter enables the debug instructions of BGB, and writes
+// the debug messages to w. See cpu.SetDebugMessageWriter. A source breakpoint
+// enters the debugger, or ends the emulation if there is no debugger.
+func (a *AQBoy) SetDebugMessageWriter(w io.Writer) {
+	a.cpu.SetDebugMessageWriter(w)
+}
+
+// EnableEventLog starts recording the hardware events, keeping the latest
+// size ones, and returns the log.
+func (a *AQBoy) EnableEventLog(size int) *eventlog.Log {
+	if a.bus.Events == nil {
+		a.bus.Events = eventlog.NewLog(size, debugMachine{a})
+	}
+	return a.bus.Events
+}
+
+// RecordTimeline records the frames from-to, inclusive, and writes them to
+// out in the Chrome trace event format when the last one ends or the
+// emulation is closed. See package timeline.
+func (a *AQBoy) RecordTimeline(from, to int, out io.Writer) {
+	// The PPU modes alone are ~500 events per frame.
+	a.EnableEventLog((to - from + 1) * 1024)
+	a.timelineFrom, a.timelineTo, a.timelineOut = from, to, out
+	a.closers = append(a.closers, a.finishTimeline)
+	a.updateTimeline()
+}
+
+// updateTimeline starts or finishes the timeline at the start of a frame.
+func (a *AQBoy) updateTimeline() error {
+	if a.timelineOut == nil {
+		return nil
+	}
+	if a.timeline == nil && a.frames >= a.timelineFrom {
+		var symbols cpu.Symbolizer
+		if a.symbols != nil {
+			symbols = a.symbols
+		}
+		a.timeline = timeline.NewRecorder(symbols, a.cycles, a.cpu)
+	} else if a.timeline != nil && a.frames > a.timelineTo {
+		return a.finishTimeline()
+	}
+	return nil
+}
+
+// finishTimeline writes the timeline recorded so far, if any.
+func (a *AQBoy) finishTimeline() error {
+	if a.timeline == nil || a.timelineOut == nil {
+		return nil
+	}
+	out := a.timelineOut
+	a.timelineOut = nil
+	a.timeline.Stop(a.cycles)
+	recorder := a.timeline
+	a.timeline = nil
+	start, end := recorder.Span()
+	events := a.bus.Events.Query(func(e eventlog.Event) bool {
+		return start <= e.Cycle && e.Cycle <= end
+	})
+	return recorder.WriteJSON(out, events)
+}
+
+// EnableProfiler starts attributing the cycles spent by the guest code to its
+// routines, and returns the profiler collecting them.
+func (a *AQBoy) EnableProfiler() *profiler.Profiler {
+	if a.profiler == nil {
+		a.profiler = profiler.NewProfiler()
+		if a.symbols != nil {
+			a.profiler.SetSymbolizer(a.symbols)
+		}
+	}
+	return a.profiler
+}
+
+// EnableDebugger makes the debugger available through in and out, and
+// returns it. See Break.
+func (a *AQBoy) EnableDebugger(in io.Reader, out io.Writer) *debugger.Debugger {
+	if a.debugger == nil {
+		if a.historySize == 0 {
+			a.EnableHistory(defaultHistoryFrames)
+		}
+		a.debugger = debugger.NewDebugger(debugMachine{a}, in, out)
+		if a.symbols != nil {
+			a.debugger.SetSymbols(a.symbols)
+		}
+	}
+	return a.debugger
+}
+
+// Break stops the emulation before the next instruction and enters the
+// debugger. The debugger uses the terminal unless EnableDebugger has been
+// called.
+func (a *AQBoy) Break() {
+	a.EnableDebugger(os.Stdin, os.Stdout).Break()
+}
+
+// EnableGDB waits for a GDB client on addr, e.g. "localhost:2345", which
+// controls the emulation afterwards. See package gdbstub.
+func (a *AQBoy) EnableGDB(addr string) error {
+	server, err := gdbstub.Listen(debugMachine{a}, addr)
+	if err != nil {
+		return err
+	}
+	a.closers = append(a.closers, server.Close)
+	fmt.Fprintf(os.Stderr, "Waiting for GDB on %v\n", server.Addr())
+	if err := server.Accept(); err != nil {
+		return err
+	}
+	a.gdb = server
+	return nil
+}
+
+// EnableDAP waits for a client of the Debug Adapter Protocol on addr, e.g.
+// "localhost:4711", which controls the emulation afterwards. See package dap.
+func (a *AQBoy) EnableDAP(addr string) error {
+	server, err := dap.Listen(debugMachine{a}, addr)
+	if err != nil {
+		return err
+	}
+	if a.symbols != nil {
+		server.SetSymbols(a.symbols)
+	}
+	a.closers = append(a.closers, server.Close)
+	fmt.Fprintf(os.Stderr, "Waiting for a debug adapter client on %v\n", server.Addr())
+	if err := server.Accept(); err != nil {
+		return err
+	}
+	a.dap = server
+	return nil
+}
+
+// debugMachine exposes AQBoy to the debugger and the debug servers.
+type debugMachine struct {
+	a *AQBoy
+}
+
+func (m debugMachine) Step() (uint, error)                  { return m.a.step() }
+func (m debugMachine) Replay() (uint, error)                { return m.a.replay() }
+func (m debugMachine) State() cpu.State                     { return m.a.cpu.Snapshot() }
+func (m debugMachine) Restore(state cpu.State)              { m.a.cpu.Restore(state) }
+func (m debugMachine) CallStack() []cpu.Frame               { return m.a.cpu.CallStack() }
+func (m debugMachine) Peek8(addr uint16) uint8              { return m.a.mmu.Peek8(addr) }
+func (m debugMachine) Bank(addr uint16) int                 { return m.a.mmu.Bank(addr) }
+func (m debugMachine) LY() uint8                            { return m.a.ppu.LY() }
+func (m debugMachine) Frame() int                           { return m.a.frames }
+func (m debugMachine) Steps() uint64                        { return m.a.steps }
+func (m debugMachine) Rewind(step uint64) bool              { return m.a.rewind(step) }
+func (m debugMachine) Cycle() uint64                        { return m.a.cycles }
+func (m debugMachine) Dot() int                             { return m.a.ppu.Dot() }
+func (m debugMachine) TakeSourceBreakpoint() (uint16, bool) { return m.a.cpu.TakeSourceBreakpoint() }
+func (m debugMachine) SetWatchpoints(wps []mmu.Watchpoint)  { m.a.mmu.SetWatchpoints(wps) }
+func (m debugMachine) TakeWatchHit() (mmu.WatchHit, bool)   { return m.a.mmu.TakeWatchHit() }
+func (m debugMachine) IORegisters() []ioreg.Register        { return m.a.IORegisters() }
+func (m debugMachine) Poke(p mmu.Poke) error                { return m.a.Poke(p) }
+func (m debugMachine) CheckWrite(addr uint16) error         { return m.a.mmu.CheckWrite(addr) }
+func (m debugMachine) Write(addr uint16, val uint8) error   { return m.a.mmu.Write(addr, val) }
+func (m debugMachine) Freeze(p mmu.Poke) error              { return m.a.Freeze(p) }
+func (m debugMachine) Unfreeze(index int)                   { m.a.Unfreeze(index) }
+func (m debugMachine) Freezes() []mmu.Poke                  { return m.a.Freezes() }
+func (m debugMachine) TileImage(paletteData uint8) *image.Paletted {
+	return m.a.TileImage(paletteData)
+}
+func (m debugMachine) TileMapImage(tileMapAddr uint16) *image.Paletted {
+	return m.a.TileMapImage(tileMapAddr)
+}
+
+// EnableCDL starts recording how each byte of the memory is accessed, and
+// returns the log. See mmu.CDL.
+func (a *AQBoy) EnableCDL() *mmu.CDL {
+	// Decode the cached instructions again to log them.
+	a.cpu.FlushBlockCache()
+	return a.mmu.EnableCDL()
+}
+
+// IORegisters returns the hardware registers with their bitfields decoded
+// from the live components, sorted by the address.
+func (a *AQBoy) IORegisters() []ioreg.Register {
+	var regs []ioreg.Register
+	regs = append(regs, a.joypad.Registers()...)
+	regs = append(regs, a.timer.Registers()...)
+	regs = append(regs, a.cpu.Registers()...)
+	regs = append(regs, a.apu.Registers()...)
+	regs = append(regs, a.ppu.Registers()...)
+	ioreg.Sort(regs)
+	return regs
+}
+
+// Step executes one instruction and updates the other components accordingly.
+// It enters the debugger first if a breakpoint is hit.
+func (a *AQBoy) Step() (uint, error) {
+	if a.debugger != nil && a.debugger.ShouldBreak(a.cpu.PC()) {
+		if err := a.debugger.Run(); err != nil {
+			return 0, err
+		}
+	}
+	if a.gdb != nil && a.gdb.ShouldBreak(a.cpu.PC()) {
+		if err := a.gdb.Run(); err != nil {
+			if errors.Is(err, gdbstub.ErrKilled) {
+				return 0, debugger.ErrQuit // Quit as the debugger does
+			}
+			return 0, err
+		}
+	}
+	if a.dap != nil && a.dap.ShouldBreak(a.cpu.PC()) {
+		if err := a.dap.Run(); err != nil {
+			if errors.Is(err, dap.ErrTerminated) {
+				return 0, debugger.ErrQuit
+			}
+			return 0, err
+		}
+	}
+
+	pc := a.cpu.PC()
+	tick, err := a.step()
+	if a.debugger != nil {
+		a.debugger.Stepped(pc)
+	} else if addr, ok := a.cpu.TakeSourceBreakpoint(); ok && err == nil {
+		err = a.sourceBreakpoint(addr)
+	}
+	if isOutputError(err) {
+		// The emulation is fine, e.g. the trace diverges from the reference.
+		return 0, err
+	}
+	if err != nil && a.gdb != nil && a.gdb.Attached() {
+		// Let the client inspect what went wrong.
+		fmt.Fprintln(os.Stderr, err)
+		a.gdb.Fault()
+		return 0, nil
+	}
+	if err != nil && a.dap != nil && a.dap.Attached() {
+		a.dap.Fault(err)
+		return 0, nil
+	}
+	return tick, err
+}
+
+// isOutputError returns true if err is an error of the trace or the debug
+// messages, which is not a crash.
+func isOutputError(err error) bool {
+	var outErr *cpu.OutputError
+	return errors.As(err, &outErr)
 }
 
-func (a *AQBoy) Update(event *window.WindowEvent) error {
+// sourceBreakpoint stops the emulation after the source breakpoint at pc is
+// executed. Without any debugger, the emulation ends with ErrSourceBreakpoint.
+func (a *AQBoy) sourceBreakpoint(pc uint16) error {
+	stopped := false
+	if a.gdb != nil && a.gdb.Attached() {
+		a.gdb.Break()
+		stopped = true
+	}
+	if a.dap != nil && a.dap.Attached() {
+		a.dap.Break()
+		stopped = true
+	}
+	if stopped {
+		return nil
+	}
+	bank := a.mmu.Bank(pc)
+	return fmt.Errorf("%w at %02x:%04x%s", ErrSourceBreakpoint, bank, pc, a.label(bank, pc))
+}
+
+func (a *AQBoy) step() (uint, error) {
 	cpu := a.cpu
 	ppu := a.ppu
 	timer := a.timer
 	apu := a.apu
-	joypad := a.joypad
 	wind := a.wind
 
+	if a.profiler != nil && !a.replaying {
+		a.profiler.BeginStep(a.mmu.Bank(cpu.PC()), cpu.PC(), cpu)
+	}
+	if a.executed != nil && !a.replaying {
+		a.recordInstruction()
+	}
+	tick, err := cpu.Step()
+	if err != nil {
+		if isOutputError(err) {
+			return 0, err
+		}
+		return 0, a.crash(err, nil)
+	}
+	a.cycles += uint64(tick)
+	if a.profiler != nil && !a.replaying {
+		a.profiler.EndStep(tick)
+	}
+	if a.timeline != nil && !a.replaying {
+		a.timeline.Step(a.cycles, cpu)
+	}
+	ppu.Update(tick)
+	timer.Update(tick)
+	if apu.Update(tick) && !a.replaying {
+		if events := a.bus.Events; events != nil {
+			events.Add(eventlog.AudioBuffer, 0, 0)
+		}
+		err := wind.EnqueueAudioBuffer(apu.GetAudioBuffer())
+		if err != nil {
+			return 0, err
+		}
+	}
+	a.cnt += int(tick)
+	a.steps++
+	if a.cnt >= constant.FRAME_TICKS {
+		a.cnt -= constant.FRAME_TICKS
+		a.frames++
+		a.reassertFreezes()
+		if !a.replaying {
+			if err := a.updateTimeline(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	//util.Trace4("                af=%04x    bc=%04x    de=%04x    hl=%04x",
+	//	cpu.AF(), cpu.BC(), cpu.DE(), cpu.HL())
+	//util.Trace6("                sp=%04x    pc=%04x    Z=%d  N=%d  H=%d  C=%d",
+	//	cpu.SP(), cpu.PC(), util.BoolToU8(cpu.FlagZ()), util.BoolToU8(cpu.FlagN()), util.BoolToU8(cpu.FlagH()), util.BoolToU8(cpu.FlagC()))
+	//util.Trace2("                ime=%d      tima=%02x",
+	//	util.BoolToU8(cpu.IME()), timer.TIMA())
+
+	return tick, nil
+}
+
+func (a *AQBoy) Update(event *window.WindowEvent) (err error) {
+	defer a.recoverCrash(&err)
+	joypad := a.joypad
+
 	joypad.SetDirection(event.Direction)
 	joypad.SetAction(event.Action)
+	if event.Debug {
+		a.Break()
+	}
+	if a.historySize > 0 {
+		a.saveSnapshot()
+	}
 
 	// Emulate one frame
-	for a.cnt < constant.FRAME_TICKS {
-		tick, err := cpu.Step()
-		if err != nil {
+	for frame := a.frames; a.frames == frame; {
+		if _, err := a.Step(); err != nil {
 			return err
 		}
-		ppu.Update(tick)
-		timer.Update(tick)
-		if apu.Update(tick) {
-			err := wind.EnqueueAudioBuffer(apu.GetAudioBuffer())
-			if err != nil {
-				return err
-			}
-		}
-		a.cnt += int(tick)
-
-		//util.Trace4("                af=%04x    bc=%04x    de=%04x    hl=%04x",
-		//	cpu.AF(), cpu.BC(), cpu.DE(), cpu.HL())
-		//util.Trace6("                sp=%04x    pc=%04x    Z=%d  N=%d  H=%d  C=%d",
-		//	cpu.SP(), cpu.PC(), util.BoolToU8(cpu.FlagZ()), util.BoolToU8(cpu.FlagN()), util.BoolToU8(cpu.FlagH()), util.BoolToU8(cpu.FlagC()))
-		//util.Trace2("                ime=%d      tima=%02x",
-		//	util.BoolToU8(cpu.IME()), timer.TIMA())
 	}
-	a.cnt -= constant.FRAME_TICKS
 
 	return nil
 }
@@ -0,0 +1,1383 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ushitora-anqou/aqboy/asm"
+	"github.com/ushitora-anqou/aqboy/crashdump"
+	"github.com/ushitora-anqou/aqboy/debugger"
+	"github.com/ushitora-anqou/aqboy/eventlog"
+	"github.com/ushitora-anqou/aqboy/expr"
+	"github.com/ushitora-anqou/aqboy/ioreg"
+	"github.com/ushitora-anqou/aqboy/mmu"
+	"github.com/ushitora-anqou/aqboy/ppu"
+	"github.com/ushitora-anqou/aqboy/tracediff"
+	"github.com/ushitora-anqou/aqboy/window"
+)
+
+// newTestAQBoy assembles src and builds an emulator running it.
+func newTestAQBoy(tb testing.TB, src string) *AQBoy {
+	tb.Helper()
+	rom, err := asm.Assemble(src)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	aqboy, err := NewAQBoy(window.NewHeadlessWindow(), rom)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return aqboy
+}
+
+func runFrames(t *testing.T, aqboy *AQBoy, frames int) {
+	t.Helper()
+	for i := 0; i < frames; i++ {
+		if err := aqboy.Update(&window.WindowEvent{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRunAssembledProgram(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $fffe
+	ld b, 10
+	xor a
+.loop:
+	add a, b
+	dec b
+	jr nz, .loop
+	ld [$c000], a
+	call Double
+	ld [$c001], a
+.end:
+	halt
+	jr .end
+
+Double:
+	add a, a
+	ret
+`)
+	runFrames(t, aqboy, 1)
+
+	if got := aqboy.mmu.Get8(0xc000); got != 55 {
+		t.Fatalf("Sum: (got: %d) (expected: 55)", got)
+	}
+	if got := aqboy.mmu.Get8(0xc001); got != 110 {
+		t.Fatalf("Double: (got: %d) (expected: 110)", got)
+	}
+}
+
+func TestTimerInterrupt(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "timer", ROM0[$0050]
+	ld hl, $c000
+	inc [hl]
+	reti
+
+SECTION "main", ROM0[$0150]
+	ld sp, $fffe
+	xor a
+	ld [$c000], a
+	ldh [$ff06], a ; TMA
+	ld a, %101     ; Enable, CPU Clock / 16
+	ldh [$ff07], a ; TAC
+	ld a, %100     ; Timer
+	ldh [$ffff], a ; IE
+	ei
+.wait:
+	halt
+	jr .wait
+`)
+	runFrames(t, aqboy, 1)
+
+	// 70224 ticks / (16 * 256) ticks per overflow
+	if got := aqboy.mmu.Get8(0xc000); got < 16 || 17 < got {
+		t.Fatalf("Number of timer interrupts: (got: %d) (expected: 16 or 17)", got)
+	}
+}
+
+func TestGuestProfiler(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+	ld sp, $fffe
+.loop:
+	call Busy
+	jr .loop
+
+SECTION "busy", ROM0[$0200]
+Busy:
+	ld b, 100
+.loop:
+	dec b
+	jr nz, .loop
+	ret
+`)
+	prof := aqboy.EnableProfiler()
+	runFrames(t, aqboy, 1)
+
+	funcs := prof.Functions()
+	if len(funcs) != 2 {
+		t.Fatalf("Routines: (got: %v) (expected: 2 routines)", funcs)
+	}
+	if funcs[0].Name != "00:0200" || funcs[0].SelfRatio < 0.9 {
+		t.Fatalf("Hottest routine: (got: %+v) (expected: 00:0200)", funcs[0])
+	}
+	if funcs[1].Name != "00:0100" || funcs[1].CumRatio != 1 {
+		t.Fatalf("Root routine: (got: %+v) (expected: 00:0100)", funcs[1])
+	}
+
+	var buf bytes.Buffer
+	if err := prof.WritePprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gzip.NewReader(&buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCDL(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+	ld sp, $fffe
+	ld a, 2
+	ld [$2000], a
+	call Banked
+.end:
+	halt
+	jr .end
+
+SECTION "banked", ROMX[$4000], BANK[2]
+Banked:
+	ld a, [Table]
+	ret
+	db $ff ; Dead code
+Table:
+	db $42
+`)
+	cdl := aqboy.EnableCDL()
+	runFrames(t, aqboy, 1)
+
+	for _, entry := range []struct {
+		index    int
+		expected uint8
+	}{
+		{0x0150, mmu.CDLCode},            // ld sp, $fffe
+		{0x0151, mmu.CDLOperand},         // $fe
+		{0x2*0x4000 + 0, mmu.CDLCode},    // ld a, [Table]
+		{0x2*0x4000 + 1, mmu.CDLOperand}, // Table
+		{0x2*0x4000 + 3, mmu.CDLCode},    // ret
+		{0x2*0x4000 + 4, 0},              // Dead code
+		{0x2*0x4000 + 5, mmu.CDLData},    // Table
+		{0x1*0x4000 + 0, 0},              // Bank 1 is never mapped
+	} {
+		if got := cdl.ROM[entry.index]; got != entry.expected {
+			t.Fatalf("ROM[0x%05x]: (got: %04b) (expected: %04b)", entry.index, got, entry.expected)
+		}
+	}
+
+	// The records of the previous sessions are kept.
+	var buf bytes.Buffer
+	if err := cdl.WriteFile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	merged := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+	jr @
+SECTION "banked", ROMX[$4000], BANK[2]
+	ds 1
+`).EnableCDL()
+	merged.ROM[0x2*0x4000+4] = mmu.CDLData
+	if err := merged.MergeFile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := merged.ROM[0x2*0x4000+4], mmu.CDLData; got != expected {
+		t.Fatalf("Merged flags: (got: %04b) (expected: %04b)", got, expected)
+	}
+	if got, expected := merged.ROM[0x2*0x4000+5], mmu.CDLData; got != expected {
+		t.Fatalf("Merged flags: (got: %04b) (expected: %04b)", got, expected)
+	}
+}
+
+func TestCDLWithTrace(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+	ld sp, $fffe
+	call Sub
+	db $ff ; Never executed
+Sub:
+	halt
+	jr Sub
+	db $ff, $ff ; Never read
+`)
+	aqboy.SetTraceWriter(io.Discard)
+	cdl := aqboy.EnableCDL()
+	runFrames(t, aqboy, 1)
+
+	// Neither the trace nor the call stack counts as reads of the game.
+	for _, entry := range []struct {
+		index    int
+		expected uint8
+	}{
+		{0x0153, mmu.CDLCode}, // call Sub
+		{0x0156, 0},
+		{0x0157, mmu.CDLCode}, // halt
+		{0x015a, 0},
+		{0x015b, 0},
+	} {
+		if got := cdl.ROM[entry.index]; got != entry.expected {
+			t.Fatalf("ROM[0x%05x]: (got: %04b) (expected: %04b)", entry.index, got, entry.expected)
+		}
+	}
+	if got := cdl.HRAM[0x7c:0x7e]; got[0] != 0 || got[1] != 0 {
+		t.Fatalf("HRAM[0x7c:0x7e]: (got: %04b) (expected: no flags)", got)
+	}
+}
+
+func TestSymbolsInCrash(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $fffe
+	call Crash
+
+Crash:
+	nop
+	db $d3 ; Illegal
+`)
+	filename := filepath.Join(t.TempDir(), "test.sym")
+	if err := os.WriteFile(filename, []uint8("00:0150 Main\n00:0156 Crash\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := aqboy.LoadSymbols(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	err := aqboy.Update(&window.WindowEvent{})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, expected := range []string{
+		"Illegal instr: 0xd3 at 0x0157 (Crash+1)",
+		"Call stack (PC=00:0157 Crash+1)",
+		"CALL 00:0156 from 00:0153 (return to 0156, SP=fffc) Crash",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Error message: (got: %q) (expected to contain: %q)", err, expected)
+		}
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $fffe
+	ld a, 1
+	call Double
+	call Double
+	ld [$c000], a
+.end:
+	halt
+	jr .end
+
+Double:
+	add a, a
+	ret
+`)
+	in := strings.NewReader(strings.Join([]string{
+		"b 0155",   // The first call
+		"c",        // Stop at the breakpoint
+		"n",        // Step over the call
+		"s",        // Step into the second call
+		"fin",      // Return from it
+		"r",        // A = 4
+		"b Double", // Not a label since no symbols are loaded
+		"d",
+		"s 2",
+		"x c000 1",
+		"l 015f 1",
+		"q",
+	}, "\n"))
+	var out strings.Builder
+	aqboy.EnableDebugger(in, &out)
+	aqboy.Break()
+
+	err := aqboy.Update(&window.WindowEvent{})
+	if !errors.Is(err, debugger.ErrQuit) {
+		t.Fatalf("Update: (got: %v) (expected: %v)", err, debugger.ErrQuit)
+	}
+	for _, expected := range []string{
+		"00:0100: nop\n",
+		"Breakpoint 0 at **:0155\n",
+		"Breakpoint 0 at 00:0155\n00:0155: call $0161\n",
+		"00:0158: call $0161\n",
+		"00:0161: add a, a\n",
+		"00:015b: ld [$c000], a\n",
+		"A:04 F:00 [----]",
+		"Error: Invalid location: Double\n",
+		"00:015f: jr $015e\n",
+		"c000: 04\n",
+		"=> 00:015f  jr $015e\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("Output: (got: %q) (expected to contain: %q)", out.String(), expected)
+		}
+	}
+}
+
+func TestWatchpoint(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $fffe
+	ld a, 1
+	ld [$c000], a
+	ld a, [$c000]
+	ld [$c000], a
+	inc a
+	ld [$c000], a
+.end:
+	halt
+	jr .end
+`)
+	in := strings.NewReader(strings.Join([]string{
+		"w c000 c",
+		"c", // Stop after the first write
+		"uw",
+		"w c000 r",
+		"s 5", // Stop after the read
+		"uw 0",
+		"w bfff-c001 c",
+		"c", // Not at the write of the same value
+		"i",
+		"q",
+	}, "\n"))
+	var out strings.Builder
+	aqboy.EnableDebugger(in, &out)
+	aqboy.Break()
+
+	err := aqboy.Update(&window.WindowEvent{})
+	if !errors.Is(err, debugger.ErrQuit) {
+		t.Fatalf("Update: (got: %v) (expected: %v)", err, debugger.ErrQuit)
+	}
+	for _, expected := range []string{
+		"Watchpoint 0 at c000 c\n",
+		"Watchpoint 0: write c000 = 01 (was 00) at 00:0155\n00:0158: ld a, [$c000]\n",
+		"Watchpoint 0: read c000 = 01 at 00:0158\n00:015b: ld [$c000], a\n",
+		"Watchpoint 0: write c000 = 02 (was 01) at 00:015f\n",
+		"w0: bfff-c001 c\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("Output: (got: %q) (expected to contain: %q)", out.String(), expected)
+		}
+	}
+}
+
+func TestWatchpointOnlyGameAccesses(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $fffe
+	call Sub
+Sub:
+	halt
+	jr Sub
+`)
+	// Neither the trace nor the call stack reads the memory as the game.
+	aqboy.SetTraceWriter(io.Discard)
+	in := strings.NewReader(strings.Join([]string{
+		"w 0150-015f r",
+		"w fffc-fffd r",
+		"s 10",
+		"q",
+	}, "\n"))
+	var out strings.Builder
+	aqboy.EnableDebugger(in, &out)
+	aqboy.Break()
+
+	err := aqboy.Update(&window.WindowEvent{})
+	if !errors.Is(err, debugger.ErrQuit) {
+		t.Fatalf("Update: (got: %v) (expected: %v)", err, debugger.ErrQuit)
+	}
+	if strings.Contains(out.String(), ": read ") {
+		t.Fatalf("Output: (got: %q) (expected: no reads)", out.String())
+	}
+	if len(aqboy.cpu.CallStack()) != 1 {
+		t.Fatalf("Call stack: (got: %v) (expected: Sub)", aqboy.cpu.CallStack())
+	}
+}
+
+func TestConditions(t *testing.T) {
+	src := `
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $fffe
+	ld b, 5
+	xor a
+.loop:
+	add a, b
+	ld [$c000], a
+	dec b
+	jr nz, .loop
+.end:
+	halt
+	jr .end
+`
+	aqboy := newTestAQBoy(t, src)
+	in := strings.NewReader(strings.Join([]string{
+		"b 0156 if b == 2",
+		"c",
+		"r",
+		"d",
+		"w c000 if [$c000] > 13",
+		"c",
+		"i",
+		"b 0156 if b ==",
+		"q",
+	}, "\n"))
+	var out strings.Builder
+	aqboy.EnableDebugger(in, &out)
+	aqboy.Break()
+
+	err := aqboy.Update(&window.WindowEvent{})
+	if !errors.Is(err, debugger.ErrQuit) {
+		t.Fatalf("Update: (got: %v) (expected: %v)", err, debugger.ErrQuit)
+	}
+	for _, expected := range []string{
+		"Breakpoint 0 at **:0156 if b == 2\n",
+		"Breakpoint 0 at 00:0156\n",
+		"A:0c F:40 [-N--] B:02",
+		"Watchpoint 0: write c000 = 0e (was 0c) at 00:0157\n",
+		"w0: c000 w if [$c000] > 13\n",
+		"Error: Invalid expression at 5: Unexpected end\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("Output: (got: %q) (expected to contain: %q)", out.String(), expected)
+		}
+	}
+
+	// Trace filter
+	aqboy = newTestAQBoy(t, src)
+	var trace strings.Builder
+	aqboy.SetTraceWriter(&trace)
+	cond, err := expr.Parse("pc == 0x0156 && b < 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aqboy.SetTraceFilter(cond)
+	runFrames(t, aqboy, 1)
+	if got := strings.Count(trace.String(), "PC:0156"); got != 2 || strings.Count(trace.String(), "\n") != 2 {
+		t.Fatalf("Trace: (got: %q) (expected: 2 lines at 0156)", trace.String())
+	}
+}
+
+func TestSourceBreakpoint(t *testing.T) {
+	src := `
+SECTION "main", ROM0[$0150]
+Main:
+	ld d, d
+	jr .msg
+	dw $6464
+	dw $0000
+	db "Hi"
+.msg:
+	ld b, b
+	inc a
+.end:
+	halt
+	jr .end
+`
+	aqboy := newTestAQBoy(t, src)
+	var msgs strings.Builder
+	aqboy.SetDebugMessageWriter(&msgs)
+	err := aqboy.Update(&window.WindowEvent{})
+	if !errors.Is(err, ErrSourceBreakpoint) || err.Error() != "Source breakpoint at 00:0159" {
+		t.Fatalf("Update: (got: %v) (expected: %v)", err, ErrSourceBreakpoint)
+	}
+	if msgs.String() != "Hi\n" {
+		t.Fatalf("Messages: (got: %q) (expected: %q)", msgs.String(), "Hi\n")
+	}
+
+	// Pause in the debugger
+	aqboy = newTestAQBoy(t, src)
+	aqboy.SetDebugMessageWriter(&msgs)
+	var out strings.Builder
+	aqboy.EnableDebugger(strings.NewReader("q\n"), &out)
+	err = aqboy.Update(&window.WindowEvent{})
+	if !errors.Is(err, debugger.ErrQuit) {
+		t.Fatalf("Update: (got: %v) (expected: %v)", err, debugger.ErrQuit)
+	}
+	if expected := "Source breakpoint at 00:0159\n00:015a: inc a\n"; !strings.HasPrefix(out.String(), expected) {
+		t.Fatalf("Output: (got: %q) (expected: %q)", out.String(), expected)
+	}
+}
+
+func TestEventLog(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "stat", ROM0[$0048]
+	reti
+
+SECTION "main", ROM0[$0150]
+	ld sp, $fffe
+	ld a, $91
+	ldh [$ff40], a ; LCDC
+	ld a, 100
+	ldh [$ff45], a ; LYC
+	ld a, %01000000
+	ldh [$ff41], a ; STAT: LY=LYC
+	ld a, %10      ; STAT
+	ldh [$ffff], a ; IE
+	ei
+.wait:
+	halt
+	jr .wait
+`)
+	events := aqboy.EnableEventLog(1 << 16)
+	runFrames(t, aqboy, 3)
+
+	writes := events.Query(func(e eventlog.Event) bool {
+		return e.Kind == eventlog.IOWrite && e.Addr == 0xff45
+	})
+	if len(writes) != 1 || writes[0].Value != 100 || writes[0].Frame != 0 {
+		t.Fatalf("Writes to LYC: (got: %v) (expected: one of 100)", writes)
+	}
+	stat := events.Query(func(e eventlog.Event) bool {
+		return e.Kind == eventlog.IRQ && e.Value == eventlog.STAT && e.Dot < 80
+	})
+	if len(stat) < 2 {
+		t.Fatalf("STAT interrupts: (got: %v) (expected: one per frame)", stat)
+	}
+	for _, e := range stat {
+		if e.LY != 100 {
+			t.Fatalf("STAT interrupt: (got: %v) (expected: at LY=100)", e)
+		}
+	}
+	if cycles := stat[1].Cycle - stat[0].Cycle; cycles != 70224 {
+		t.Fatalf("Interval of STAT interrupts: (got: %d) (expected: %d)", cycles, 70224)
+	}
+	dispatches := events.Query(func(e eventlog.Event) bool {
+		return e.Kind == eventlog.Dispatch && e.Cycle >= stat[0].Cycle && e.Cycle < stat[0].Cycle+100
+	})
+	if len(dispatches) != 1 || dispatches[0].Addr != 0x0048 {
+		t.Fatalf("Dispatch: (got: %v) (expected: to 0048)", dispatches)
+	}
+	modes := events.Query(func(e eventlog.Event) bool {
+		return e.Kind == eventlog.PPUMode && e.LY == 50 && e.Frame == 1
+	})
+	if len(modes) != 3 {
+		t.Fatalf("PPU modes at LY=50: (got: %v) (expected: 3 transitions)", modes)
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "vblank", ROM0[$0040]
+	nop
+	reti
+
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $fffe
+	ld a, $91
+	ldh [$ff40], a ; LCDC
+	ld a, %1       ; VBlank
+	ldh [$ffff], a ; IE
+	ei
+.loop:
+	call Wait
+	jr .loop
+
+Wait:
+	halt
+	ret
+`)
+	filename := filepath.Join(t.TempDir(), "test.sym")
+	if err := os.WriteFile(filename, []uint8("00:0040 VBlank\n00:0150 Main\n00:0161 Wait\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := aqboy.LoadSymbols(filename); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	aqboy.RecordTimeline(1, 1, &out)
+	runFrames(t, aqboy, 1)
+	if out.Len() != 0 {
+		t.Fatalf("Timeline: (got: %d bytes) (expected: none before the frame ends)", out.Len())
+	}
+	runFrames(t, aqboy, 1)
+
+	var trace struct {
+		TraceEvents []struct {
+			Name  string                 `json:"name"`
+			Phase string                 `json:"ph"`
+			TID   int                    `json:"tid"`
+			Args  map[string]interface{} `json:"args"`
+		} `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+	count := map[string]int{}
+	for _, e := range trace.TraceEvents {
+		count[e.Phase+" "+e.Name]++
+		if e.Name == "Mode 3 (Pixel Transfer)" && e.Args["ly"] == nil {
+			t.Fatalf("PPU mode: (got: %v) (expected: with ly)", e)
+		}
+	}
+	for name, expected := range map[string]int{
+		"M thread_name":             5,
+		"B Wait":                    2, // Open at the start, and called again after VBlank
+		"B VBlank":                  1,
+		"i IRQ VBlank":              1,
+		"X Dispatch VBlank":         1,
+		"X Mode 3 (Pixel Transfer)": 144,
+	} {
+		if count[name] != expected {
+			t.Fatalf("Trace events %q: (got: %d) (expected: %d)", name, count[name], expected)
+		}
+	}
+	if count["B Wait"]+count["B VBlank"] != count["E "] {
+		t.Fatalf("Trace events: (got: %d B and %d E) (expected: balanced)", count["B Wait"]+count["B VBlank"], count["E "])
+	}
+}
+
+func TestReverseExecution(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "vblank", ROM0[$0040]
+	reti
+
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $fffe
+	ld a, $91
+	ldh [$ff40], a ; LCDC
+	ld a, %1       ; VBlank
+	ldh [$ffff], a ; IE
+	ei
+.loop:
+	halt
+	ld hl, $c000
+	inc [hl] ; Count the frames
+	call Work
+	jr .loop
+
+Work:
+	ld a, [hl]
+	cp 3
+	ret nz
+	ld [$c001], a ; Corrupt at the third frame
+	ret
+`)
+	in := strings.NewReader(strings.Join([]string{
+		"x c000 2",
+		"w c001",
+		"rc", // Back to the write
+		"x c000 2",
+		"rs 2",
+		"s",
+		"x c000 2",
+		"uw",
+		"rf", // To the start of the second frame
+		"x c000 2",
+		"b 0166", // Work
+		"rc",     // To the call in the first frame
+		"x c000 2",
+		"rc", // Nothing to stop at
+		"rf 10",
+		"q",
+	}, "\n"))
+	var out strings.Builder
+	aqboy.EnableDebugger(in, &out)
+	runFrames(t, aqboy, 5)
+	aqboy.Break()
+
+	err := aqboy.Update(&window.WindowEvent{})
+	if !errors.Is(err, debugger.ErrQuit) {
+		t.Fatalf("Update: (got: %v) (expected: %v)", err, debugger.ErrQuit)
+	}
+	for _, expected := range []string{
+		"c000: 05 03\n",
+		"Watchpoint 0: write c001 = 03 (was 00) at 00:016a\n00:016d: ret\n(aqboy) c000: 03 03\n",
+		"00:0169: ret nz\n(aqboy) 00:016a: ld [$c001], a\n(aqboy) c000: 03 00\n",
+		"00:015d: ld hl, $c000\n(aqboy) c000: 01 00\n",
+		"Breakpoint 0 at 00:0166\n00:0166: ld a, [hl]\n(aqboy) c000: 01 00\n",
+		"Reached the start of the history\n00:0166: ld a, [hl]\n",
+		"Error: The history does not go back that far\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("Output: (got: %q) (expected to contain: %q)", out.String(), expected)
+		}
+	}
+}
+
+func TestReverseExecutionWithTrace(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	ld hl, $c000
+.loop:
+	inc [hl]
+	jr .loop
+`)
+	var trace strings.Builder
+	aqboy.SetTraceWriter(&trace)
+	in := strings.NewReader(strings.Join([]string{
+		"rs 10",
+		"rf",
+		"rs 10",
+		"s 3",
+		"q",
+	}, "\n"))
+	var out strings.Builder
+	aqboy.EnableDebugger(in, &out)
+	runFrames(t, aqboy, 2)
+	aqboy.Break()
+	before := strings.SplitAfter(trace.String(), "\n")
+	before = before[:len(before)-1]
+
+	err := aqboy.Update(&window.WindowEvent{})
+	if !errors.Is(err, debugger.ErrQuit) {
+		t.Fatalf("Update: (got: %v) (expected: %v)", err, debugger.ErrQuit)
+	}
+
+	// Only the instructions stepped after going back are traced again.
+	after := strings.SplitAfter(trace.String(), "\n")
+	after = after[:len(after)-1]
+	if len(after) != len(before)+3 {
+		t.Fatalf("Trace: (got: %d lines) (expected: %d lines)", len(after), len(before)+3)
+	}
+	if !strings.Contains(strings.Join(before, ""), strings.Join(after[len(before):], "")) {
+		t.Fatalf("Trace: (got: %q) (expected to be executed before)", after[len(before):])
+	}
+}
+
+func TestTraceDiff(t *testing.T) {
+	src := `
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $fffe
+	ld a, 1
+.loop:
+	add a, a
+	jr .loop
+`
+	var trace strings.Builder
+	aqboy := newTestAQBoy(t, src)
+	aqboy.SetTraceWriter(&trace)
+	runFrames(t, aqboy, 1)
+
+	// Pretend the reference got a different result from the first add.
+	lines := strings.SplitAfter(trace.String(), "\n")
+	lines[5] = strings.Replace(lines[5], "A:02", "A:03", 1)
+	aqboy = newTestAQBoy(t, src)
+	aqboy.SetTraceWriter(tracediff.NewDiffer(strings.NewReader(strings.Join(lines, ""))))
+	dir := filepath.Join(t.TempDir(), "dump")
+	aqboy.EnableCrashDump(dir)
+	err := aqboy.Update(&window.WindowEvent{})
+	var div *tracediff.Divergence
+	if !errors.As(err, &div) {
+		t.Fatalf("Update: (got: %v) (expected: a divergence)", err)
+	}
+	if strings.Contains(err.Error(), "Call stack") {
+		t.Fatalf("Update: (got: %v) (expected: not a crash)", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("Crash dump: (got: %v) (expected: none for a divergence)", err)
+	}
+	if div.Line != 6 || !strings.Contains(div.Context[len(div.Context)-1], "PC:0155") {
+		t.Fatalf("Divergence: (got: %+v) (expected: at line 6 after PC:0155)", div)
+	}
+}
+
+func TestTraceDiffWithGameboyDoctor(t *testing.T) {
+	src := `
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $fffe
+`
+	// The first lines of a log of gameboy-doctor for a ROM starting with
+	// "nop; jp $0150"
+	reference := "A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0100 PCMEM:00,C3,50,01\n" +
+		"A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0101 PCMEM:C3,50,01,CE\n"
+
+	aqboy := newTestAQBoy(t, src)
+	aqboy.SetTraceWriter(tracediff.NewDiffer(strings.NewReader(reference)))
+	err := aqboy.Update(&window.WindowEvent{})
+	var div *tracediff.Divergence
+	if !errors.As(err, &div) || div.Line != 1 {
+		t.Fatalf("CGB: (got: %v) (expected: a divergence at line 1)", err)
+	}
+
+	aqboy = newTestAQBoy(t, src)
+	aqboy.UseDMGRegisters()
+	aqboy.SetTraceWriter(tracediff.NewDiffer(strings.NewReader(reference)))
+	if err := aqboy.Update(&window.WindowEvent{}); !errors.Is(err, tracediff.ErrEndOfReference) {
+		t.Fatalf("DMG: (got: %v) (expected: %v)", err, tracediff.ErrEndOfReference)
+	}
+}
+
+func TestIORegisters(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	ld a, $93
+	ldh [$ff40], a ; LCDC
+	ld a, $05
+	ldh [$ff07], a ; TAC
+	ldh [$ffff], a ; IE
+	ld a, $e4
+	ldh [$ff47], a ; BGP
+	ld a, $f3
+	ldh [$ff12], a ; NR12
+	ld a, $80
+	ldh [$ff26], a ; NR52
+.loop:
+	jr .loop
+`)
+	runFrames(t, aqboy, 1)
+
+	for _, expected := range []string{
+		"ff07 TAC  = 05  Enable: on, Clock: 262144 Hz",
+		"ff12 NR12 = f3  Volume: 15, Direction: decrease, Pace: 3",
+		"ff26 NR52 = 80  Sound: on",
+		"ff40 LCDC = 93  LCD: on, Window map: 9800-9bff, Window: off, Tile data: 8000-8fff, BG map: 9800-9bff, OBJ size: 8x8, OBJ: on, BG/Window: on",
+		"ff47 BGP  = e4  Color 0: white, Color 1: light gray, Color 2: dark gray, Color 3: black",
+		"ffff IE   = 05  VBlank: on, STAT: off, Timer: on, Serial: off, Joypad: off",
+	} {
+		name := strings.Fields(expected)[1]
+		r, ok := ioreg.Find(aqboy.IORegisters(), name)
+		if !ok || r.String() != expected {
+			t.Fatalf("IORegisters: (got: %q) (expected: %q)", r.String(), expected)
+		}
+	}
+
+	in := strings.NewReader("io stat\nio\nio ff46\nq\n")
+	var out strings.Builder
+	aqboy.EnableDebugger(in, &out)
+	aqboy.Break()
+	err := aqboy.Update(&window.WindowEvent{})
+	if !errors.Is(err, debugger.ErrQuit) {
+		t.Fatalf("Update: (got: %v) (expected: %v)", err, debugger.ErrQuit)
+	}
+	for _, expected := range []string{
+		"(aqboy) ff41 STAT = ",
+		"  Mode: ",
+		"ff00 P1   = ",
+		"ff44 LY   = ",
+		"Error: No I/O register: ff46\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("Output: (got: %q) (expected to contain: %q)", out.String(), expected)
+		}
+	}
+}
+
+func TestPokeAndFreeze(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	ld a, $11
+	ld [$c001], a
+	ld a, $11
+	ld [$c002], a
+	jr Main
+`)
+	runFrames(t, aqboy, 1)
+
+	pokes, err := aqboy.ParsePokes("0151=33")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aqboy.Poke(pokes[0]); err != nil {
+		t.Fatalf("Poke: (got: %v) (expected: no error)", err)
+	}
+	if err := aqboy.Freeze(mmu.Poke{Bank: -1, Addr: 0xc002, Val: 0x22}); err != nil {
+		t.Fatalf("Freeze: (got: %v) (expected: no error)", err)
+	}
+	runFrames(t, aqboy, 1)
+	if got := aqboy.mmu.Peek8(0xc001); got != 0x33 {
+		t.Fatalf("Patched ROM: (got: %02x) (expected: 33)", got)
+	}
+	if got := aqboy.mmu.Peek8(0xc002); got != 0x22 {
+		t.Fatalf("Frozen: (got: %02x) (expected: 22)", got)
+	}
+	if aqboy.rom[0x0151] != 0x11 {
+		t.Fatalf("Source ROM: (got: %02x) (expected: 11)", aqboy.rom[0x0151])
+	}
+
+	for _, p := range []mmu.Poke{
+		{Bank: -1, Addr: 0xff40, Val: 0},
+		{Bank: 0x40, Addr: 0x4000, Val: 0},
+		{Bank: 0, Addr: 0xa000, Val: 0},
+	} {
+		if err := aqboy.Poke(p); err == nil {
+			t.Fatalf("Poke %v: (got: no error) (expected: an error)", p)
+		}
+	}
+
+	in := strings.NewReader(strings.Join([]string{
+		"poke c100 01 02",
+		"x c100 2",
+		"fr c003 05",
+		"info",
+		"ufr 2",
+		"ufr",
+		"info",
+		"q",
+	}, "\n"))
+	var out strings.Builder
+	aqboy.EnableDebugger(in, &out)
+	aqboy.Break()
+	err = aqboy.Update(&window.WindowEvent{})
+	if !errors.Is(err, debugger.ErrQuit) {
+		t.Fatalf("Update: (got: %v) (expected: %v)", err, debugger.ErrQuit)
+	}
+	for _, expected := range []string{
+		"c100: 01 02\n",
+		"Frozen c003 = 05\n",
+		"f0: c002 = 22\nf1: c003 = 05\n",
+		"Error: No freeze: 2\n",
+		"No watchpoints\n(aqboy) ",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("Output: (got: %q) (expected to contain: %q)", out.String(), expected)
+		}
+	}
+	if len(aqboy.Freezes()) != 0 {
+		t.Fatalf("Freezes: (got: %v) (expected: none)", aqboy.Freezes())
+	}
+}
+
+func TestDebugWrite(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	halt
+	jr Main
+`)
+	m := debugMachine{aqboy}
+	for _, entry := range []struct {
+		addr uint16
+		val  uint8
+	}{
+		{0x0150, 0x00}, // ROM, patched
+		{0x2000, 0x00}, // ROM, not switching the bank
+		{0xc000, 0x42}, // WRAM
+		{0xff40, 0x91}, // LCDC
+		{0xffff, 0x1f}, // IE
+	} {
+		if err := m.Write(entry.addr, entry.val); err != nil {
+			t.Fatalf("Write %04x: %v", entry.addr, err)
+		}
+		if got := aqboy.mmu.Peek8(entry.addr); got != entry.val {
+			t.Fatalf("Write %04x: (got: %02x) (expected: %02x)", entry.addr, got, entry.val)
+		}
+	}
+	if aqboy.mmu.Bank(0x4000) != 1 {
+		t.Fatalf("Bank: (got: %d) (expected: 1)", aqboy.mmu.Bank(0x4000))
+	}
+	for _, addr := range []uint16{0xa000, 0xff03, 0xff44} { // No cartridge RAM, unused, LY
+		if err := m.CheckWrite(addr); err == nil {
+			t.Fatalf("CheckWrite %04x: (got: nil) (expected: an error)", addr)
+		}
+	}
+}
+
+func TestParsePokes(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	jr Main
+`)
+	filename := filepath.Join(t.TempDir(), "test.sym")
+	if err := os.WriteFile(filename, []uint8("00:0150 Main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := aqboy.LoadSymbols(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{"c000=de,ad", "[c000 = de c001 = ad]"},
+		{"01:4000=c9", "[01:4000 = c9]"},
+		{"$ff80=0x3c", "[ff80 = 3c]"},
+		{"Main=18", "[00:0150 = 18]"},
+	}
+	for _, c := range cases {
+		pokes, err := aqboy.ParsePokes(c.src)
+		if err != nil || fmt.Sprint(pokes) != c.expected {
+			t.Fatalf("ParsePokes %s: (got: %v, %v) (expected: %s)", c.src, pokes, err, c.expected)
+		}
+	}
+	for _, src := range []string{"c000", "c000=100", "zz=1", "ffff=1,2"} {
+		if _, err := aqboy.ParsePokes(src); err == nil {
+			t.Fatalf("ParsePokes %s: (got: no error) (expected: an error)", src)
+		}
+	}
+}
+
+func TestTileImage(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	ld hl, $8010 ; Tile 1
+	ld a, $ff
+	ld [hl+], a
+	xor a
+	ld [hl+], a ; Row 0: color 1
+	ld [hl+], a
+	cpl
+	ld [hl+], a ; Row 1: color 2
+	ld [hl+], a
+	ld [hl+], a ; Row 2: color 3
+	ld a, $1b
+	ldh [$ff47], a ; BGP
+.loop:
+	jr .loop
+`)
+	runFrames(t, aqboy, 1)
+
+	img := aqboy.TileImage(0xe4)
+	if size := img.Bounds().Size(); size.X != 128 || size.Y != 192 {
+		t.Fatalf("Size: (got: %v) (expected: 128x192)", size)
+	}
+	for _, c := range []struct {
+		x, y     int
+		expected uint8
+	}{
+		{0, 0, 0}, {8, 0, 1}, {15, 1, 2}, {12, 2, 3}, {8, 3, 0},
+	} {
+		if got := img.ColorIndexAt(c.x, c.y); got != c.expected {
+			t.Fatalf("Pixel (%d, %d): (got: %d) (expected: %d)", c.x, c.y, got, c.expected)
+		}
+	}
+
+	filename := filepath.Join(t.TempDir(), "tiles.png")
+	in := strings.NewReader("tiles " + filename + "\ntiles\nq\n")
+	var out strings.Builder
+	aqboy.EnableDebugger(in, &out)
+	aqboy.Break()
+	err := aqboy.Update(&window.WindowEvent{})
+	if !errors.Is(err, debugger.ErrQuit) {
+		t.Fatalf("Update: (got: %v) (expected: %v)", err, debugger.ErrQuit)
+	}
+	if !strings.Contains(out.String(), "Error: File name required\n") {
+		t.Fatalf("Output: (got: %q) (expected: an error of tiles)", out.String())
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	written, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// BGP maps the color 1 to 2.
+	if got := color.GrayModel.Convert(written.At(8, 0)); got != ppu.Shades[2] {
+		t.Fatalf("Written pixel: (got: %v) (expected: %v)", got, ppu.Shades[2])
+	}
+}
+
+func TestTileMapImage(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	ld hl, $9010 ; Tile 1 addressed from 9000
+	ld a, $ff
+	ld b, 16
+.fill:
+	ld [hl+], a
+	dec b
+	jr nz, .fill
+	ld a, 1
+	ld [$9800], a
+	ld a, 250
+	ldh [$ff43], a ; SCX
+	ld a, 87
+	ldh [$ff4b], a ; WX
+	ld a, 100
+	ldh [$ff4a], a ; WY
+	ld a, $e4
+	ldh [$ff47], a ; BGP
+	ld a, $a1      ; LCD, window and BG on, tile data at 8800-97ff
+	ldh [$ff40], a ; LCDC
+.loop:
+	jr .loop
+`)
+	runFrames(t, aqboy, 1)
+
+	img := aqboy.TileMapImage(0)
+	if size := img.Bounds().Size(); size.X != 256 || size.Y != 256 {
+		t.Fatalf("Size: (got: %v) (expected: 256x256)", size)
+	}
+	for _, c := range []struct {
+		x, y     int
+		expected uint8
+	}{
+		{3, 3, 3}, {10, 3, 0},
+		{250, 10, ppu.ViewportColor}, {153, 10, ppu.ViewportColor}, // Wrapped around
+		{100, 0, ppu.ViewportColor}, {100, 143, ppu.ViewportColor},
+		{154, 10, 0}, {249, 10, 0},
+		{74, 120, ppu.WindowColor}, {100, 100, ppu.WindowColor},
+	} {
+		if got := img.ColorIndexAt(c.x, c.y); got != c.expected {
+			t.Fatalf("Pixel (%d, %d): (got: %d) (expected: %d)", c.x, c.y, got, c.expected)
+		}
+	}
+	// Inside the outlines and above the window, it is what is on the screen.
+	screen := aqboy.wind.(*window.HeadlessWindow).Screen
+	for y := 1; y < 100; y++ {
+		for x := 1; x < 159; x++ {
+			if got, expected := img.ColorIndexAt((250+x)%256, y), screen[y*160+x]; got != expected {
+				t.Fatalf("Pixel on the screen (%d, %d): (got: %d) (expected: %d)", x, y, got, expected)
+			}
+		}
+	}
+	if got := aqboy.TileMapImage(0x9c00).ColorIndexAt(3, 3); got != 0 {
+		t.Fatalf("Pixel of 9c00: (got: %d) (expected: 0)", got)
+	}
+
+	filename := filepath.Join(t.TempDir(), "map.png")
+	in := strings.NewReader("map " + filename + " 9c00\nmap " + filename + " 9000\nq\n")
+	var out strings.Builder
+	aqboy.EnableDebugger(in, &out)
+	aqboy.Break()
+	err := aqboy.Update(&window.WindowEvent{})
+	if !errors.Is(err, debugger.ErrQuit) {
+		t.Fatalf("Update: (got: %v) (expected: %v)", err, debugger.ErrQuit)
+	}
+	for _, expected := range []string{
+		"Wrote " + filename + "\n",
+		"Error: Invalid tile map (expected: 9800 or 9c00): 9000\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("Output: (got: %q) (expected to contain: %q)", out.String(), expected)
+		}
+	}
+}
+
+func TestCrashDump(t *testing.T) {
+	for _, tc := range []struct {
+		name, crash, expected string
+		panic                 bool
+	}{
+		{"illegal", "db $d3", "Illegal instr: 0xd3 at 0x015b", false},
+		{"panic", "ldh a, [$ff42]", "Panic: Invalid memory access of Get8: at 0x0000ff42", true},
+	} {
+		aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $fffe
+	ld a, $42
+	ld [$c000], a
+	call Crash
+
+Crash:
+	`+tc.crash+`
+`)
+		dir := filepath.Join(t.TempDir(), "dump")
+		aqboy.EnableCrashDump(dir)
+		err := aqboy.Update(&window.WindowEvent{})
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("%s: Update: (got: %v) (expected: %q)", tc.name, err, tc.expected)
+		}
+
+		d, err := crashdump.Read(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(d.Error, tc.expected) || (d.Panic != "") != tc.panic {
+			t.Fatalf("%s: Error: (got: %q %q) (expected: %q)", tc.name, d.Error, d.Panic, tc.expected)
+		}
+		if d.WRAM[0] != 0x42 || len(d.VRAM) != 0x2000 || len(d.IO) != 0x80 || d.State.PC != 0x015b {
+			t.Fatalf("%s: Dump: (got: %+v) (expected: WRAM[0]=42 and PC=015b)", tc.name, d)
+		}
+		last := d.History[len(d.History)-1]
+		if last.State.PC != 0x015b || last.Bank != 0 {
+			t.Fatalf("%s: History: (got: %+v) (expected: the crashing instruction)", tc.name, last)
+		}
+		report, err := os.ReadFile(filepath.Join(dir, "report.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(report), "CALL 00:015b from 00:0158") {
+			t.Fatalf("%s: Report: (got: %s) (expected: the call stack)", tc.name, report)
+		}
+
+		var out strings.Builder
+		err = InspectCrashDump(dir, aqboy.rom, strings.NewReader("x c000 1\nbt\ns\nio ie\nq\n"), &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range []string{
+			"00:015b: ",
+			"c000: 42\n",
+			"#0 CALL 00:015b from 00:0158",
+			"Error: A crash dump cannot be executed\n",
+			"ffff IE   = 00  VBlank: off,",
+		} {
+			if !strings.Contains(out.String(), expected) {
+				t.Fatalf("%s: Output: (got: %q) (expected to contain: %q)", tc.name, out.String(), expected)
+			}
+		}
+	}
+}
+
+func TestCrashDumpWithROMPatch(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $fffe
+	call Crash
+
+Crash:
+	nop ; Patched to an illegal instruction
+	halt
+`)
+	if err := aqboy.Poke(mmu.Poke{Bank: -1, Addr: 0x0156, Val: 0xd3}); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "dump")
+	aqboy.EnableCrashDump(dir)
+	if err := aqboy.Update(&window.WindowEvent{}); err == nil {
+		t.Fatalf("Update: (got: nil) (expected: a crash)")
+	}
+
+	report, err := os.ReadFile(filepath.Join(dir, "report.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(report), "ROM patch: 00:0156 = d3\n") {
+		t.Fatalf("Report: (got: %s) (expected: the patch)", report)
+	}
+	var out strings.Builder
+	err = InspectCrashDump(dir, aqboy.rom, strings.NewReader("x 0156 1\nl 0156\nq\n"), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"0156: d3\n", "db $d3"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("Output: (got: %q) (expected to contain: %q)", out.String(), expected)
+		}
+	}
+}
+
+func TestCodeInOAM(t *testing.T) {
+	// Run `ld a, N; ret` copied to OAM by DMA, and rewrite N by DMA and by
+	// the CPU.
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $fffe
+	ld hl, $c100
+	ld a, $3e ; ld a, d8
+	ld [hl+], a
+	ld a, 1
+	ld [hl+], a
+	ld a, $c9 ; ret
+	ld [hl], a
+	ld a, $c1
+	ldh [$ff46], a ; DMA
+	call $fe00
+	ld [$c000], a
+
+	ld a, 2
+	ld [$c101], a
+	ld a, $c1
+	ldh [$ff46], a
+	call $fe00
+	ld [$c001], a
+
+	ld a, 3
+	ld [$fe01], a
+	call $fe00
+	ld [$c002], a
+.loop:
+	halt
+	jr .loop
+`)
+	runFrames(t, aqboy, 1)
+	for i, expected := range []uint8{1, 2, 3} {
+		if got := aqboy.mmu.Peek8(0xc000 + uint16(i)); got != expected {
+			t.Fatalf("Call %d: (got: %d) (expected: %d)", i, got, expected)
+		}
+	}
+}
+
+// BenchmarkFrame runs a frame of a loop which reads and writes WRAM, with and
+// without the cache of decoded blocks.
+func BenchmarkFrame(b *testing.B) {
+	src := `
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $fffe
+	ld a, $91
+	ldh [$ff40], a ; LCDC
+.loop:
+	ld hl, $c000
+	ld b, 64
+.inner:
+	ld a, [hl]
+	add a, b
+	ld [hl+], a
+	dec b
+	jr nz, .inner
+	call Count
+	jr .loop
+
+Count:
+	ld a, [$c000]
+	inc a
+	ld [$c000], a
+	ret
+`
+	for _, entry := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"Cached", true},
+		{"Uncached", false},
+	} {
+		b.Run(entry.name, func(b *testing.B) {
+			aqboy := newTestAQBoy(b, src)
+			aqboy.cpu.SetBlockCacheEnabled(entry.enabled)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := aqboy.Update(&window.WindowEvent{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPanicWithoutCrashDump(t *testing.T) {
+	aqboy := newTestAQBoy(t, `
+SECTION "main", ROM0[$0150]
+Main:
+	ldh a, [$ff42]
+`)
+	err := aqboy.Update(&window.WindowEvent{})
+	expected := "Panic: Invalid memory access of Get8: at 0x0000ff42"
+	if err == nil || !strings.Contains(err.Error(), expected) || !strings.Contains(err.Error(), "Call stack") {
+		t.Fatalf("Update: (got: %v) (expected: %q with the call stack)", err, expected)
+	}
+}
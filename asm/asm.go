@@ -0,0 +1,516 @@
+// Package asm implements a small assembler for SM83, the CPU of Game Boy.
+//
+// It accepts a subset of the RGBDS syntax that is enough to write test ROMs:
+//
+//	SECTION "main", ROM0[$0150]
+//	Main:
+//	    ld a, $3c
+//	.loop:
+//	    dec a
+//	    jr nz, .loop
+//	    halt
+//	Message: db "hello", 0
+//	Table:   dw Main, .loop
+//
+// Supported directives are SECTION (ROM0, ROMX with BANK[n], WRAM0, WRAMX
+// and HRAM), DB, DW, DS and EQU. Code is placed at $0150 unless a SECTION
+// says otherwise, and the entry point at $0100 jumps to $0150 unless a
+// section occupies it. The resulting image has a valid cartridge header.
+package asm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Symbol is the location of a label.
+type Symbol struct {
+	Bank int
+	Addr uint16
+}
+
+// Program is the result of an assembly.
+type Program struct {
+	ROM     []uint8
+	Symbols map[string]Symbol
+}
+
+type region int
+
+const (
+	regionROM0 region = iota
+	regionROMX
+	regionWRAM0
+	regionWRAMX
+	regionHRAM
+)
+
+var regionInfo = map[string]struct {
+	region     region
+	start, end int
+}{
+	"ROM0":  {regionROM0, 0x0000, 0x4000},
+	"ROMX":  {regionROMX, 0x4000, 0x8000},
+	"WRAM0": {regionWRAM0, 0xc000, 0xd000},
+	"WRAMX": {regionWRAMX, 0xd000, 0xe000},
+	"HRAM":  {regionHRAM, 0xff80, 0xffff},
+}
+
+type section struct {
+	name     string
+	region   region
+	bank     int
+	pc, end  int
+	hasBytes bool
+}
+
+type assembler struct {
+	final   bool
+	symbols map[string]Symbol
+	equs    map[string]int
+	scope   string
+	sec     *section
+	cursors map[[2]int]int // (region, bank) --> next free address
+	banks   map[int][]uint8
+	written map[int][]bool
+	lineNo  int
+}
+
+// Assemble assembles src and returns the ROM image.
+func Assemble(src string) ([]uint8, error) {
+	prog, err := AssembleProgram(src)
+	if err != nil {
+		return nil, err
+	}
+	return prog.ROM, nil
+}
+
+// AssembleProgram assembles src and returns the ROM image along with the
+// locations of all labels.
+func AssembleProgram(src string) (*Program, error) {
+	lines := strings.Split(src, "\n")
+
+	// Pass 1: Determine the addresses of the labels.
+	a := newAssembler(false, nil)
+	if err := a.run(lines); err != nil {
+		return nil, err
+	}
+
+	// Pass 2: Emit the code with the labels resolved.
+	a = newAssembler(true, a.symbols)
+	if err := a.run(lines); err != nil {
+		return nil, err
+	}
+
+	rom, err := a.buildROM()
+	if err != nil {
+		return nil, err
+	}
+	return &Program{ROM: rom, Symbols: a.symbols}, nil
+}
+
+// LineSize returns the number of bytes emitted for a line of source code,
+// which may define a label. Symbols are not resolved, so the line may refer
+// to labels defined elsewhere. Directives other than DB, DW and DS are errors.
+func LineSize(line string) (int, error) {
+	a := newAssembler(false, nil)
+	if err := a.openSection("", "ROMX[$4000]"); err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(stripComment(line))
+	if len(fields) > 0 && strings.ToLower(fields[0]) == "section" {
+		return 0, fmt.Errorf("SECTION has no size")
+	}
+	if err := a.assembleLine(line); err != nil {
+		return 0, err
+	}
+	return a.sec.pc - 0x4000, nil
+}
+
+func newAssembler(final bool, symbols map[string]Symbol) *assembler {
+	if symbols == nil {
+		symbols = map[string]Symbol{}
+	}
+	return &assembler{
+		final:   final,
+		symbols: symbols,
+		equs:    map[string]int{},
+		cursors: map[[2]int]int{},
+		banks:   map[int][]uint8{},
+		written: map[int][]bool{},
+	}
+}
+
+func (a *assembler) run(lines []string) error {
+	a.sec = nil
+	if err := a.openSection("", "ROM0[$0150]"); err != nil {
+		return err
+	}
+	for i, line := range lines {
+		a.lineNo = i + 1
+		if err := a.assembleLine(line); err != nil {
+			return fmt.Errorf("line %d: %v", a.lineNo, err)
+		}
+	}
+	a.closeSection()
+	return nil
+}
+
+func stripComment(line string) string {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			inString = !inString
+		case ';':
+			if !inString {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// splitOperands splits src by commas that are not in strings or brackets.
+func splitOperands(src string) []string {
+	if strings.TrimSpace(src) == "" {
+		return nil
+	}
+	ret := []string{}
+	depth, inString, begin := 0, false, 0
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; {
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			ret = append(ret, strings.TrimSpace(src[begin:i]))
+			begin = i + 1
+		}
+	}
+	return append(ret, strings.TrimSpace(src[begin:]))
+}
+
+func (a *assembler) qualify(name string) string {
+	if strings.HasPrefix(name, ".") {
+		return a.scope + name
+	}
+	return name
+}
+
+func (a *assembler) lookup(name string) (int, error) {
+	if name == "@" {
+		return a.sec.pc, nil
+	}
+	if val, ok := a.equs[name]; ok {
+		return val, nil
+	}
+	if sym, ok := a.symbols[a.qualify(name)]; ok {
+		return int(sym.Addr), nil
+	}
+	if a.final {
+		return 0, fmt.Errorf("Undefined symbol: %s", name)
+	}
+	return 0, nil
+}
+
+func (a *assembler) defineLabel(name string) error {
+	if !strings.HasPrefix(name, ".") {
+		a.scope = name
+	}
+	name = a.qualify(name)
+	sym := Symbol{Bank: a.sec.bank, Addr: uint16(a.sec.pc)}
+	if old, ok := a.symbols[name]; ok && !a.final {
+		return fmt.Errorf("Duplicate label: %s (already defined at %02x:%04x)", name, old.Bank, old.Addr)
+	}
+	a.symbols[name] = sym
+	return nil
+}
+
+func (a *assembler) assembleLine(line string) error {
+	line = strings.TrimSpace(stripComment(line))
+
+	// Label
+	if i := strings.Index(line, ":"); i > 0 && !strings.ContainsAny(line[:i], " \t\",[") {
+		if err := a.defineLabel(line[:i]); err != nil {
+			return err
+		}
+		line = strings.TrimSpace(strings.TrimLeft(line[i:], ":"))
+	}
+	if line == "" {
+		return nil
+	}
+
+	fields := strings.SplitN(strings.ReplaceAll(line, "\t", " "), " ", 2)
+	mnemonic := strings.ToLower(fields[0])
+	rest := ""
+	if len(fields) == 2 {
+		rest = strings.TrimSpace(fields[1])
+	}
+
+	// EQU
+	if mnemonic == "def" {
+		return a.assembleLine(rest)
+	}
+	if f := strings.SplitN(rest, " ", 2); len(f) == 2 && strings.ToLower(f[0]) == "equ" {
+		val, err := a.eval(f[1])
+		if err != nil {
+			return err
+		}
+		a.equs[fields[0]] = val
+		return nil
+	}
+
+	operands := splitOperands(rest)
+	switch mnemonic {
+	case "section":
+		if len(operands) < 2 {
+			return fmt.Errorf("SECTION needs a name and a type")
+		}
+		return a.openSection(strings.Trim(operands[0], "\""), strings.Join(operands[1:], ","))
+	case "db":
+		return a.assembleDB(operands)
+	case "dw":
+		for _, op := range operands {
+			if err := a.emitImm16(op); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "ds":
+		return a.assembleDS(operands)
+	}
+
+	return a.assembleInstr(mnemonic, operands)
+}
+
+func (a *assembler) assembleDB(operands []string) error {
+	for _, op := range operands {
+		if strings.HasPrefix(op, "\"") {
+			if len(op) < 2 || !strings.HasSuffix(op, "\"") {
+				return fmt.Errorf("Unterminated string: %s", op)
+			}
+			if err := a.emit([]uint8(op[1 : len(op)-1])...); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := a.emitImm8(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *assembler) assembleDS(operands []string) error {
+	if len(operands) < 1 || len(operands) > 2 {
+		return fmt.Errorf("DS needs a size and an optional fill value")
+	}
+	size, err := a.eval(operands[0])
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("Negative size for DS: %d", size)
+	}
+	if a.sec.region != regionROM0 && a.sec.region != regionROMX {
+		a.sec.pc += size
+		return a.checkSectionBounds()
+	}
+	fill := 0
+	if len(operands) == 2 {
+		if fill, err = a.eval(operands[1]); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < size; i++ {
+		if err := a.emit(uint8(fill)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openSection starts a section. typ is e.g. `ROM0`, `ROM0[$0150]` or
+// `ROMX[$4000], BANK[2]`.
+func (a *assembler) openSection(name, typ string) error {
+	a.closeSection()
+
+	parts := splitOperands(typ)
+	kind, addrExpr := parseBracketed(parts[0])
+	info, ok := regionInfo[strings.ToUpper(kind)]
+	if !ok {
+		return fmt.Errorf("Unsupported section type: %s", kind)
+	}
+	bank := 0
+	if info.region == regionROMX {
+		bank = 1
+	}
+	for _, opt := range parts[1:] {
+		key, val := parseBracketed(opt)
+		if strings.ToUpper(key) != "BANK" || info.region != regionROMX {
+			return fmt.Errorf("Unsupported section option: %s", opt)
+		}
+		n, err := a.eval(val)
+		if err != nil {
+			return err
+		}
+		if n < 1 || n > 127 {
+			return fmt.Errorf("Invalid bank number: %d", n)
+		}
+		bank = n
+	}
+
+	cursorKey := [2]int{int(info.region), bank}
+	pc, ok := a.cursors[cursorKey]
+	if !ok {
+		pc = info.start
+	}
+	if addrExpr != "" {
+		addr, err := a.eval(addrExpr)
+		if err != nil {
+			return err
+		}
+		if addr < info.start || addr >= info.end {
+			return fmt.Errorf("Address $%04x is out of %s", addr, kind)
+		}
+		pc = addr
+	}
+
+	a.sec = &section{
+		name:   name,
+		region: info.region,
+		bank:   bank,
+		pc:     pc,
+		end:    info.end,
+	}
+	return nil
+}
+
+func (a *assembler) closeSection() {
+	if a.sec != nil {
+		a.cursors[[2]int{int(a.sec.region), a.sec.bank}] = a.sec.pc
+	}
+}
+
+// parseBracketed splits `NAME[expr]` into `NAME` and `expr`.
+func parseBracketed(src string) (string, string) {
+	src = strings.TrimSpace(src)
+	i := strings.Index(src, "[")
+	if i < 0 || !strings.HasSuffix(src, "]") {
+		return src, ""
+	}
+	return strings.TrimSpace(src[:i]), src[i+1 : len(src)-1]
+}
+
+func (a *assembler) checkSectionBounds() error {
+	if a.sec.pc > a.sec.end {
+		return fmt.Errorf("Section \"%s\" overflows at $%04x", a.sec.name, a.sec.end)
+	}
+	return nil
+}
+
+func (a *assembler) emit(bytes ...uint8) error {
+	sec := a.sec
+	if sec.region != regionROM0 && sec.region != regionROMX {
+		return fmt.Errorf("Section \"%s\" cannot contain code or data", sec.name)
+	}
+	for _, b := range bytes {
+		if sec.pc >= sec.end {
+			return a.checkSectionBounds()
+		}
+		bank, off := sec.bank, sec.pc&0x3fff
+		if a.banks[bank] == nil {
+			a.banks[bank] = make([]uint8, 0x4000)
+			a.written[bank] = make([]bool, 0x4000)
+		}
+		if a.written[bank][off] {
+			return fmt.Errorf("Overlapping data at %02x:%04x", bank, sec.pc)
+		}
+		if bank == 0 && 0x0104 <= off && off < 0x0150 {
+			return fmt.Errorf("Section \"%s\" overlaps the cartridge header at $%04x", sec.name, sec.pc)
+		}
+		a.banks[bank][off] = b
+		a.written[bank][off] = true
+		sec.pc++
+	}
+	return nil
+}
+
+func (a *assembler) emitImm8(expr string) error {
+	val, err := a.eval(expr)
+	if err != nil {
+		return err
+	}
+	if a.final && (val < -128 || val > 0xff) {
+		return fmt.Errorf("Value out of 8-bit range: %s = %d", expr, val)
+	}
+	return a.emit(uint8(val))
+}
+
+func (a *assembler) emitImm16(expr string) error {
+	val, err := a.eval(expr)
+	if err != nil {
+		return err
+	}
+	if a.final && (val < -32768 || val > 0xffff) {
+		return fmt.Errorf("Value out of 16-bit range: %s = %d", expr, val)
+	}
+	return a.emit(uint8(val), uint8(val>>8))
+}
+
+var nintendoLogo = []uint8{
+	0xce, 0xed, 0x66, 0x66, 0xcc, 0x0d, 0x00, 0x0b, 0x03, 0x73, 0x00, 0x83, 0x00, 0x0c, 0x00, 0x0d,
+	0x00, 0x08, 0x11, 0x1f, 0x88, 0x89, 0x00, 0x0e, 0xdc, 0xcc, 0x6e, 0xe6, 0xdd, 0xdd, 0xd9, 0x99,
+	0xbb, 0xbb, 0x67, 0x63, 0x6e, 0x0e, 0xec, 0xcc, 0xdd, 0xdc, 0x99, 0x9f, 0xbb, 0xb9, 0x33, 0x3e,
+}
+
+func (a *assembler) buildROM() ([]uint8, error) {
+	numBanks := 2
+	for bank := range a.banks {
+		for numBanks <= bank {
+			numBanks *= 2
+		}
+	}
+
+	rom := make([]uint8, numBanks*0x4000)
+	for bank, data := range a.banks {
+		copy(rom[bank*0x4000:], data)
+	}
+
+	// Entry point
+	if a.banks[0] == nil || !a.written[0][0x100] {
+		copy(rom[0x100:], []uint8{0x00, 0xc3, 0x50, 0x01}) // nop; jp $0150
+	}
+
+	// Cartridge header
+	copy(rom[0x104:], nintendoLogo)
+	copy(rom[0x134:0x144], "AQBOY")
+	if numBanks > 2 {
+		rom[0x147] = 0x01 // MBC1
+	}
+	log2Banks := 0
+	for 1<<log2Banks < numBanks {
+		log2Banks++
+	}
+	rom[0x148] = uint8(log2Banks - 1)
+	var headerSum uint8
+	for _, b := range rom[0x134:0x14d] {
+		headerSum = headerSum - b - 1
+	}
+	rom[0x14d] = headerSum
+	var globalSum uint16
+	for i, b := range rom {
+		if i != 0x14e && i != 0x14f {
+			globalSum += uint16(b)
+		}
+	}
+	rom[0x14e] = uint8(globalSum >> 8)
+	rom[0x14f] = uint8(globalSum)
+
+	return rom, nil
+}
@@ -0,0 +1,155 @@
+package asm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncoding(t *testing.T) {
+	table := []struct {
+		src      string
+		expected []uint8
+	}{
+		{"nop", []uint8{0x00}},
+		{"ld a, $3c", []uint8{0x3e, 0x3c}},
+		{"ld [hl], b", []uint8{0x70}},
+		{"ld bc, $1234", []uint8{0x01, 0x34, 0x12}},
+		{"ld [hl+], a", []uint8{0x22}},
+		{"ld a, [hld]", []uint8{0x3a}},
+		{"ld [$c000], a", []uint8{0xea, 0x00, 0xc0}},
+		{"ld [$c000], sp", []uint8{0x08, 0x00, 0xc0}},
+		{"ld hl, sp+-2", []uint8{0xf8, 0xfe}},
+		{"ldh [$ff44], a", []uint8{0xe0, 0x44}},
+		{"ldh a, [c]", []uint8{0xf2}},
+		{"add hl, de", []uint8{0x19}},
+		{"add sp, 4", []uint8{0xe8, 0x04}},
+		{"sub a, c", []uint8{0x91}},
+		{"cp 'A'", []uint8{0xfe, 0x41}},
+		{"inc sp", []uint8{0x33}},
+		{"dec [hl]", []uint8{0x35}},
+		{"push af", []uint8{0xf5}},
+		{"jp c, $0150", []uint8{0xda, 0x50, 0x01}},
+		{"jp hl", []uint8{0xe9}},
+		{"ret nz", []uint8{0xc0}},
+		{"rst $38", []uint8{0xff}},
+		{"bit 7, h", []uint8{0xcb, 0x7c}},
+		{"swap a", []uint8{0xcb, 0x37}},
+		{"db 1, \"AB\", -1", []uint8{0x01, 0x41, 0x42, 0xff}},
+		{"dw $1234, HIGH($abcd)", []uint8{0x34, 0x12, 0xab, 0x00}},
+		{"ds 2, $76", []uint8{0x76, 0x76}},
+	}
+
+	for _, entry := range table {
+		rom, err := Assemble(entry.src)
+		if err != nil {
+			t.Fatalf("%s: %v", entry.src, err)
+		}
+		got := rom[0x150 : 0x150+len(entry.expected)]
+		if !bytes.Equal(got, entry.expected) {
+			t.Fatalf("%s: (got: % x) (expected: % x)", entry.src, got, entry.expected)
+		}
+	}
+}
+
+func TestLabelsAndSections(t *testing.T) {
+	prog, err := AssembleProgram(`
+SECTION "vars", WRAM0[$C000]
+Counter: ds 1
+
+SECTION "main", ROM0[$0150]
+Main:
+	ld hl, Counter
+.loop:
+	inc [hl]
+	jr nz, .loop
+	call Far
+	jr Main.loop
+
+SECTION "far", ROMX[$4000], BANK[2]
+Far:
+	ret
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]Symbol{
+		"Counter":   {0, 0xc000},
+		"Main":      {0, 0x0150},
+		"Main.loop": {0, 0x0153},
+		"Far":       {2, 0x4000},
+	}
+	for name, sym := range expected {
+		if prog.Symbols[name] != sym {
+			t.Fatalf("%s: (got: %v) (expected: %v)", name, prog.Symbols[name], sym)
+		}
+	}
+
+	rom := prog.ROM
+	if len(rom) != 4*0x4000 || rom[0x147] != 0x01 || rom[0x148] != 0x01 {
+		t.Fatalf("Invalid ROM layout: size=%d type=%02x rom_size=%02x", len(rom), rom[0x147], rom[0x148])
+	}
+	if !bytes.Equal(rom[0x150:0x15b], []uint8{0x21, 0x00, 0xc0, 0x34, 0x20, 0xfd, 0xcd, 0x00, 0x40, 0x18, 0xf8}) {
+		t.Fatalf("Unexpected code: % x", rom[0x150:0x15b])
+	}
+	if rom[2*0x4000] != 0xc9 {
+		t.Fatalf("Far is not placed in bank 2")
+	}
+
+	var headerSum uint8
+	for _, b := range rom[0x134:0x14d] {
+		headerSum = headerSum - b - 1
+	}
+	if rom[0x14d] != headerSum {
+		t.Fatalf("Invalid header checksum: %02x", rom[0x14d])
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, src := range []string{
+		"ld [hl], [hl]",
+		"jr Far\nds 200\nFar:",
+		"foo a",
+		"ld a, Undefined",
+		"SECTION \"hdr\", ROM0[$0104]\nnop",
+		"Dup:\nDup:",
+	} {
+		if _, err := Assemble(src); err == nil {
+			t.Fatalf("Expected an error: %q", src)
+		}
+	}
+}
+
+func TestLineSize(t *testing.T) {
+	for _, entry := range []struct {
+		line     string
+		expected int
+	}{
+		{"", 0},
+		{"Main:", 0},
+		{"\tcall Elsewhere ; comment", 3},
+		{".loop: jr nz, .loop", 2},
+		{"\tldh [hFlag], a", 2},
+		{"\tbit 7, h", 2},
+		{"Message: db \"hello\", 0", 6},
+		{"\tds 4", 4},
+		{"Size EQU 10", 0},
+	} {
+		got, err := LineSize(entry.line)
+		if err != nil {
+			t.Fatalf("%q: %v", entry.line, err)
+		}
+		if got != entry.expected {
+			t.Fatalf("%q: (got: %d) (expected: %d)", entry.line, got, entry.expected)
+		}
+	}
+
+	for _, line := range []string{
+		"SECTION \"main\", ROM0",
+		"\tINCLUDE \"hardware.inc\"",
+	} {
+		if _, err := LineSize(line); err == nil {
+			t.Fatalf("Expected an error: %q", line)
+		}
+	}
+}
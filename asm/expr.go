@@ -0,0 +1,236 @@
+package asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type token struct {
+	kind  byte // 'n': number, 'i': identifier, otherwise an operator
+	op    string
+	num   int
+	ident string
+}
+
+func isIdentChar(c byte, first bool) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', c == '_', c == '.':
+		return true
+	case c == '@':
+		return first
+	case '0' <= c && c <= '9':
+		return !first
+	}
+	return false
+}
+
+func tokenize(src string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+
+		case c == '$' || c == '%' || ('0' <= c && c <= '9'):
+			j := i + 1
+			for j < len(src) && isIdentChar(src[j], false) {
+				j++
+			}
+			num, err := parseNumber(src[i:j])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: 'n', num: num})
+			i = j
+
+		case c == '\'':
+			if i+2 >= len(src) || src[i+2] != '\'' {
+				return nil, fmt.Errorf("Invalid character literal: %s", src[i:])
+			}
+			tokens = append(tokens, token{kind: 'n', num: int(src[i+1])})
+			i += 3
+
+		case isIdentChar(c, true):
+			j := i + 1
+			for j < len(src) && isIdentChar(src[j], false) {
+				j++
+			}
+			tokens = append(tokens, token{kind: 'i', ident: src[i:j]})
+			i = j
+
+		default:
+			op := string(c)
+			if i+1 < len(src) {
+				switch src[i : i+2] {
+				case "<<", ">>":
+					op = src[i : i+2]
+				}
+			}
+			if !strings.Contains("+-*/&|^~()", op) && op != "<<" && op != ">>" {
+				return nil, fmt.Errorf("Unexpected character '%c' in expression: %s", c, src)
+			}
+			tokens = append(tokens, token{kind: 'o', op: op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+func parseNumber(s string) (int, error) {
+	var val int64
+	var err error
+	switch {
+	case strings.HasPrefix(s, "$"):
+		val, err = strconv.ParseInt(s[1:], 16, 64)
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		val, err = strconv.ParseInt(s[2:], 16, 64)
+	case strings.HasPrefix(s, "%"):
+		val, err = strconv.ParseInt(s[1:], 2, 64)
+	default:
+		val, err = strconv.ParseInt(s, 10, 64)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Invalid number: %s", s)
+	}
+	return int(val), nil
+}
+
+// exprParser evaluates expressions by precedence climbing.
+// Unknown symbols evaluate to 0 unless the assembler is in its final pass.
+type exprParser struct {
+	asm    *assembler
+	tokens []token
+	pos    int
+}
+
+var binaryPrecedence = map[string]int{
+	"|": 1, "^": 2, "&": 3, "<<": 4, ">>": 4, "+": 5, "-": 5, "*": 6, "/": 6,
+}
+
+func (a *assembler) eval(src string) (int, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return 0, err
+	}
+	if len(tokens) == 0 {
+		return 0, fmt.Errorf("Empty expression")
+	}
+	p := &exprParser{asm: a, tokens: tokens}
+	val, err := p.parseBinary(1)
+	if err != nil {
+		return 0, err
+	}
+	if p.pos != len(p.tokens) {
+		return 0, fmt.Errorf("Unexpected trailing tokens in expression: %s", src)
+	}
+	return val, nil
+}
+
+func (p *exprParser) peekOp() string {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == 'o' {
+		return p.tokens[p.pos].op
+	}
+	return ""
+}
+
+func (p *exprParser) parseBinary(minPrec int) (int, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peekOp()
+		prec, ok := binaryPrecedence[op]
+		if !ok || prec < minPrec {
+			return lhs, nil
+		}
+		p.pos++
+		rhs, err := p.parseBinary(prec + 1)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "|":
+			lhs |= rhs
+		case "^":
+			lhs ^= rhs
+		case "&":
+			lhs &= rhs
+		case "<<":
+			lhs <<= uint(rhs)
+		case ">>":
+			lhs >>= uint(rhs)
+		case "+":
+			lhs += rhs
+		case "-":
+			lhs -= rhs
+		case "*":
+			lhs *= rhs
+		case "/":
+			if rhs == 0 {
+				return 0, fmt.Errorf("Division by zero")
+			}
+			lhs /= rhs
+		}
+	}
+}
+
+func (p *exprParser) parseUnary() (int, error) {
+	switch p.peekOp() {
+	case "-":
+		p.pos++
+		val, err := p.parseUnary()
+		return -val, err
+	case "+":
+		p.pos++
+		return p.parseUnary()
+	case "~":
+		p.pos++
+		val, err := p.parseUnary()
+		return ^val, err
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (int, error) {
+	if p.pos >= len(p.tokens) {
+		return 0, fmt.Errorf("Unexpected end of expression")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+
+	switch tok.kind {
+	case 'n':
+		return tok.num, nil
+
+	case 'i':
+		fn := strings.ToUpper(tok.ident)
+		if (fn == "HIGH" || fn == "LOW") && p.peekOp() == "(" {
+			val, err := p.parsePrimary()
+			if err != nil {
+				return 0, err
+			}
+			if fn == "HIGH" {
+				return (val >> 8) & 0xff, nil
+			}
+			return val & 0xff, nil
+		}
+		return p.asm.lookup(tok.ident)
+
+	case 'o':
+		if tok.op == "(" {
+			val, err := p.parseBinary(1)
+			if err != nil {
+				return 0, err
+			}
+			if p.peekOp() != ")" {
+				return 0, fmt.Errorf("Missing ')'")
+			}
+			p.pos++
+			return val, nil
+		}
+	}
+	return 0, fmt.Errorf("Unexpected token in expression")
+}
@@ -0,0 +1,394 @@
+package asm
+
+import (
+	"fmt"
+	"strings"
+)
+
+type operandKind int
+
+const (
+	opImm    operandKind = iota // n8, n16, e8 or a label
+	opMem                       // [n16]
+	opR8                        // B, C, D, E, H, L, [HL], A
+	opR16                       // BC, DE, HL, SP
+	opAF                        // AF
+	opCond                      // NZ, Z, NC (C is parsed as opR8)
+	opMemBC                     // [BC]
+	opMemDE                     // [DE]
+	opMemHLI                    // [HL+], [HLI]
+	opMemHLD                    // [HL-], [HLD]
+	opMemC                      // [C], [$FF00+C]
+	opSPOff                     // SP+e8
+)
+
+type operand struct {
+	kind operandKind
+	reg  uint8
+	expr string
+}
+
+var r8Index = map[string]uint8{"b": 0, "c": 1, "d": 2, "e": 3, "h": 4, "l": 5, "[hl]": 6, "a": 7}
+var r16Index = map[string]uint8{"bc": 0, "de": 1, "hl": 2, "sp": 3}
+var condIndex = map[string]uint8{"nz": 0, "z": 1, "nc": 2}
+
+func parseOperand(src string) operand {
+	key := strings.ToLower(strings.ReplaceAll(src, " ", ""))
+	if i, ok := r8Index[key]; ok {
+		return operand{kind: opR8, reg: i}
+	}
+	if i, ok := r16Index[key]; ok {
+		return operand{kind: opR16, reg: i}
+	}
+	if i, ok := condIndex[key]; ok {
+		return operand{kind: opCond, reg: i}
+	}
+	switch key {
+	case "af":
+		return operand{kind: opAF, reg: 3}
+	case "[bc]":
+		return operand{kind: opMemBC}
+	case "[de]":
+		return operand{kind: opMemDE}
+	case "[hl+]", "[hli]":
+		return operand{kind: opMemHLI}
+	case "[hl-]", "[hld]":
+		return operand{kind: opMemHLD}
+	case "[c]", "[$ff00+c]", "[0xff00+c]":
+		return operand{kind: opMemC}
+	}
+	if strings.HasPrefix(key, "sp+") || strings.HasPrefix(key, "sp-") {
+		return operand{kind: opSPOff, expr: strings.TrimSpace(src)[2:]}
+	}
+	if strings.HasPrefix(key, "[") && strings.HasSuffix(key, "]") {
+		src = strings.TrimSpace(src)
+		return operand{kind: opMem, expr: src[1 : len(src)-1]}
+	}
+	return operand{kind: opImm, expr: src}
+}
+
+// asCond interprets op as a condition code. Note that C is both a register
+// and a condition.
+func asCond(op operand) (uint8, bool) {
+	switch {
+	case op.kind == opCond:
+		return op.reg, true
+	case op.kind == opR8 && op.reg == 1:
+		return 3, true
+	}
+	return 0, false
+}
+
+var implied = map[string]uint8{
+	"nop": 0x00, "rlca": 0x07, "rrca": 0x0f, "rla": 0x17, "rra": 0x1f,
+	"daa": 0x27, "cpl": 0x2f, "scf": 0x37, "ccf": 0x3f, "halt": 0x76,
+	"reti": 0xd9, "di": 0xf3, "ei": 0xfb,
+}
+
+var aluBase = map[string]uint8{
+	"add": 0x80, "adc": 0x88, "sub": 0x90, "sbc": 0x98,
+	"and": 0xa0, "xor": 0xa8, "or": 0xb0, "cp": 0xb8,
+}
+
+var cbBase = map[string]uint8{
+	"rlc": 0x00, "rrc": 0x08, "rl": 0x10, "rr": 0x18,
+	"sla": 0x20, "sra": 0x28, "swap": 0x30, "srl": 0x38,
+	"bit": 0x40, "res": 0x80, "set": 0xc0,
+}
+
+func (a *assembler) assembleInstr(mnemonic string, srcs []string) error {
+	ops := make([]operand, len(srcs))
+	for i, src := range srcs {
+		ops[i] = parseOperand(src)
+	}
+	invalid := fmt.Errorf("Invalid operands for %s: %s", mnemonic, strings.Join(srcs, ", "))
+
+	if opcode, ok := implied[mnemonic]; ok {
+		if len(ops) != 0 {
+			return invalid
+		}
+		return a.emit(opcode)
+	}
+
+	if base, ok := aluBase[mnemonic]; ok {
+		// ADD HL, r16 and ADD SP, e8 are special.
+		if mnemonic == "add" && len(ops) == 2 && ops[0].kind == opR16 {
+			switch {
+			case ops[0].reg == 2 && ops[1].kind == opR16:
+				return a.emit(0x09 | ops[1].reg<<4)
+			case ops[0].reg == 3 && ops[1].kind == opImm:
+				if err := a.emit(0xe8); err != nil {
+					return err
+				}
+				return a.emitImm8(ops[1].expr)
+			}
+			return invalid
+		}
+		// Both "SUB B" and "SUB A, B" are accepted.
+		if len(ops) == 2 && ops[0].kind == opR8 && ops[0].reg == 7 {
+			ops = ops[1:]
+		}
+		if len(ops) != 1 {
+			return invalid
+		}
+		switch ops[0].kind {
+		case opR8:
+			return a.emit(base | ops[0].reg)
+		case opImm:
+			if err := a.emit(base + 0x46); err != nil {
+				return err
+			}
+			return a.emitImm8(ops[0].expr)
+		}
+		return invalid
+	}
+
+	if base, ok := cbBase[mnemonic]; ok {
+		if base >= 0x40 { // BIT, RES, SET
+			if len(ops) != 2 || ops[0].kind != opImm || ops[1].kind != opR8 {
+				return invalid
+			}
+			index, err := a.eval(ops[0].expr)
+			if err != nil {
+				return err
+			}
+			if index < 0 || index > 7 {
+				return fmt.Errorf("Invalid bit index: %d", index)
+			}
+			return a.emit(0xcb, base|uint8(index)<<3|ops[1].reg)
+		}
+		if len(ops) != 1 || ops[0].kind != opR8 {
+			return invalid
+		}
+		return a.emit(0xcb, base|ops[0].reg)
+	}
+
+	switch mnemonic {
+	case "stop":
+		return a.emit(0x10, 0x00)
+
+	case "ld":
+		return a.assembleLD(ops, invalid)
+
+	case "ldh":
+		if len(ops) != 2 {
+			return invalid
+		}
+		switch {
+		case ops[0].kind == opMemC && ops[1].kind == opR8 && ops[1].reg == 7:
+			return a.emit(0xe2)
+		case ops[0].kind == opR8 && ops[0].reg == 7 && ops[1].kind == opMemC:
+			return a.emit(0xf2)
+		case ops[0].kind == opMem && ops[1].kind == opR8 && ops[1].reg == 7:
+			return a.emitLDH(0xe0, ops[0].expr)
+		case ops[0].kind == opR8 && ops[0].reg == 7 && ops[1].kind == opMem:
+			return a.emitLDH(0xf0, ops[1].expr)
+		}
+		return invalid
+
+	case "inc", "dec":
+		if len(ops) != 1 {
+			return invalid
+		}
+		switch ops[0].kind {
+		case opR8:
+			if mnemonic == "inc" {
+				return a.emit(0x04 | ops[0].reg<<3)
+			}
+			return a.emit(0x05 | ops[0].reg<<3)
+		case opR16:
+			if mnemonic == "inc" {
+				return a.emit(0x03 | ops[0].reg<<4)
+			}
+			return a.emit(0x0b | ops[0].reg<<4)
+		}
+		return invalid
+
+	case "push", "pop":
+		if len(ops) != 1 || !(ops[0].kind == opAF || (ops[0].kind == opR16 && ops[0].reg != 3)) {
+			return invalid
+		}
+		if mnemonic == "push" {
+			return a.emit(0xc5 | ops[0].reg<<4)
+		}
+		return a.emit(0xc1 | ops[0].reg<<4)
+
+	case "jp":
+		if len(ops) == 1 && (ops[0].kind == opR16 && ops[0].reg == 2 || ops[0].kind == opR8 && ops[0].reg == 6) {
+			return a.emit(0xe9) // JP HL
+		}
+		return a.assembleBranch(ops, 0xc3, 0xc2, invalid)
+
+	case "call":
+		return a.assembleBranch(ops, 0xcd, 0xc4, invalid)
+
+	case "jr":
+		if len(ops) == 0 || ops[len(ops)-1].kind != opImm {
+			return invalid
+		}
+		target := ops[len(ops)-1]
+		opcode := uint8(0x18)
+		if len(ops) == 2 {
+			cc, ok := asCond(ops[0])
+			if !ok {
+				return invalid
+			}
+			opcode = 0x20 | cc<<3
+		} else if len(ops) != 1 {
+			return invalid
+		}
+		addr, err := a.eval(target.expr)
+		if err != nil {
+			return err
+		}
+		offset := addr - (a.sec.pc + 2)
+		if a.final && (offset < -128 || offset > 127) {
+			return fmt.Errorf("JR target is out of range: %s", target.expr)
+		}
+		return a.emit(opcode, uint8(offset))
+
+	case "ret":
+		if len(ops) == 0 {
+			return a.emit(0xc9)
+		}
+		if cc, ok := asCond(ops[0]); ok && len(ops) == 1 {
+			return a.emit(0xc0 | cc<<3)
+		}
+		return invalid
+
+	case "rst":
+		if len(ops) != 1 || ops[0].kind != opImm {
+			return invalid
+		}
+		vec, err := a.eval(ops[0].expr)
+		if err != nil {
+			return err
+		}
+		if vec&^0x38 != 0 {
+			return fmt.Errorf("Invalid RST vector: $%02x", vec)
+		}
+		return a.emit(0xc7 | uint8(vec))
+	}
+
+	return fmt.Errorf("Unknown instruction: %s", mnemonic)
+}
+
+// assembleBranch handles JP and CALL with an optional condition.
+func (a *assembler) assembleBranch(ops []operand, opcode, condBase uint8, invalid error) error {
+	switch {
+	case len(ops) == 1 && ops[0].kind == opImm:
+		if err := a.emit(opcode); err != nil {
+			return err
+		}
+		return a.emitImm16(ops[0].expr)
+	case len(ops) == 2 && ops[1].kind == opImm:
+		cc, ok := asCond(ops[0])
+		if !ok {
+			return invalid
+		}
+		if err := a.emit(condBase | cc<<3); err != nil {
+			return err
+		}
+		return a.emitImm16(ops[1].expr)
+	}
+	return invalid
+}
+
+func (a *assembler) emitLDH(opcode uint8, expr string) error {
+	addr, err := a.eval(expr)
+	if err != nil {
+		return err
+	}
+	if addr >= 0xff00 {
+		addr -= 0xff00
+	}
+	if a.final && (addr < 0 || addr > 0xff) {
+		return fmt.Errorf("Address out of range for LDH: %s", expr)
+	}
+	return a.emit(opcode, uint8(addr))
+}
+
+func (a *assembler) assembleLD(ops []operand, invalid error) error {
+	if len(ops) != 2 {
+		return invalid
+	}
+	dst, src := ops[0], ops[1]
+	dstIsA := dst.kind == opR8 && dst.reg == 7
+	srcIsA := src.kind == opR8 && src.reg == 7
+
+	switch {
+	case dst.kind == opR8 && src.kind == opR8:
+		if dst.reg == 6 && src.reg == 6 {
+			return invalid // It would be HALT.
+		}
+		return a.emit(0x40 | dst.reg<<3 | src.reg)
+
+	case dst.kind == opR8 && src.kind == opImm:
+		if err := a.emit(0x06 | dst.reg<<3); err != nil {
+			return err
+		}
+		return a.emitImm8(src.expr)
+
+	case dst.kind == opR16 && src.kind == opImm:
+		if err := a.emit(0x01 | dst.reg<<4); err != nil {
+			return err
+		}
+		return a.emitImm16(src.expr)
+
+	case dst.kind == opR16 && dst.reg == 2 && src.kind == opSPOff: // LD HL, SP+e8
+		if err := a.emit(0xf8); err != nil {
+			return err
+		}
+		return a.emitImm8(src.expr)
+
+	case dst.kind == opR16 && dst.reg == 3 && src.kind == opR16 && src.reg == 2: // LD SP, HL
+		return a.emit(0xf9)
+
+	case dst.kind == opMem && src.kind == opR16 && src.reg == 3: // LD [n16], SP
+		if err := a.emit(0x08); err != nil {
+			return err
+		}
+		return a.emitImm16(dst.expr)
+
+	case dst.kind == opMem && srcIsA:
+		if err := a.emit(0xea); err != nil {
+			return err
+		}
+		return a.emitImm16(dst.expr)
+
+	case dstIsA && src.kind == opMem:
+		if err := a.emit(0xfa); err != nil {
+			return err
+		}
+		return a.emitImm16(src.expr)
+
+	case srcIsA:
+		switch dst.kind {
+		case opMemBC:
+			return a.emit(0x02)
+		case opMemDE:
+			return a.emit(0x12)
+		case opMemHLI:
+			return a.emit(0x22)
+		case opMemHLD:
+			return a.emit(0x32)
+		case opMemC:
+			return a.emit(0xe2)
+		}
+
+	case dstIsA:
+		switch src.kind {
+		case opMemBC:
+			return a.emit(0x0a)
+		case opMemDE:
+			return a.emit(0x1a)
+		case opMemHLI:
+			return a.emit(0x2a)
+		case opMemHLD:
+			return a.emit(0x3a)
+		case opMemC:
+			return a.emit(0xf2)
+		}
+	}
+	return invalid
+}
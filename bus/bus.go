@@ -2,6 +2,8 @@ package bus
 
 import (
 	"log"
+
+	"github.com/ushitora-anqou/aqboy/eventlog"
 )
 
 type InterruptBits struct {
@@ -64,14 +66,20 @@ type CPU interface {
 	SetIF(val uint8)
 	IE() uint8
 	IF() uint8
+	InvalidateCode(addr uint16)
+	FlushBlockCache()
 }
 
 type MMU interface {
 	Get8(addr uint16) uint8
 	Get16(addr uint16) uint16
+	FetchOpcode(addr uint16) uint8
+	FetchOperand(addr uint16) uint8
+	Peek8(addr uint16) uint8
 	Set8(addr uint16, val uint8)
 	Set16(addr uint16, val uint16)
 	GetSliceXX00(prefix, size int) []uint8
+	Bank(addr uint16) int
 }
 
 type PPU interface {
@@ -136,6 +144,8 @@ type Bus struct {
 	Timer
 	APU
 	Joypad
+
+	Events *eventlog.Log // Hardware events are recorded here if not nil
 }
 
 func NewBus() *Bus {
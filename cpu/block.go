@@ -0,0 +1,194 @@
+package cpu
+
+// Instruction length in bytes indexed by opcode. Illegal opcodes are 1.
+var opLength = [256]uint8{
+	1, 3, 1, 1, 1, 1, 2, 1, 3, 1, 1, 1, 1, 1, 2, 1, // 0x
+	2, 3, 1, 1, 1, 1, 2, 1, 2, 1, 1, 1, 1, 1, 2, 1, // 1x
+	2, 3, 1, 1, 1, 1, 2, 1, 2, 1, 1, 1, 1, 1, 2, 1, // 2x
+	2, 3, 1, 1, 1, 1, 2, 1, 2, 1, 1, 1, 1, 1, 2, 1, // 3x
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, // 4x
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, // 5x
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, // 6x
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, // 7x
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, // 8x
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, // 9x
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, // ax
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, // bx
+	1, 1, 3, 3, 3, 1, 2, 1, 1, 1, 3, 2, 3, 3, 2, 1, // cx
+	1, 1, 3, 1, 3, 1, 2, 1, 1, 1, 3, 1, 3, 1, 2, 1, // dx
+	2, 1, 1, 1, 1, 1, 2, 1, 2, 1, 3, 1, 1, 1, 2, 1, // ex
+	2, 1, 1, 1, 1, 1, 2, 1, 2, 1, 3, 1, 1, 1, 2, 1, // fx
+}
+
+// endsBlock returns true if the instruction may transfer control somewhere
+// other than the next instruction, or is illegal.
+func endsBlock(opcode uint8) bool {
+	switch opcode {
+	case 0x10, 0x76: // STOP, HALT
+		return true
+	case 0x18, 0x20, 0x28, 0x30, 0x38: // JR
+		return true
+	case 0xc3, 0xc2, 0xca, 0xd2, 0xda, 0xe9: // JP
+		return true
+	case 0xcd, 0xc4, 0xcc, 0xd4, 0xdc: // CALL
+		return true
+	case 0xc9, 0xc0, 0xc8, 0xd0, 0xd8, 0xd9: // RET, RETI
+		return true
+	case 0xc7, 0xcf, 0xd7, 0xdf, 0xe7, 0xef, 0xf7, 0xff: // RST
+		return true
+	case 0xd3, 0xdb, 0xdd, 0xe3, 0xe4, 0xeb, 0xec, 0xed, 0xf4, 0xfc, 0xfd: // Illegal
+		return true
+	}
+	return false
+}
+
+const maxBlockLength = 64
+
+type decodedInst struct {
+	addr   uint16
+	opcode uint8
+	imm8   uint8
+	imm16  uint16
+}
+
+// block is a sequence of instructions that are executed in a row unless
+// an interrupt occurs.
+type block struct {
+	insts []decodedInst
+}
+
+func (cpu *CPU) decode(addr uint16) decodedInst {
+	mmu := cpu.bus.MMU
+	inst := decodedInst{addr: addr, opcode: mmu.FetchOpcode(addr)}
+	switch opLength[inst.opcode] {
+	case 2:
+		inst.imm8 = mmu.FetchOperand(addr + 1)
+	case 3:
+		inst.imm16 = uint16(mmu.FetchOperand(addr+1)) | uint16(mmu.FetchOperand(addr+2))<<8
+		inst.imm8 = uint8(inst.imm16)
+	}
+	return inst
+}
+
+// decodeBlock decodes the block starting at addr. A block never spans two
+// 8 KiB regions, since they may be mapped to different banks. The second
+// return value is false if the block must not be cached because its only
+// instruction spans two regions.
+func (cpu *CPU) decodeBlock(addr uint16) (*block, bool) {
+	b := &block{}
+	for len(b.insts) < maxBlockLength {
+		length := uint16(opLength[cpu.bus.MMU.FetchOpcode(addr)])
+		last := addr + length - 1
+		if last < addr || last>>13 != addr>>13 {
+			if len(b.insts) == 0 {
+				b.insts = append(b.insts, cpu.decode(addr))
+				return b, false
+			}
+			break
+		}
+
+		inst := cpu.decode(addr)
+		b.insts = append(b.insts, inst)
+		if addr >= 0x8000 {
+			for i := uint16(0); i < length; i++ {
+				cpu.ramCode[ramCodeIndex(addr+i)] = true
+			}
+		}
+		if endsBlock(inst.opcode) || (last+1)>>13 != addr>>13 {
+			break
+		}
+		addr = last + 1
+	}
+	return b, true
+}
+
+// fetch returns the decoded instruction at PC.
+func (cpu *CPU) fetch() *decodedInst {
+	pc := cpu.PC()
+	if !cpu.blockCacheEnabled {
+		cpu.uncachedInst = cpu.decode(pc)
+		return &cpu.uncachedInst
+	}
+
+	// Continue the current block if possible
+	if b := cpu.curBlock; b != nil && cpu.curIndex < len(b.insts) && b.insts[cpu.curIndex].addr == pc {
+		inst := &b.insts[cpu.curIndex]
+		cpu.curIndex++
+		return inst
+	}
+
+	key := uint32(cpu.bus.MMU.Bank(pc))<<16 | uint32(pc)
+	b, ok := cpu.blocks[key]
+	if !ok {
+		var cacheable bool
+		b, cacheable = cpu.decodeBlock(pc)
+		if cacheable {
+			cpu.blocks[key] = b
+		}
+	}
+	cpu.curBlock, cpu.curIndex = b, 1
+	return &b.insts[0]
+}
+
+func ramCodeIndex(addr uint16) uint16 {
+	if 0xe000 <= addr && addr <= 0xfdff { // Echo RAM
+		addr -= 0x2000
+	}
+	return addr - 0x8000
+}
+
+// SetBlockCacheEnabled turns the cache of decoded blocks on or off.
+func (cpu *CPU) SetBlockCacheEnabled(enabled bool) {
+	cpu.blockCacheEnabled = enabled
+	cpu.FlushBlockCache()
+}
+
+// FlushBlockCache discards all the decoded blocks.
+func (cpu *CPU) FlushBlockCache() {
+	cpu.blocks = map[uint32]*block{}
+	cpu.ramCode = [0x8000]bool{}
+	cpu.curBlock = nil
+}
+
+// InvalidateCode tells the CPU that addr has been written to, so that
+// stale decoded instructions are not executed. A write to 0x0000-0x7fff
+// means that the ROM banks may have been switched, and the cartridge RAM may
+// have been enabled, disabled or switched.
+func (cpu *CPU) InvalidateCode(addr uint16) {
+	if addr < 0x8000 {
+		// Blocks are keyed by bank, so just stop following the current one.
+		cpu.curBlock = nil
+		if addr < 0x2000 || addr >= 0x4000 {
+			cpu.flushBlocks(0xa000, 0xbfff)
+		}
+		return
+	}
+	if cpu.ramCode[ramCodeIndex(addr)] {
+		cpu.flushRAMBlocks()
+	}
+}
+
+// flushRAMBlocks discards the decoded blocks in RAM.
+func (cpu *CPU) flushRAMBlocks() {
+	cpu.flushBlocks(0x8000, 0xffff)
+}
+
+// flushBlocks discards the decoded blocks at from-to in RAM, which are found
+// by ramCode without searching the cache if there are none.
+func (cpu *CPU) flushBlocks(from, to uint16) {
+	cpu.curBlock = nil
+	found := false
+	code := cpu.ramCode[from-0x8000 : int(to-0x8000)+1]
+	for i := range code {
+		found = found || code[i]
+		code[i] = false
+	}
+	if !found {
+		return
+	}
+	for key := range cpu.blocks {
+		if addr := uint16(key); from <= addr && addr <= to {
+			delete(cpu.blocks, key)
+		}
+	}
+}
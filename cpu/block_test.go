@@ -0,0 +1,197 @@
+package cpu
+
+import (
+	"testing"
+
+	"github.com/ushitora-anqou/aqboy/asm"
+	"github.com/ushitora-anqou/aqboy/bus"
+	"github.com/ushitora-anqou/aqboy/mmu"
+)
+
+func newMMUTestCPU(tb testing.TB, src string) *CPU {
+	tb.Helper()
+	rom, err := asm.Assemble(src)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return newMMUTestCPUWithROM(tb, rom)
+}
+
+func newMMUTestCPUWithROM(tb testing.TB, rom []uint8) *CPU {
+	tb.Helper()
+	b := bus.NewBus()
+	mmu, err := mmu.NewMMU(b, rom)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cpu := NewCPU(b)
+	b.CPU = cpu
+	b.MMU = mmu
+	return cpu
+}
+
+func stepN(tb testing.TB, cpu *CPU, n int) {
+	tb.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := cpu.Step(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+const hotLoopSrc = `
+SECTION "main", ROM0[$0150]
+Main:
+	ld hl, $c000
+.loop:
+	ld a, [hl]
+	add a, b
+	ld [hl+], a
+	inc b
+	ld a, h
+	cp $d0
+	jr nz, .loop
+	jr Main
+`
+
+func TestBlockCacheConsistency(t *testing.T) {
+	cached := newMMUTestCPU(t, hotLoopSrc)
+	uncached := newMMUTestCPU(t, hotLoopSrc)
+	uncached.SetBlockCacheEnabled(false)
+
+	for i := 0; i < 100; i++ {
+		stepN(t, cached, 1000)
+		stepN(t, uncached, 1000)
+		if cached.Snapshot() != uncached.Snapshot() {
+			t.Fatalf("(cached: %v) (uncached: %v)", cached.Snapshot(), uncached.Snapshot())
+		}
+	}
+}
+
+func TestBlockCacheInvalidation(t *testing.T) {
+	// Run `ld a, N; ret` in WRAM, rewrite N and run it again.
+	cpu := newMMUTestCPU(t, `
+SECTION "main", ROM0[$0150]
+	ld sp, $dff0
+	ld hl, $c000
+	ld a, $3e ; ld a, d8
+	ld [hl+], a
+	ld a, 1
+	ld [hl+], a
+	ld a, $c9 ; ret
+	ld [hl], a
+	call $c000
+	ld b, a
+	ld a, 2
+	ld [$c001], a
+	call $c000
+	ld c, a
+
+	; Switch to bank 2 and call the same address in both banks
+	ld a, 2
+	ld [$2000], a
+	call $4000
+	ld d, a
+	ld a, 3
+	ld [$2000], a
+	call $4000
+	ld e, a
+	halt
+
+SECTION "bank2", ROMX[$4000], BANK[2]
+	ld a, $22
+	ret
+
+SECTION "bank3", ROMX[$4000], BANK[3]
+	ld a, $33
+	ret
+`)
+	stepN(t, cpu, 40)
+
+	if !cpu.Halted() {
+		t.Fatalf("Not halted at 0x%04x", cpu.PC())
+	}
+	if cpu.B() != 1 || cpu.C() != 2 {
+		t.Fatalf("RAM code: (got: %d, %d) (expected: 1, 2)", cpu.B(), cpu.C())
+	}
+	if cpu.D() != 0x22 || cpu.E() != 0x33 {
+		t.Fatalf("Banked code: (got: %02x, %02x) (expected: 22, 33)", cpu.D(), cpu.E())
+	}
+}
+
+func TestBlockCacheCartRAM(t *testing.T) {
+	// Run `ld a, N; ret` in each bank of the cartridge RAM.
+	rom, err := asm.Assemble(`
+SECTION "main", ROM0[$0150]
+	ld sp, $dff0
+	ld a, $0a ; Enable the RAM
+	ld [$0000], a
+	ld a, 1 ; RAM banking mode
+	ld [$6000], a
+	ld hl, $a000
+	ld a, $3e ; ld a, d8
+	ld [hl+], a
+	ld a, 1
+	ld [hl+], a
+	ld a, $c9 ; ret
+	ld [hl], a
+	call $a000
+	ld b, a
+
+	ld a, 1 ; RAM bank 1
+	ld [$4000], a
+	ld hl, $a000
+	ld a, $3e
+	ld [hl+], a
+	ld a, 2
+	ld [hl+], a
+	ld a, $c9
+	ld [hl], a
+	call $a000
+	ld c, a
+
+	xor a ; RAM bank 0
+	ld [$4000], a
+	call $a000
+	ld d, a
+	xor a ; Disable the RAM
+	ld [$0000], a
+	halt
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rom[0x147] = 0x03 // MBC1+RAM+BATTERY
+	rom[0x149] = 0x03 // 32 KiB of RAM
+	cpu := newMMUTestCPUWithROM(t, rom)
+	stepN(t, cpu, 40)
+
+	if !cpu.Halted() {
+		t.Fatalf("Not halted at 0x%04x", cpu.PC())
+	}
+	if cpu.B() != 1 || cpu.C() != 2 || cpu.D() != 1 {
+		t.Fatalf("RAM code: (got: %d, %d, %d) (expected: 1, 2, 1)", cpu.B(), cpu.C(), cpu.D())
+	}
+	for key := range cpu.blocks {
+		if addr := uint16(key); 0xa000 <= addr && addr <= 0xbfff {
+			t.Fatalf("Block at %04x: (got: cached) (expected: flushed when the RAM is disabled)", addr)
+		}
+	}
+}
+
+func BenchmarkStep(b *testing.B) {
+	for _, entry := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"Cached", true},
+		{"Uncached", false},
+	} {
+		b.Run(entry.name, func(b *testing.B) {
+			cpu := newMMUTestCPU(b, hotLoopSrc)
+			cpu.SetBlockCacheEnabled(entry.enabled)
+			b.ResetTimer()
+			stepN(b, cpu, b.N)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package cpu
+
+import "fmt"
+
+type FrameKind int
+
+const (
+	FrameCall FrameKind = iota
+	FrameRST
+	FrameInterrupt
+)
+
+func (k FrameKind) String() string {
+	return []string{"CALL", "RST", "INT"}[k]
+}
+
+// Frame is an entry of the shadow call stack.
+type Frame struct {
+	Kind       FrameKind
+	CallerBank int
+	CallerPC   uint16 // Address of CALL/RST, or PC when the interrupt occurred
+	TargetBank int
+	Target     uint16 // Entry point of the called routine
+	ReturnAddr uint16
+	SP         uint16 // Where the return address is stored
+}
+
+func (f Frame) String() string {
+	return fmt.Sprintf("%s %02x:%04x from %02x:%04x (return to %04x, SP=%04x)",
+		f.Kind, f.TargetBank, f.Target, f.CallerBank, f.CallerPC, f.ReturnAddr, f.SP)
+}
+
+const maxCallStackDepth = 1024
+
+// pushFrame records a call whose return address has just been pushed.
+// The return address is read without side effects since the game does not.
+func (cpu *CPU) pushFrame(kind FrameKind, callerPC, target uint16) {
+	mmu := cpu.bus.MMU
+	sp := cpu.SP()
+
+	// Frames whose return address is at or below SP are no longer on the
+	// stack; the game must have modified SP directly.
+	cpu.pruneFrames(sp + 1)
+
+	if len(cpu.frames) == maxCallStackDepth {
+		copy(cpu.frames, cpu.frames[1:])
+		cpu.frames = cpu.frames[:len(cpu.frames)-1]
+	}
+	cpu.frames = append(cpu.frames, Frame{
+		Kind:       kind,
+		CallerBank: mmu.Bank(callerPC),
+		CallerPC:   callerPC,
+		TargetBank: mmu.Bank(target),
+		Target:     target,
+		ReturnAddr: uint16(mmu.Peek8(sp)) | uint16(mmu.Peek8(sp+1))<<8,
+		SP:         sp,
+	})
+}
+
+// popFrame is called just before a return address is popped.
+func (cpu *CPU) popFrame() {
+	sp := cpu.SP()
+	cpu.pruneFrames(sp)
+	if n := len(cpu.frames); n > 0 && cpu.frames[n-1].SP == sp {
+		cpu.frames = cpu.frames[:n-1]
+	}
+}
+
+// pruneFrames discards the innermost frames whose SP is less than sp.
+func (cpu *CPU) pruneFrames(sp uint16) {
+	n := len(cpu.frames)
+	for n > 0 && cpu.frames[n-1].SP < sp {
+		n--
+	}
+	cpu.frames = cpu.frames[:n]
+}
+
+// CallStack returns the shadow call stack built from CALL, RST, interrupts
+// and RET/RETI, innermost first. Frames whose return address has been
+// discarded by direct manipulation of SP are omitted.
+func (cpu *CPU) CallStack() []Frame {
+	return cpu.AppendCallStack([]Frame{})
+}
+
+// AppendCallStack is like CallStack but appends the frames to dst.
+func (cpu *CPU) AppendCallStack(dst []Frame) []Frame {
+	sp := cpu.SP()
+	for i := len(cpu.frames) - 1; i >= 0; i-- {
+		if cpu.frames[i].SP >= sp {
+			dst = append(dst, cpu.frames[i])
+		}
+	}
+	return dst
+}
@@ -2,10 +2,12 @@ package cpu
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"math/bits"
 
 	"github.com/ushitora-anqou/aqboy/bus"
+	"github.com/ushitora-anqou/aqboy/eventlog"
 	"github.com/ushitora-anqou/aqboy/util"
 )
 
@@ -109,10 +111,6 @@ func (ib *InterruptBits) set(val uint8) {
 	*ib = InterruptBits(val)
 }
 
-func (ib *InterruptBits) clear() {
-	*ib = 0
-}
-
 type CPU struct {
 	bus                    *bus.Bus
 	pc, sp                 uint16
@@ -120,6 +118,23 @@ type CPU struct {
 	ime                    bool // Interrupt Master Enable flag (IME)
 	halted                 bool
 	intEnable, intFlag     InterruptBits
+	traceWriter            io.Writer
+	traceFilter            func() bool
+	debugMsgWriter         io.Writer
+	quiet                  bool
+	sourceBreak            bool
+	sourceBreakPC          uint16
+	symbols                Symbolizer
+
+	// Cache of decoded blocks keyed by bank and address
+	blockCacheEnabled bool
+	blocks            map[uint32]*block
+	curBlock          *block
+	curIndex          int
+	ramCode           [0x8000]bool // true if 0x8000+i is in a cached block
+	uncachedInst      decodedInst
+
+	frames []Frame // Shadow call stack
 }
 
 func NewCPU(bus *bus.Bus) *CPU {
@@ -134,6 +149,9 @@ func NewCPU(bus *bus.Bus) *CPU {
 		sp:  0xfffe,
 		pc:  0x0100,
 		ime: false,
+
+		blockCacheEnabled: true,
+		blocks:            map[uint32]*block{},
 	}
 }
 
@@ -278,6 +296,14 @@ func (cpu *CPU) SetIE(val uint8) {
 	cpu.intEnable.set(val)
 }
 func (cpu *CPU) SetIF(val uint8) {
+	if events := cpu.bus.Events; events != nil {
+		requested := val &^ cpu.IF() & 0x1f
+		for i := uint8(0); i < 5; i++ {
+			if requested&(1<<i) != 0 {
+				events.Add(eventlog.IRQ, 0xff0f, i)
+			}
+		}
+	}
 	cpu.intFlag.set(val)
 }
 func (cpu *CPU) SetHalted(b bool) {
@@ -507,12 +533,14 @@ func (cpu *CPU) pop16() uint16 {
 	return val
 }
 
-func (cpu *CPU) call(addr uint16) {
+func (cpu *CPU) call(kind FrameKind, callerPC, addr uint16) {
 	cpu.push16(cpu.PC())
+	cpu.pushFrame(kind, callerPC, addr)
 	cpu.SetPC(addr)
 }
 
 func (cpu *CPU) ret() {
+	cpu.popFrame()
 	addr := cpu.pop16()
 	cpu.SetPC(addr)
 }
@@ -525,26 +553,53 @@ func (cpu *CPU) addSP8(val uint8) uint16 {
 	return sp + uint16(int8(val)) // NOTE: sign extension
 }
 
+func (cpu *CPU) pendingInterrupts() uint8 {
+	return cpu.IE() & cpu.IF() & 0x1f
+}
+
 func (cpu *CPU) handleInterrupt() uint {
-	var tick uint
-	for i := 0; i < 5; i++ {
-		if !(cpu.intEnable.getN(i) && cpu.intFlag.getN(i)) {
-			continue
-		}
-		if !cpu.IME() && cpu.Halted() {
-			cpu.SetHalted(false)
-		}
-		if cpu.IME() {
-			cpu.push16(cpu.PC())
-			cpu.SetPC(uint16(0x40 + 0x08*i))
-			cpu.intFlag.clear()
-			cpu.SetIME(false)
-			cpu.SetHalted(false)
-			tick = 20
+	if cpu.pendingInterrupts() == 0 {
+		return 0
+	}
+
+	// A pending interrupt wakes the CPU up even if IME is disabled.
+	cpu.SetHalted(false)
+	if !cpu.IME() {
+		return 0
+	}
+	cpu.SetIME(false)
+
+	// Dispatch takes 5 M-cycles:
+	//   M1-M2: Internal delay
+	//   M3:    Push the upper byte of PC
+	//   M4:    Push the lower byte of PC
+	//   M5:    Jump to the vector
+	// The interrupt to be serviced is chosen after the upper byte is pushed.
+	// If that push overwrites IE (i.e., SP was 0x0000) and no enabled
+	// interrupt is pending anymore, the dispatch is cancelled and PC is set
+	// to 0x0000 instead of a vector.
+	// Thanks to: https://github.com/Gekkio/mooneye-test-suite/blob/main/acceptance/interrupts/ie_push.s
+	mmu := cpu.bus.MMU
+	pc := cpu.PC()
+	cpu.SetSP(cpu.SP() - 1)
+	mmu.Set8(cpu.SP(), uint8(pc>>8))
+	pending := cpu.pendingInterrupts()
+	cpu.SetSP(cpu.SP() - 1)
+	mmu.Set8(cpu.SP(), uint8(pc))
+
+	var vector uint16 = 0x0000
+	if pending != 0 {
+		i := bits.TrailingZeros8(pending) // Lower bit has higher priority
+		cpu.intFlag.setN(i, false)
+		vector = uint16(0x40 + 0x08*i)
+		if events := cpu.bus.Events; events != nil {
+			events.Add(eventlog.Dispatch, vector, uint8(i))
 		}
-		break
 	}
-	return tick
+	cpu.pushFrame(FrameInterrupt, pc, vector)
+	cpu.SetPC(vector)
+
+	return 20
 }
 
 func getOpTick(opcode, opcode2 uint8, taken bool) uint {
@@ -618,8 +673,7 @@ func getOpTick(opcode, opcode2 uint8, taken bool) uint {
 	}[opcode]
 }
 
-func (cpu *CPU) stepCB() {
-	opcode := cpu.bus.MMU.Get8(cpu.PC())
+func (cpu *CPU) stepCB(opcode uint8) {
 	reg := opcode % 8
 	regVal := cpu.getReg(reg)
 	res := regVal
@@ -694,12 +748,20 @@ func (cpu *CPU) Step() (uint, error) {
 		return 4, nil
 	}
 
+	if !cpu.quiet && cpu.traceWriter != nil && (cpu.traceFilter == nil || cpu.traceFilter()) {
+		if err := cpu.writeTrace(); err != nil {
+			return 0, &OutputError{err}
+		}
+	}
+
 	mmu := cpu.bus.MMU
-	opcode := mmu.Get8(cpu.PC())
+	instPC := cpu.PC()
+	inst := cpu.fetch()
+	opcode := inst.opcode
 	opLow := opcode & 0x0f
 	opHigh := opcode >> 4
-	imm8 := mmu.Get8(cpu.PC() + 1)
-	imm16 := mmu.Get16(cpu.PC() + 1)
+	imm8 := inst.imm8
+	imm16 := inst.imm16
 	taken := false
 
 	switch {
@@ -965,7 +1027,7 @@ func (cpu *CPU) Step() (uint, error) {
 		if opcode == 0xcd ||
 			(opcode == 0xc4 && !cpu.FlagZ()) || (opcode == 0xcc && cpu.FlagZ()) ||
 			(opcode == 0xd4 && !cpu.FlagC()) || (opcode == 0xdc && cpu.FlagC()) {
-			cpu.call(imm16)
+			cpu.call(FrameCall, inst.addr, imm16)
 			taken = true
 		}
 
@@ -1008,12 +1070,12 @@ func (cpu *CPU) Step() (uint, error) {
 		index := opcode - 0xc7
 		cpu.traceInst1("RST %02xH", index)
 		cpu.IncPC(1)
-		cpu.call(uint16(index))
+		cpu.call(FrameRST, inst.addr, uint16(index))
 
 	case opcode == 0xcb: // PREFIX CB
 		cpu.traceInst0("PREFIX CB")
 		cpu.IncPC(1)
-		cpu.stepCB()
+		cpu.stepCB(imm8)
 
 	case opcode == 0xd9: // RETI
 		cpu.traceInst0("RETI")
@@ -1086,16 +1148,22 @@ func (cpu *CPU) Step() (uint, error) {
 		cpu.IncPC(1)
 
 	default:
-		return 0, fmt.Errorf("Illegal instr: 0x%02x at 0x%04x\n", mmu.Get8(cpu.PC()), cpu.PC())
+		return 0, fmt.Errorf("Illegal instr: 0x%02x at %s", opcode, cpu.addrString(cpu.PC()))
 	}
 
 	tick := getOpTick(opcode, imm8, taken)
 
+	if cpu.debugMsgWriter != nil && (opcode == 0x40 || opcode == 0x52) {
+		if err := cpu.debugInstruction(opcode, instPC); err != nil {
+			return 0, &OutputError{err}
+		}
+	}
+
 	return tick + interruptTick, nil
 }
 
 func (cpu *CPU) traceInst0(format string) {
-	util.Trace1("0x%04x: "+format, cpu.PC())
+	util.Trace1("%v: "+format, pcString{cpu})
 }
 
 /*
@@ -1104,39 +1172,39 @@ func (cpu *CPU) traceInst0(format string) {
 		def foo(i)
 		  args = i.times.map { |k| "v#{k}" }.join(", ")
 		  puts "func (cpu *CPU) traceInst#{i}(format string, #{args} interface{}) {"
-		  puts "\tutil.Trace#{i+1}(\"0x%04x: \"+format, cpu.PC(), #{args})"
+		  puts "\tutil.Trace#{i+1}(\"%v: \"+format, pcString{cpu}, #{args})"
 		  puts "}"
 		end
 		(1...9).each { |i| foo(i); puts "\n" }
 */
 func (cpu *CPU) traceInst1(format string, v0 interface{}) {
-	util.Trace2("0x%04x: "+format, cpu.PC(), v0)
+	util.Trace2("%v: "+format, pcString{cpu}, v0)
 }
 
 func (cpu *CPU) traceInst2(format string, v0, v1 interface{}) {
-	util.Trace3("0x%04x: "+format, cpu.PC(), v0, v1)
+	util.Trace3("%v: "+format, pcString{cpu}, v0, v1)
 }
 
 func (cpu *CPU) traceInst3(format string, v0, v1, v2 interface{}) {
-	util.Trace4("0x%04x: "+format, cpu.PC(), v0, v1, v2)
+	util.Trace4("%v: "+format, pcString{cpu}, v0, v1, v2)
 }
 
 func (cpu *CPU) traceInst4(format string, v0, v1, v2, v3 interface{}) {
-	util.Trace5("0x%04x: "+format, cpu.PC(), v0, v1, v2, v3)
+	util.Trace5("%v: "+format, pcString{cpu}, v0, v1, v2, v3)
 }
 
 func (cpu *CPU) traceInst5(format string, v0, v1, v2, v3, v4 interface{}) {
-	util.Trace6("0x%04x: "+format, cpu.PC(), v0, v1, v2, v3, v4)
+	util.Trace6("%v: "+format, pcString{cpu}, v0, v1, v2, v3, v4)
 }
 
 func (cpu *CPU) traceInst6(format string, v0, v1, v2, v3, v4, v5 interface{}) {
-	util.Trace7("0x%04x: "+format, cpu.PC(), v0, v1, v2, v3, v4, v5)
+	util.Trace7("%v: "+format, pcString{cpu}, v0, v1, v2, v3, v4, v5)
 }
 
 func (cpu *CPU) traceInst7(format string, v0, v1, v2, v3, v4, v5, v6 interface{}) {
-	util.Trace8("0x%04x: "+format, cpu.PC(), v0, v1, v2, v3, v4, v5, v6)
+	util.Trace8("%v: "+format, pcString{cpu}, v0, v1, v2, v3, v4, v5, v6)
 }
 
 func (cpu *CPU) traceInst8(format string, v0, v1, v2, v3, v4, v5, v6, v7 interface{}) {
-	util.Trace9("0x%04x: "+format, cpu.PC(), v0, v1, v2, v3, v4, v5, v6, v7)
+	util.Trace9("%v: "+format, pcString{cpu}, v0, v1, v2, v3, v4, v5, v6, v7)
 }
@@ -77,3 +77,129 @@ func TestSub4(t *testing.T) {
 		}
 	}
 }
+
+func TestInterruptPriority(t *testing.T) {
+	cpu, mem := newTestCPU()
+	cpu.SetPC(0x0200)
+	cpu.SetSP(0xd000)
+	cpu.SetIME(true)
+	cpu.SetIE(0x1f)
+	cpu.SetIF(0x06) // LCD STAT and Timer
+
+	if tick := cpu.handleInterrupt(); tick != 20 {
+		t.Fatalf("tick: (got: %d) (expected: 20)", tick)
+	}
+	if cpu.PC() != 0x0048 || cpu.IF() != 0x04 || cpu.IME() {
+		t.Fatalf("Invalid state: PC=0x%04x IF=%02x IME=%v", cpu.PC(), cpu.IF(), cpu.IME())
+	}
+	if cpu.SP() != 0xcffe || mem.Get16(0xcffe) != 0x0200 {
+		t.Fatalf("Invalid stack: SP=0x%04x (SP)=0x%04x", cpu.SP(), mem.Get16(cpu.SP()))
+	}
+}
+
+// ieMemory maps IE to the CPU like mmu.MMU does.
+type ieMemory struct {
+	testMemory
+	cpu *CPU
+}
+
+func (mem *ieMemory) Set8(addr uint16, val uint8) {
+	if addr == 0xffff {
+		mem.cpu.SetIE(val)
+	}
+	mem.testMemory.Set8(addr, val)
+}
+
+func (mem *ieMemory) Set16(addr uint16, val uint16) {
+	mem.Set8(addr, uint8(val))
+	mem.Set8(addr+1, uint8(val>>8))
+}
+
+func TestInterruptCancelledByIEPush(t *testing.T) {
+	for _, entry := range []struct {
+		pc, expectedPC uint16
+		expectedIF     uint8
+	}{
+		{0x0200, 0x0000, 0x01}, // The upper byte 0x02 disables V-Blank.
+		{0x0100, 0x0040, 0x00}, // The upper byte 0x01 keeps V-Blank enabled.
+	} {
+		cpu, _ := newTestCPU()
+		mem := &ieMemory{cpu: cpu}
+		cpu.bus.MMU = mem
+		cpu.SetPC(entry.pc)
+		cpu.SetSP(0x0000)
+		cpu.SetIME(true)
+		cpu.SetIE(0x01)
+		cpu.SetIF(0x01)
+
+		cpu.handleInterrupt()
+		if cpu.PC() != entry.expectedPC || cpu.IF() != entry.expectedIF {
+			t.Fatalf("PC=0x%04x: (got: PC=0x%04x IF=%02x) (expected: PC=0x%04x IF=%02x)",
+				entry.pc, cpu.PC(), cpu.IF(), entry.expectedPC, entry.expectedIF)
+		}
+	}
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	cpu, _ := newTestCPU()
+	state := State{
+		Registers: Registers{A: 0x01, F: 0xb0, B: 0x02, C: 0x03, D: 0x04, E: 0x05, H: 0x06, L: 0x07, SP: 0xfffe, PC: 0x0150},
+		IME:       true,
+		Halted:    true,
+		IE:        0x05,
+		IF:        0x01,
+	}
+	cpu.Restore(state)
+	if got := cpu.Snapshot(); got != state {
+		t.Fatalf("(got: %v) (expected: %v)", got, state)
+	}
+
+	state.F = 0xff
+	cpu.Restore(state)
+	if got := cpu.Snapshot().F; got != 0xf0 {
+		t.Fatalf("F: (got: %02x) (expected: f0)", got)
+	}
+}
+
+func TestCallStack(t *testing.T) {
+	cpu := newMMUTestCPU(t, `
+SECTION "rst08", ROM0[$0008]
+	jp Inner
+
+SECTION "main", ROM0[$0150]
+Main:
+	ld sp, $dff0
+	call Outer
+	halt
+	call Escape
+Outer:
+	rst $08
+	ret
+Inner:
+	halt
+	ret
+Escape:
+	ld sp, $dff0 ; Discard the return address
+	call Inner
+`)
+	runUntilHalt := func() []Frame {
+		cpu.SetHalted(false)
+		for i := 0; i < 100 && !cpu.Halted(); i++ {
+			stepN(t, cpu, 1)
+		}
+		return cpu.CallStack()
+	}
+
+	frames := runUntilHalt()
+	if len(frames) != 2 ||
+		frames[0].Kind != FrameRST || frames[0].Target != 0x0008 || frames[0].ReturnAddr != 0x015b ||
+		frames[1].Kind != FrameCall || frames[1].CallerPC != 0x0153 || frames[1].SP != 0xdfee {
+		t.Fatalf("Unexpected frames in Inner: %v", frames)
+	}
+	if frames := runUntilHalt(); len(frames) != 0 {
+		t.Fatalf("Unexpected frames after return: %v", frames)
+	}
+	if frames := runUntilHalt(); len(frames) != 1 || frames[0].CallerPC != 0x0161 {
+		t.Fatalf("Unexpected frames after SP was reset: %v", frames)
+	}
+}
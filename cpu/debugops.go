@@ -0,0 +1,61 @@
+package cpu
+
+import (
+	"io"
+)
+
+/*
+	Debug instructions of BGB, which are no-ops on the hardware:
+
+		ld b, b         ; Source breakpoint
+		ld d, d         ; Debug message
+		jr .end
+		dw $6464
+		dw $0000
+		db "Message"
+	.end:
+*/
+
+// SetDebugMessageWriter makes the CPU recognize the debug instructions of
+// BGB. The debug messages are written to w, one per line, and the source
+// breakpoints are reported by TakeSourceBreakpoint. Passing nil turns them
+// off.
+func (cpu *CPU) SetDebugMessageWriter(w io.Writer) {
+	cpu.debugMsgWriter = w
+	cpu.sourceBreak = false
+}
+
+// TakeSourceBreakpoint returns the address of the source breakpoint executed
+// since the last call, if any.
+func (cpu *CPU) TakeSourceBreakpoint() (uint16, bool) {
+	hit := cpu.sourceBreak
+	cpu.sourceBreak = false
+	return cpu.sourceBreakPC, hit
+}
+
+// debugInstruction handles the debug instruction executed at pc.
+func (cpu *CPU) debugInstruction(opcode uint8, pc uint16) error {
+	if opcode == 0x40 { // LD B, B
+		cpu.sourceBreak = true
+		cpu.sourceBreakPC = pc
+		return nil
+	}
+
+	// LD D, D followed by the message
+	if cpu.quiet {
+		return nil
+	}
+	mmu := cpu.bus.MMU
+	if mmu.Peek8(pc+1) != 0x18 || mmu.Peek8(pc+3) != 0x64 || mmu.Peek8(pc+4) != 0x64 ||
+		mmu.Peek8(pc+5) != 0x00 || mmu.Peek8(pc+6) != 0x00 {
+		return nil // Not a message
+	}
+	end := pc + 3 + uint16(int8(mmu.Peek8(pc+2)))
+	msg := []uint8{}
+	for addr := pc + 7; addr != end && len(msg) < 256; addr++ {
+		msg = append(msg, mmu.Peek8(addr))
+	}
+	msg = append(msg, '\n')
+	_, err := cpu.debugMsgWriter.Write(msg)
+	return err
+}
@@ -0,0 +1,56 @@
+package cpu
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDebugInstructions(t *testing.T) {
+	src := `
+SECTION "main", ROM0[$0150]
+Main:
+	ld d, d
+	jr .msg1
+	dw $6464
+	dw $0000
+	db "Hello, world"
+.msg1:
+	ld b, b
+	ld d, d         ; Not a message
+	ld d, d
+	jr .msg2
+	dw $6464
+	dw $0000
+.msg2:
+	halt
+`
+	cpu := newMMUTestCPU(t, src)
+	cpu.SetPC(0x0150)
+	stepN(t, cpu, 3)
+	if _, ok := cpu.TakeSourceBreakpoint(); ok {
+		t.Fatalf("TakeSourceBreakpoint: (got: %v) (expected: %v)", ok, false)
+	}
+
+	cpu = newMMUTestCPU(t, src)
+	cpu.SetPC(0x0150)
+	var out strings.Builder
+	cpu.SetDebugMessageWriter(&out)
+	stepN(t, cpu, 2)
+	if _, ok := cpu.TakeSourceBreakpoint(); ok {
+		t.Fatalf("TakeSourceBreakpoint: (got: %v) (expected: %v)", ok, false)
+	}
+	stepN(t, cpu, 1)
+	if pc, ok := cpu.TakeSourceBreakpoint(); !ok || pc != 0x0163 {
+		t.Fatalf("TakeSourceBreakpoint: (got: %04x %v) (expected: %04x %v)", pc, ok, 0x0163, true)
+	}
+	if _, ok := cpu.TakeSourceBreakpoint(); ok {
+		t.Fatalf("TakeSourceBreakpoint: (got: %v) (expected: %v)", ok, false)
+	}
+	stepN(t, cpu, 3)
+	if got, expected := out.String(), "Hello, world\n\n"; got != expected {
+		t.Fatalf("Messages: (got: %q) (expected: %q)", got, expected)
+	}
+	if cpu.PC() != 0x016c {
+		t.Fatalf("PC: (got: %04x) (expected: %04x)", cpu.PC(), 0x016c)
+	}
+}
@@ -0,0 +1,160 @@
+package cpu
+
+import "fmt"
+
+var (
+	disasmR8     = [8]string{"b", "c", "d", "e", "h", "l", "[hl]", "a"}
+	disasmR16    = [4]string{"bc", "de", "hl", "sp"}
+	disasmR16Stk = [4]string{"bc", "de", "hl", "af"}
+	disasmR16Mem = [4]string{"[bc]", "[de]", "[hl+]", "[hl-]"}
+	disasmCond   = [4]string{"nz", "z", "nc", "c"}
+	disasmALU    = [8]string{"add a, ", "adc a, ", "sub a, ", "sbc a, ", "and a, ", "xor a, ", "or a, ", "cp a, "}
+	disasmRot    = [8]string{"rlc", "rrc", "rl", "rr", "sla", "sra", "swap", "srl"}
+	disasmMisc   = [8]string{"rlca", "rrca", "rla", "rra", "daa", "cpl", "scf", "ccf"}
+)
+
+// InstLength returns the length in bytes of the instruction whose first
+// byte is opcode.
+func InstLength(opcode uint8) uint16 {
+	return uint16(opLength[opcode])
+}
+
+// Disassemble decodes the instruction at addr, reading the memory through
+// read, and returns it in the syntax accepted by RGBDS and package asm along
+// with its length in bytes.
+func Disassemble(read func(addr uint16) uint8, addr uint16) (string, uint16) {
+	opcode := read(addr)
+	length := InstLength(opcode)
+	imm8 := read(addr + 1)
+	imm16 := uint16(imm8) | uint16(read(addr+2))<<8
+	rel := addr + 2 + uint16(int8(imm8))
+
+	x, y, z := opcode>>6, (opcode>>3)&7, opcode&7
+	p, q := y>>1, y&1
+	switch x {
+	case 0:
+		switch z {
+		case 0:
+			switch y {
+			case 0:
+				return "nop", length
+			case 1:
+				return fmt.Sprintf("ld [$%04x], sp", imm16), length
+			case 2:
+				return "stop", length
+			case 3:
+				return fmt.Sprintf("jr $%04x", rel), length
+			default:
+				return fmt.Sprintf("jr %s, $%04x", disasmCond[y-4], rel), length
+			}
+		case 1:
+			if q == 0 {
+				return fmt.Sprintf("ld %s, $%04x", disasmR16[p], imm16), length
+			}
+			return fmt.Sprintf("add hl, %s", disasmR16[p]), length
+		case 2:
+			if q == 0 {
+				return fmt.Sprintf("ld %s, a", disasmR16Mem[p]), length
+			}
+			return fmt.Sprintf("ld a, %s", disasmR16Mem[p]), length
+		case 3:
+			if q == 0 {
+				return fmt.Sprintf("inc %s", disasmR16[p]), length
+			}
+			return fmt.Sprintf("dec %s", disasmR16[p]), length
+		case 4:
+			return fmt.Sprintf("inc %s", disasmR8[y]), length
+		case 5:
+			return fmt.Sprintf("dec %s", disasmR8[y]), length
+		case 6:
+			return fmt.Sprintf("ld %s, $%02x", disasmR8[y], imm8), length
+		default:
+			return disasmMisc[y], length
+		}
+
+	case 1:
+		if opcode == 0x76 {
+			return "halt", length
+		}
+		return fmt.Sprintf("ld %s, %s", disasmR8[y], disasmR8[z]), length
+
+	case 2:
+		return disasmALU[y] + disasmR8[z], length
+	}
+
+	switch z {
+	case 0:
+		switch y {
+		case 4:
+			return fmt.Sprintf("ldh [$ff%02x], a", imm8), length
+		case 5:
+			return fmt.Sprintf("add sp, %d", int8(imm8)), length
+		case 6:
+			return fmt.Sprintf("ldh a, [$ff%02x]", imm8), length
+		case 7:
+			return fmt.Sprintf("ld hl, sp%+d", int8(imm8)), length
+		default:
+			return "ret " + disasmCond[y], length
+		}
+	case 1:
+		if q == 0 {
+			return "pop " + disasmR16Stk[p], length
+		}
+		return [4]string{"ret", "reti", "jp hl", "ld sp, hl"}[p], length
+	case 2:
+		switch y {
+		case 4:
+			return "ldh [c], a", length
+		case 5:
+			return fmt.Sprintf("ld [$%04x], a", imm16), length
+		case 6:
+			return "ldh a, [c]", length
+		case 7:
+			return fmt.Sprintf("ld a, [$%04x]", imm16), length
+		default:
+			return fmt.Sprintf("jp %s, $%04x", disasmCond[y], imm16), length
+		}
+	case 3:
+		switch y {
+		case 0:
+			return fmt.Sprintf("jp $%04x", imm16), length
+		case 1:
+			return disassembleCB(imm8), length
+		case 6:
+			return "di", length
+		case 7:
+			return "ei", length
+		}
+	case 4:
+		if y < 4 {
+			return fmt.Sprintf("call %s, $%04x", disasmCond[y], imm16), length
+		}
+	case 5:
+		if q == 0 {
+			return "push " + disasmR16Stk[p], length
+		}
+		if p == 0 {
+			return fmt.Sprintf("call $%04x", imm16), length
+		}
+	case 6:
+		return fmt.Sprintf("%s$%02x", disasmALU[y], imm8), length
+	case 7:
+		return fmt.Sprintf("rst $%02x", y*8), length
+	}
+
+	return fmt.Sprintf("db $%02x", opcode), length
+}
+
+func disassembleCB(opcode uint8) string {
+	x, y, z := opcode>>6, (opcode>>3)&7, opcode&7
+	switch x {
+	case 0:
+		return fmt.Sprintf("%s %s", disasmRot[y], disasmR8[z])
+	case 1:
+		return fmt.Sprintf("bit %d, %s", y, disasmR8[z])
+	case 2:
+		return fmt.Sprintf("res %d, %s", y, disasmR8[z])
+	default:
+		return fmt.Sprintf("set %d, %s", y, disasmR8[z])
+	}
+}
@@ -0,0 +1,62 @@
+package cpu
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ushitora-anqou/aqboy/asm"
+)
+
+// TestDisassembleRoundTrip checks that the disassembly of every instruction
+// assembles back to the same bytes.
+func TestDisassembleRoundTrip(t *testing.T) {
+	const addr = 0x0150
+	var encodings [][]uint8
+	for opcode := 0; opcode < 0x100; opcode++ {
+		if opcode == 0xcb {
+			continue
+		}
+		code := []uint8{uint8(opcode), 0xfe, 0x12}
+		if opcode == 0x10 { // The second byte of STOP is always 0
+			code[1] = 0x00
+		}
+		encodings = append(encodings, code)
+	}
+	for opcode := 0; opcode < 0x100; opcode++ {
+		encodings = append(encodings, []uint8{0xcb, uint8(opcode)})
+	}
+
+	for _, code := range encodings {
+		mem := &testMemory{}
+		copy(mem[addr:], code)
+		text, length := Disassemble(mem.Get8, addr)
+
+		rom, err := asm.Assemble(fmt.Sprintf("SECTION \"main\", ROM0[$%04x]\n\t%s\n", addr, text))
+		if err != nil {
+			t.Fatalf("% x: %s: %v", code, text, err)
+		}
+		expected := code[:length]
+		if got := rom[addr : addr+int(length)]; string(got) != string(expected) {
+			t.Fatalf("%s: (got: % x) (expected: % x)", text, got, expected)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	for _, entry := range []struct {
+		code     []uint8
+		expected string
+	}{
+		{[]uint8{0x18, 0xfe}, "jr $0150"},
+		{[]uint8{0xe0, 0x40}, "ldh [$ff40], a"},
+		{[]uint8{0xf8, 0xfe}, "ld hl, sp-2"},
+		{[]uint8{0xcb, 0x7c}, "bit 7, h"},
+		{[]uint8{0xd3}, "db $d3"},
+	} {
+		mem := &testMemory{}
+		copy(mem[0x0150:], entry.code)
+		if got, _ := Disassemble(mem.Get8, 0x0150); got != entry.expected {
+			t.Fatalf("% x: (got: %s) (expected: %s)", entry.code, got, entry.expected)
+		}
+	}
+}
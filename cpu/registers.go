@@ -0,0 +1,11 @@
+package cpu
+
+import "github.com/ushitora-anqou/aqboy/ioreg"
+
+// Registers returns IF and IE with a field per interrupt.
+func (cpu *CPU) Registers() []ioreg.Register {
+	return []ioreg.Register{
+		{Addr: 0xff0f, Name: "IF", Value: cpu.IF(), Fields: ioreg.Interrupts(cpu.IF())},
+		{Addr: 0xffff, Name: "IE", Value: cpu.IE(), Fields: ioreg.Interrupts(cpu.IE())},
+	}
+}
@@ -0,0 +1,315 @@
+package cpu
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ushitora-anqou/aqboy/bus"
+)
+
+/*
+	Per-opcode conformance tests driven by JSON test vectors.
+
+	The vectors follow the common per-opcode layout: one file per opcode
+	(e.g. "3e.json", "cb 11.json"), each holding an array of test cases with
+	an initial state, a final state and the bus cycles of one instruction.
+	A few cases of some opcodes are in cpu/testdata/sm83. Point
+	AQBOY_SM83_TESTS to the directory containing the full set to run them
+	instead.
+
+	Each case checks the state after the instruction, its ticks, and the
+	bus accesses of its cycles, i.e. the address, the value and whether it
+	is a read or a write. Since the CPU is not cycle accurate, the order of
+	the accesses and the internal cycles without any access are not
+	checked, e.g. PUSH writes the upper byte last.
+*/
+
+const sm83TestsEnv = "AQBOY_SM83_TESTS"
+
+type sm83State struct {
+	PC  uint16     `json:"pc"`
+	SP  uint16     `json:"sp"`
+	A   uint8      `json:"a"`
+	B   uint8      `json:"b"`
+	C   uint8      `json:"c"`
+	D   uint8      `json:"d"`
+	E   uint8      `json:"e"`
+	F   uint8      `json:"f"`
+	H   uint8      `json:"h"`
+	L   uint8      `json:"l"`
+	IME uint8      `json:"ime"`
+	IE  *uint8     `json:"ie"`
+	RAM [][2]int64 `json:"ram"`
+}
+
+type sm83Test struct {
+	Name    string          `json:"name"`
+	Initial sm83State       `json:"initial"`
+	Final   sm83State       `json:"final"`
+	Cycles  json.RawMessage `json:"cycles"`
+}
+
+// testMemory is a flat 64 KiB memory used in place of mmu.MMU.
+type testMemory [0x10000]uint8
+
+func (mem *testMemory) Get8(addr uint16) uint8 {
+	return mem[addr]
+}
+
+func (mem *testMemory) Get16(addr uint16) uint16 {
+	return uint16(mem.Get8(addr)) | uint16(mem.Get8(addr+1))<<8
+}
+
+func (mem *testMemory) FetchOpcode(addr uint16) uint8 {
+	return mem[addr]
+}
+
+func (mem *testMemory) FetchOperand(addr uint16) uint8 {
+	return mem[addr]
+}
+
+func (mem *testMemory) Peek8(addr uint16) uint8 {
+	return mem[addr]
+}
+
+func (mem *testMemory) Set8(addr uint16, val uint8) {
+	mem[addr] = val
+}
+
+func (mem *testMemory) Set16(addr uint16, val uint16) {
+	mem.Set8(addr, uint8(val))
+	mem.Set8(addr+1, uint8(val>>8))
+}
+
+func (mem *testMemory) GetSliceXX00(prefix, size int) []uint8 {
+	off := prefix << 8
+	return mem[off : off+size]
+}
+
+func (mem *testMemory) Bank(addr uint16) int {
+	return 0
+}
+
+// sm83Access is an access of the CPU to the bus.
+type sm83Access struct {
+	Addr  uint16
+	Val   uint8
+	Write bool
+}
+
+func (a sm83Access) String() string {
+	if a.Write {
+		return fmt.Sprintf("write 0x%02x to 0x%04x", a.Val, a.Addr)
+	}
+	return fmt.Sprintf("read 0x%02x from 0x%04x", a.Val, a.Addr)
+}
+
+// loggedMemory records the accesses of the CPU to testMemory.
+type loggedMemory struct {
+	testMemory
+	accesses []sm83Access
+}
+
+func (mem *loggedMemory) Get8(addr uint16) uint8 {
+	val := mem.testMemory.Get8(addr)
+	mem.accesses = append(mem.accesses, sm83Access{addr, val, false})
+	return val
+}
+
+func (mem *loggedMemory) Get16(addr uint16) uint16 {
+	return uint16(mem.Get8(addr)) | uint16(mem.Get8(addr+1))<<8
+}
+
+func (mem *loggedMemory) FetchOpcode(addr uint16) uint8 {
+	return mem.Get8(addr)
+}
+
+func (mem *loggedMemory) FetchOperand(addr uint16) uint8 {
+	return mem.Get8(addr)
+}
+
+func (mem *loggedMemory) Set8(addr uint16, val uint8) {
+	mem.testMemory.Set8(addr, val)
+	mem.accesses = append(mem.accesses, sm83Access{addr, val, true})
+}
+
+func (mem *loggedMemory) Set16(addr uint16, val uint16) {
+	mem.Set8(addr, uint8(val))
+	mem.Set8(addr+1, uint8(val>>8))
+}
+
+func newTestCPU() (*CPU, *testMemory) {
+	mem := &testMemory{}
+	b := bus.NewBus()
+	b.MMU = mem
+	cpu := NewCPU(b)
+	b.CPU = cpu
+	return cpu, mem
+}
+
+func (s *sm83State) state(ie uint8) State {
+	if s.IE != nil {
+		ie = *s.IE
+	}
+	return State{
+		Registers: Registers{
+			A: s.A, F: s.F, B: s.B, C: s.C, D: s.D, E: s.E, H: s.H, L: s.L,
+			SP: s.SP, PC: s.PC,
+		},
+		IME: s.IME != 0,
+		IE:  ie,
+	}
+}
+
+func (s *sm83State) load(cpu *CPU, mem *testMemory) {
+	cpu.Restore(s.state(0))
+	for _, entry := range s.RAM {
+		mem.Set8(uint16(entry[0]), uint8(entry[1]))
+	}
+}
+
+func (s *sm83State) diff(cpu *CPU, mem *testMemory) []string {
+	var diffs []string
+	got := cpu.Snapshot()
+	got.Halted, got.IF = false, 0 // Not covered by the vectors
+	if expected := s.state(got.IE); got != expected {
+		diffs = append(diffs, fmt.Sprintf("got {%v}, expected {%v}", got, expected))
+	}
+	for _, entry := range s.RAM {
+		addr := uint16(entry[0])
+		if got, expected := mem.Get8(addr), uint8(entry[1]); got != expected {
+			diffs = append(diffs, fmt.Sprintf("(0x%04x): got 0x%02x, expected 0x%02x", addr, got, expected))
+		}
+	}
+	return diffs
+}
+
+// parseCycles returns the number of the cycles and the bus accesses in them.
+// A cycle is [ADDR, VALUE, PINS], e.g. [49152, 62, "r-m"], or null if it is
+// internal.
+func parseCycles(src json.RawMessage) (int, []sm83Access, error) {
+	var cycles []json.RawMessage
+	if err := json.Unmarshal(src, &cycles); err != nil {
+		return 0, nil, err
+	}
+	var accesses []sm83Access
+	for _, cycle := range cycles {
+		var fields []interface{}
+		if err := json.Unmarshal(cycle, &fields); err != nil {
+			return 0, nil, err
+		}
+		if len(fields) != 3 {
+			continue
+		}
+		addr, okAddr := fields[0].(float64)
+		val, okVal := fields[1].(float64)
+		pins, _ := fields[2].(string)
+		if !okAddr || !okVal || !strings.ContainsAny(pins, "rw") {
+			continue
+		}
+		accesses = append(accesses, sm83Access{uint16(addr), uint8(val), strings.Contains(pins, "w")})
+	}
+	return len(cycles), accesses, nil
+}
+
+// sortAccesses sorts accesses to compare them regardless of the order.
+func sortAccesses(accesses []sm83Access) {
+	sort.Slice(accesses, func(i, j int) bool {
+		a, b := accesses[i], accesses[j]
+		if a.Addr != b.Addr {
+			return a.Addr < b.Addr
+		}
+		if a.Write != b.Write {
+			return !a.Write
+		}
+		return a.Val < b.Val
+	})
+}
+
+func runSM83Test(test *sm83Test) error {
+	cpu, _ := newTestCPU()
+	// The cache would read the instructions ahead.
+	cpu.SetBlockCacheEnabled(false)
+	mem := &loggedMemory{}
+	cpu.bus.MMU = mem
+	test.Initial.load(cpu, &mem.testMemory)
+
+	tick, err := cpu.Step()
+	if err != nil {
+		return err
+	}
+
+	diffs := test.Final.diff(cpu, &mem.testMemory)
+
+	numCycles, expected, err := parseCycles(test.Cycles)
+	if err != nil {
+		return err
+	}
+	if expected := uint(numCycles) * 4; tick != expected {
+		diffs = append(diffs, fmt.Sprintf("tick: got %d, expected %d", tick, expected))
+	}
+	got := mem.accesses
+	sortAccesses(got)
+	sortAccesses(expected)
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		diffs = append(diffs, fmt.Sprintf("accesses: got %v, expected %v", got, expected))
+	}
+
+	if len(diffs) != 0 {
+		return fmt.Errorf("%s", strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+func sm83TestsDir(t *testing.T) string {
+	dir := os.Getenv(sm83TestsEnv)
+	if dir == "" {
+		dir = filepath.Join("testdata", "sm83")
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Skipf("SM83 test vectors not found in %s; set %s to run them", dir, sm83TestsEnv)
+	}
+	return dir
+}
+
+func TestSM83Vectors(t *testing.T) {
+	dir := sm83TestsDir(t)
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		path := path
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".json"), func(t *testing.T) {
+			src, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var tests []sm83Test
+			if err := json.Unmarshal(src, &tests); err != nil {
+				t.Fatal(err)
+			}
+
+			failed := 0
+			for i := range tests {
+				if err := runSM83Test(&tests[i]); err != nil {
+					// Report only the first few failures of each opcode
+					if failed < 3 {
+						t.Errorf("%s: %v", tests[i].Name, err)
+					}
+					failed++
+				}
+			}
+			if failed != 0 {
+				t.Errorf("%d/%d cases failed", failed, len(tests))
+			}
+		})
+	}
+}
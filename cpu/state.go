@@ -0,0 +1,110 @@
+package cpu
+
+import "fmt"
+
+// Registers holds the values of the SM83 registers.
+type Registers struct {
+	A, F, B, C, D, E, H, L uint8
+	SP, PC                 uint16
+}
+
+func (r Registers) String() string {
+	return fmt.Sprintf("AF=%02x%02x BC=%02x%02x DE=%02x%02x HL=%02x%02x SP=%04x PC=%04x",
+		r.A, r.F, r.B, r.C, r.D, r.E, r.H, r.L, r.SP, r.PC)
+}
+
+// DMGRegisters are the registers of a DMG after the boot ROM, which are
+// assumed by the logs of gameboy-doctor. NewCPU starts with the ones of a CGB
+// instead.
+var DMGRegisters = Registers{
+	A: 0x01, F: 0xb0, B: 0x00, C: 0x13, D: 0x00, E: 0xd8, H: 0x01, L: 0x4d,
+	SP: 0xfffe, PC: 0x0100,
+}
+
+// State is the architectural state of the CPU.
+type State struct {
+	Registers
+	IME, Halted bool
+	IE, IF      uint8
+}
+
+func (s State) String() string {
+	return fmt.Sprintf("%v IME=%d HALT=%d IE=%02x IF=%02x",
+		s.Registers, b2u8(s.IME), b2u8(s.Halted), s.IE, s.IF)
+}
+
+// Snapshot returns the current state of the CPU.
+func (cpu *CPU) Snapshot() State {
+	return State{
+		Registers: Registers{
+			A: cpu.A(), F: cpu.F(), B: cpu.B(), C: cpu.C(),
+			D: cpu.D(), E: cpu.E(), H: cpu.H(), L: cpu.L(),
+			SP: cpu.SP(), PC: cpu.PC(),
+		},
+		IME:    cpu.IME(),
+		Halted: cpu.Halted(),
+		IE:     cpu.IE(),
+		IF:     cpu.IF(),
+	}
+}
+
+// Restore overwrites the state of the CPU with s.
+// Note that the lower 4 bits of F are always zero.
+func (cpu *CPU) Restore(s State) {
+	cpu.SetA(s.A)
+	cpu.SetF(s.F)
+	cpu.SetB(s.B)
+	cpu.SetC(s.C)
+	cpu.SetD(s.D)
+	cpu.SetE(s.E)
+	cpu.SetH(s.H)
+	cpu.SetL(s.L)
+	cpu.SetSP(s.SP)
+	cpu.SetPC(s.PC)
+	cpu.SetIME(s.IME)
+	cpu.SetHalted(s.Halted)
+	cpu.SetIE(s.IE)
+	cpu.SetIF(s.IF)
+}
+
+// SavedState is the whole state of the CPU saved by SaveState, including the
+// shadow call stack.
+type SavedState struct {
+	pc, sp                 uint16
+	a, f, b, c, d, e, h, l uint8
+	ime, halted            bool
+	intEnable, intFlag     InterruptBits
+	frames                 []Frame
+}
+
+// SaveState returns the whole state of the CPU, which can be restored by
+// LoadState.
+func (cpu *CPU) SaveState() *SavedState {
+	return &SavedState{
+		pc: cpu.pc, sp: cpu.sp,
+		a: cpu.a, f: cpu.f, b: cpu.b, c: cpu.c,
+		d: cpu.d, e: cpu.e, h: cpu.h, l: cpu.l,
+		ime:       cpu.ime,
+		halted:    cpu.halted,
+		intEnable: cpu.intEnable,
+		intFlag:   cpu.intFlag,
+		frames:    append([]Frame(nil), cpu.frames...),
+	}
+}
+
+// LoadState restores the state saved by SaveState. Unlike Restore, no event
+// is recorded for the interrupt flags.
+func (cpu *CPU) LoadState(s *SavedState) {
+	cpu.pc, cpu.sp = s.pc, s.sp
+	cpu.a, cpu.f, cpu.b, cpu.c = s.a, s.f, s.b, s.c
+	cpu.d, cpu.e, cpu.h, cpu.l = s.d, s.e, s.h, s.l
+	cpu.ime = s.ime
+	cpu.halted = s.halted
+	cpu.intEnable = s.intEnable
+	cpu.intFlag = s.intFlag
+	cpu.frames = append(cpu.frames[:0], s.frames...)
+	cpu.sourceBreak = false
+
+	// The RAM may hold other code now.
+	cpu.flushRAMBlocks()
+}
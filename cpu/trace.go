@@ -0,0 +1,93 @@
+package cpu
+
+import (
+	"fmt"
+	"io"
+)
+
+// OutputError is returned by Step when the trace or the debug messages
+// cannot be written. Unlike the other errors, it does not mean that the
+// emulation went wrong.
+type OutputError struct {
+	Err error
+}
+
+func (e *OutputError) Error() string { return e.Err.Error() }
+func (e *OutputError) Unwrap() error { return e.Err }
+
+// SetTraceWriter makes the CPU emit one line per executed instruction to w
+// in the format used by gameboy-doctor and similar tools:
+//
+//	A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0100 PCMEM:00,C3,13,02
+//
+// Each line shows the state just before the instruction is executed.
+// If a symbolizer is set, the label of PC is appended to each line.
+// Passing nil turns the trace off.
+func (cpu *CPU) SetTraceWriter(w io.Writer) {
+	cpu.traceWriter = w
+}
+
+// SetTraceFilter makes the trace show only the instructions before which
+// filter returns true. Passing nil shows all of them.
+func (cpu *CPU) SetTraceFilter(filter func() bool) {
+	cpu.traceFilter = filter
+}
+
+// SetQuiet turns off the trace and the debug messages while quiet is true,
+// e.g. while the emulation is executed again after a rewind. The source
+// breakpoints are still reported.
+func (cpu *CPU) SetQuiet(quiet bool) {
+	cpu.quiet = quiet
+}
+
+// writeTrace reads the memory with Peek8, so that the trace is not caught by
+// the watchpoints nor logged to CDL.
+func (cpu *CPU) writeTrace() error {
+	mmu := cpu.bus.MMU
+	pc := cpu.PC()
+	label := ""
+	if name := cpu.symbolize(pc); name != "" {
+		label = " " + name
+	}
+	_, err := fmt.Fprintf(cpu.traceWriter,
+		"A:%02X F:%02X B:%02X C:%02X D:%02X E:%02X H:%02X L:%02X SP:%04X PC:%04X PCMEM:%02X,%02X,%02X,%02X%s\n",
+		cpu.A(), cpu.F(), cpu.B(), cpu.C(), cpu.D(), cpu.E(), cpu.H(), cpu.L(), cpu.SP(), pc,
+		mmu.Peek8(pc), mmu.Peek8(pc+1), mmu.Peek8(pc+2), mmu.Peek8(pc+3), label)
+	return err
+}
+
+// Symbolizer converts an address to a label like "Main.loop+3".
+// It returns "" if no label is known.
+type Symbolizer interface {
+	Symbolize(bank int, addr uint16) string
+}
+
+// SetSymbolizer makes the trace and the errors show labels along with
+// addresses. Passing nil turns it off.
+func (cpu *CPU) SetSymbolizer(symbols Symbolizer) {
+	cpu.symbols = symbols
+}
+
+func (cpu *CPU) symbolize(addr uint16) string {
+	if cpu.symbols == nil {
+		return ""
+	}
+	return cpu.symbols.Symbolize(cpu.bus.MMU.Bank(addr), addr)
+}
+
+// addrString returns a string like "0x0153 (Main+3)".
+func (cpu *CPU) addrString(addr uint16) string {
+	if name := cpu.symbolize(addr); name != "" {
+		return fmt.Sprintf("0x%04x (%s)", addr, name)
+	}
+	return fmt.Sprintf("0x%04x", addr)
+}
+
+// pcString formats PC lazily, so that it costs nothing unless it is printed.
+type pcString struct {
+	cpu *CPU
+}
+
+func (s pcString) String() string {
+	return s.cpu.addrString(s.cpu.PC())
+}
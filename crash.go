@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"runtime/debug"
+
+	"github.com/ushitora-anqou/aqboy/bus"
+	"github.com/ushitora-anqou/aqboy/cpu"
+	"github.com/ushitora-anqou/aqboy/crashdump"
+	"github.com/ushitora-anqou/aqboy/debugger"
+	"github.com/ushitora-anqou/aqboy/ioreg"
+	"github.com/ushitora-anqou/aqboy/mmu"
+	"github.com/ushitora-anqou/aqboy/ppu"
+)
+
+// The number of the last executed instructions kept for a crash dump
+const crashHistorySize = 1024
+
+type executedInst struct {
+	bank  int
+	state cpu.State
+}
+
+// EnableCrashDump makes the emulator write a crash dump to dir when the CPU
+// fails or a component panics. See package crashdump.
+func (a *AQBoy) EnableCrashDump(dir string) {
+	a.crashDir = dir
+	if a.executed == nil {
+		a.executed = make([]executedInst, crashHistorySize)
+	}
+}
+
+func (a *AQBoy) recordInstruction() {
+	pc := a.cpu.PC()
+	a.executed[a.executedNext] = executedInst{a.mmu.Bank(pc), a.cpu.Snapshot()}
+	a.executedNext++
+	if a.executedNext == len(a.executed) {
+		a.executedNext = 0
+		a.executedFull = true
+	}
+}
+
+// recoverCrash turns a panic of a component into an error, writing a crash
+// dump if enabled. It must be deferred.
+func (a *AQBoy) recoverCrash(err *error) {
+	if r := recover(); r != nil {
+		*err = a.crash(fmt.Errorf("Panic: %v", r), debug.Stack())
+	}
+}
+
+// crash decorates err, which stopped the emulation, with the guest call stack,
+// and writes a crash dump if enabled. stack is the goroutine stack if a
+// component panicked.
+func (a *AQBoy) crash(err error, stack []byte) error {
+	err = a.crashError(err)
+	if a.crashDir == "" {
+		return err
+	}
+	if dumpErr := a.crashDump(err, stack).Write(a.crashDir); dumpErr != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write the crash dump: %v\n", dumpErr)
+	} else {
+		fmt.Fprintf(os.Stderr, "Crash dump written to %s\n", a.crashDir)
+	}
+	return err
+}
+
+func (a *AQBoy) crashDump(err error, stack []byte) *crashdump.Dump {
+	m := a.mmu
+	peek := func(from, to uint16) []uint8 {
+		mem := make([]uint8, 0, int(to-from)+1)
+		for addr := int(from); addr <= int(to); addr++ {
+			mem = append(mem, m.Peek8(uint16(addr)))
+		}
+		return mem
+	}
+	d := &crashdump.Dump{
+		Error:     err.Error(),
+		Panic:     string(stack),
+		ROMTitle:  romTitle(a.rom),
+		ROMSHA256: fmt.Sprintf("%x", sha256.Sum256(a.rom)),
+		Frame:     a.frames,
+		Cycle:     a.cycles,
+		Steps:     a.steps,
+		State:     a.cpu.Snapshot(),
+		CallStack: a.cpu.CallStack(),
+		Mapper:    m.MapperState(),
+		ROMBanks:  [2]int{m.Bank(0x0000), m.Bank(0x4000)},
+		RAMBank:   m.Bank(0xa000),
+		VRAM:      peek(0x8000, 0x9fff),
+		OAM:       peek(0xfe00, 0xfe9f),
+		WRAM:      peek(0xc000, 0xdfff),
+		HRAM:      peek(0xff80, 0xfffe),
+		IO:        peek(0xff00, 0xff7f),
+		CartRAM:   m.CartridgeRAM(),
+
+		IORegisters: a.IORegisters(),
+	}
+
+	// The ROM may have been patched by Poke.
+	for i, val := range m.ROM() {
+		if i >= len(a.rom) || val != a.rom[i] {
+			d.ROMPatches = append(d.ROMPatches, crashdump.ROMPatch{Index: i, Val: val})
+		}
+	}
+
+	executed := a.executed[:a.executedNext]
+	if a.executedFull {
+		executed = append(a.executed[a.executedNext:], executed...)
+	}
+	for _, inst := range executed {
+		// The code may have been changed or banked out since.
+		text, _ := cpu.Disassemble(m.Peek8, inst.state.PC)
+		d.History = append(d.History, crashdump.Instruction{Bank: inst.bank, State: inst.state, Text: text})
+	}
+	return d
+}
+
+// romTitle returns the title in the header of rom.
+func romTitle(rom []uint8) string {
+	if len(rom) < 0x144 {
+		return ""
+	}
+	return string(bytes.TrimRight(rom[0x134:0x144], "\x00"))
+}
+
+// InspectCrashDump reads the crash dump in dir, and lets the debugger show
+// the state of the machine through in and out. rom must be the ROM which
+// crashed.
+func InspectCrashDump(dir string, rom []uint8, in io.Reader, out io.Writer) error {
+	d, err := crashdump.Read(dir)
+	if err != nil {
+		return err
+	}
+	if hash := fmt.Sprintf("%x", sha256.Sum256(rom)); hash != d.ROMSHA256 {
+		return fmt.Errorf("The ROM does not match the crash dump: (got: SHA-256 %s) (expected: %s)", hash, d.ROMSHA256)
+	}
+	fmt.Fprintf(out, "Error: %s\n", d.Error)
+
+	dbg := debugger.NewDebugger(dumpMachine{d, rom}, in, out)
+	for {
+		err := dbg.Run()
+		if errors.Is(err, debugger.ErrQuit) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "A crash dump cannot be resumed")
+	}
+}
+
+var (
+	errCrashDump       = errors.New("A crash dump cannot be executed")
+	errCrashDumpChange = errors.New("A crash dump cannot be changed")
+)
+
+// dumpMachine exposes a crash dump to the debugger.
+type dumpMachine struct {
+	d   *crashdump.Dump
+	rom []uint8
+}
+
+func (m dumpMachine) Step() (uint, error)                  { return 0, errCrashDump }
+func (m dumpMachine) Replay() (uint, error)                { return 0, errCrashDump }
+func (m dumpMachine) State() cpu.State                     { return m.d.State }
+func (m dumpMachine) CallStack() []cpu.Frame               { return m.d.CallStack }
+func (m dumpMachine) Peek8(addr uint16) uint8              { return m.d.Peek8(m.rom, addr) }
+func (m dumpMachine) Bank(addr uint16) int                 { return m.d.Bank(addr) }
+func (m dumpMachine) LY() uint8                            { return m.d.Peek8(m.rom, 0xff44) }
+func (m dumpMachine) Frame() int                           { return m.d.Frame }
+func (m dumpMachine) SetWatchpoints(wps []mmu.Watchpoint)  {}
+func (m dumpMachine) TakeWatchHit() (mmu.WatchHit, bool)   { return mmu.WatchHit{}, false }
+func (m dumpMachine) TakeSourceBreakpoint() (uint16, bool) { return 0, false }
+func (m dumpMachine) Steps() uint64                        { return m.d.Steps }
+func (m dumpMachine) Rewind(step uint64) bool              { return false }
+func (m dumpMachine) IORegisters() []ioreg.Register        { return m.d.IORegisters }
+func (m dumpMachine) Poke(p mmu.Poke) error                { return errCrashDumpChange }
+func (m dumpMachine) Freeze(p mmu.Poke) error              { return errCrashDumpChange }
+func (m dumpMachine) Unfreeze(index int)                   {}
+func (m dumpMachine) Freezes() []mmu.Poke                  { return nil }
+func (m dumpMachine) TileImage(paletteData uint8) *image.Paletted {
+	return m.ppu().TileImage(paletteData)
+}
+func (m dumpMachine) TileMapImage(tileMapAddr uint16) *image.Paletted {
+	return m.ppu().TileMapImage(tileMapAddr)
+}
+
+// ppu rebuilds the PPU from the dump for the viewers.
+func (m dumpMachine) ppu() *ppu.PPU {
+	p := ppu.NewPPU(bus.NewBus())
+	for i, val := range m.d.VRAM {
+		p.SetVRAM8(uint16(i), val)
+	}
+	for _, r := range m.d.IORegisters {
+		switch r.Name {
+		case "LCDC":
+			p.SetLCDC(r.Value)
+		case "SCY":
+			p.SetSCY(r.Value)
+		case "SCX":
+			p.SetSCX(r.Value)
+		case "BGP":
+			p.SetBGP(r.Value)
+		case "WY":
+			p.SetWY(r.Value)
+		case "WX":
+			p.SetWX(r.Value)
+		}
+	}
+	return p
+}
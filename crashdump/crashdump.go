@@ -0,0 +1,232 @@
+// Package crashdump saves the state of the machine when the emulation fails
+// to a directory, which can be attached to a bug report and read back for
+// inspection.
+//
+// The directory has the following files:
+//
+//	report.txt   A human-readable summary
+//	dump.json    Everything but the memory, including the patches to the ROM,
+//	             read back by Read
+//	vram.bin, oam.bin, wram.bin, hram.bin, io.bin, cartram.bin
+//	             The contents of the memory. io.bin is FF00-FF7F.
+package crashdump
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ushitora-anqou/aqboy/cpu"
+	"github.com/ushitora-anqou/aqboy/ioreg"
+)
+
+// Instruction is an executed instruction.
+type Instruction struct {
+	Bank  int
+	State cpu.State // Before the instruction is executed
+	Text  string    // Disassembly
+}
+
+// ROMPatch is a byte of the ROM patched by a poke.
+type ROMPatch struct {
+	Index int // In the ROM file
+	Val   uint8
+}
+
+// String returns the patch as BANK:ADDR = VAL like mmu.Poke.
+func (p ROMPatch) String() string {
+	bank, addr := p.Index/0x4000, p.Index%0x4000
+	if bank > 0 {
+		addr += 0x4000
+	}
+	return fmt.Sprintf("%02x:%04x = %02x", bank, addr, p.Val)
+}
+
+// Dump is the state of the machine when the emulation failed.
+type Dump struct {
+	Error     string // Including the call stack
+	Panic     string `json:",omitempty"` // The goroutine stack if a component panicked
+	ROMTitle  string
+	ROMSHA256 string
+	Frame     int
+	Cycle     uint64
+	Steps     uint64
+	State     cpu.State
+	CallStack []cpu.Frame
+	History   []Instruction // The last executed instructions, oldest first
+	Mapper    string
+	ROMBanks  [2]int // Mapped at 0000-3FFF and 4000-7FFF
+	RAMBank   int    // Mapped at A000-BFFF
+
+	ROMPatches []ROMPatch `json:",omitempty"` // Applied to the ROM file by Peek8
+
+	IORegisters []ioreg.Register // Decoded from the components, unlike IO
+
+	VRAM    []uint8 `json:"-"`
+	OAM     []uint8 `json:"-"`
+	WRAM    []uint8 `json:"-"`
+	HRAM    []uint8 `json:"-"`
+	IO      []uint8 `json:"-"` // FF00-FF7F as read by the guest
+	CartRAM []uint8 `json:"-"`
+}
+
+func (d *Dump) memoryFiles() []struct {
+	name string
+	data *[]uint8
+} {
+	return []struct {
+		name string
+		data *[]uint8
+	}{
+		{"vram.bin", &d.VRAM},
+		{"oam.bin", &d.OAM},
+		{"wram.bin", &d.WRAM},
+		{"hram.bin", &d.HRAM},
+		{"io.bin", &d.IO},
+		{"cartram.bin", &d.CartRAM},
+	}
+}
+
+// Write writes the dump to dir, which is created if needed.
+func (d *Dump) Write(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, f := range d.memoryFiles() {
+		if err := os.WriteFile(filepath.Join(dir, f.name), *f.data, 0644); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dump.json"), data, 0644); err != nil {
+		return err
+	}
+
+	file, err := os.Create(filepath.Join(dir, "report.txt"))
+	if err != nil {
+		return err
+	}
+	if err := d.WriteReport(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Read reads the dump written to dir by Write.
+func Read(dir string) (*Dump, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "dump.json"))
+	if err != nil {
+		return nil, err
+	}
+	d := &Dump{}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+	for _, f := range d.memoryFiles() {
+		data, err := os.ReadFile(filepath.Join(dir, f.name))
+		if err != nil {
+			return nil, err
+		}
+		*f.data = data
+	}
+	return d, nil
+}
+
+// WriteReport writes the human-readable summary.
+func (d *Dump) WriteReport(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "Error: %s\n\n", d.Error)
+	fmt.Fprintf(bw, "ROM: %q (SHA-256 %s)\n", d.ROMTitle, d.ROMSHA256)
+	fmt.Fprintf(bw, "Mapper: %s\n", d.Mapper)
+	for _, p := range d.ROMPatches {
+		fmt.Fprintf(bw, "ROM patch: %v\n", p)
+	}
+	fmt.Fprintf(bw, "Frame: %d, cycle: %d, instruction: %d\n", d.Frame, d.Cycle, d.Steps)
+	fmt.Fprintf(bw, "Registers: %v\n", d.State)
+
+	fmt.Fprintln(bw, "\nCall stack:")
+	for i, frame := range d.CallStack {
+		fmt.Fprintf(bw, "  #%d %v\n", i, frame)
+	}
+
+	fmt.Fprintf(bw, "\nLast %d instructions:\n", len(d.History))
+	for _, inst := range d.History {
+		fmt.Fprintf(bw, "  %02x:%04x  %-20s %v\n", inst.Bank, inst.State.PC, inst.Text, inst.State.Registers)
+	}
+
+	fmt.Fprintln(bw, "\nI/O registers:")
+	for _, r := range d.IORegisters {
+		fmt.Fprintf(bw, "  %v\n", r)
+	}
+
+	fmt.Fprintln(bw, "\nI/O memory:")
+	for i := 0; i < len(d.IO); i += 16 {
+		fmt.Fprintf(bw, "  %04x:", 0xff00+i)
+		for j := i; j < i+16 && j < len(d.IO); j++ {
+			fmt.Fprintf(bw, " %02x", d.IO[j])
+		}
+		fmt.Fprintln(bw)
+	}
+
+	if d.Panic != "" {
+		fmt.Fprintf(bw, "\nPanic:\n%s", d.Panic)
+	}
+	return bw.Flush()
+}
+
+// Peek8 reads the memory as the CPU saw it when the emulation failed. rom is
+// the contents of the ROM file, or nil if unavailable, to which ROMPatches
+// are applied. Unknown bytes read as 0xff.
+func (d *Dump) Peek8(rom []uint8, addr uint16) uint8 {
+	read := func(mem []uint8, index int) uint8 {
+		if index < len(mem) {
+			return mem[index]
+		}
+		return 0xff
+	}
+	switch {
+	case addr <= 0x7fff:
+		index := d.ROMBanks[addr/0x4000]*0x4000 + int(addr%0x4000)
+		for _, p := range d.ROMPatches {
+			if p.Index == index {
+				return p.Val
+			}
+		}
+		return read(rom, index)
+	case addr <= 0x9fff:
+		return read(d.VRAM, int(addr-0x8000))
+	case addr <= 0xbfff:
+		return read(d.CartRAM, d.RAMBank*0x2000+int(addr-0xa000))
+	case addr <= 0xdfff:
+		return read(d.WRAM, int(addr-0xc000))
+	case addr <= 0xfdff:
+		return read(d.WRAM, int(addr-0xe000))
+	case addr <= 0xfe9f:
+		return read(d.OAM, int(addr-0xfe00))
+	case addr <= 0xfeff:
+		return 0xff
+	case addr <= 0xff7f:
+		return read(d.IO, int(addr-0xff00))
+	case addr <= 0xfffe:
+		return read(d.HRAM, int(addr-0xff80))
+	}
+	return d.State.IE
+}
+
+// Bank returns the number of the bank mapped at addr, like mmu.Bank.
+func (d *Dump) Bank(addr uint16) int {
+	switch {
+	case addr <= 0x7fff:
+		return d.ROMBanks[addr/0x4000]
+	case 0xa000 <= addr && addr <= 0xbfff:
+		return d.RAMBank
+	}
+	return 0
+}
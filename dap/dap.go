@@ -0,0 +1,656 @@
+// Package dap implements a server of the Debug Adapter Protocol, so that
+// editors can debug the game at the level of its RGBDS source code.
+//
+// The server exposes a single thread. Breakpoints are set on source lines,
+// which are mapped to addresses through the symbol file (see source.go).
+// The scopes of a stack frame are the CPU registers and the labels in WRAM
+// and HRAM, each shown with the byte at its address.
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/ushitora-anqou/aqboy/constant"
+	"github.com/ushitora-anqou/aqboy/cpu"
+	"github.com/ushitora-anqou/aqboy/expr"
+	"github.com/ushitora-anqou/aqboy/symbol"
+)
+
+// ErrTerminated is returned by Run when the client asks to end the emulation.
+var ErrTerminated = errors.New("Terminated by the debug adapter client")
+
+// Target is the emulator seen from the server. The emulator executes the
+// instructions itself, asking the server by ShouldBreak whether to stop.
+type Target interface {
+	State() cpu.State
+	CallStack() []cpu.Frame
+	// Peek8 reads the memory without side effects.
+	Peek8(addr uint16) uint8
+	Bank(addr uint16) int
+	LY() uint8
+	Frame() int
+}
+
+const threadID = 1
+
+// Variable references of the scopes
+const (
+	refRegisters = iota + 1
+	refWRAM
+	refHRAM
+)
+
+// The requests are polled once per this many instructions while running.
+const pollInterval = 1024
+
+// A step request gives up after this many instructions, which take 60 frames
+// or more since an instruction takes 4 ticks or more, e.g. when the routine
+// never returns.
+const maxStepInstructions = 60 * constant.FRAME_TICKS / 4
+
+type message struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command,omitempty"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type response struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type event struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type source struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type breakpoint struct {
+	Verified bool   `json:"verified"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+type stackFrame struct {
+	ID                          int     `json:"id"`
+	Name                        string  `json:"name"`
+	Source                      *source `json:"source,omitempty"`
+	Line                        int     `json:"line"`
+	Column                      int     `json:"column"`
+	InstructionPointerReference string  `json:"instructionPointerReference,omitempty"`
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+	MemoryReference    string `json:"memoryReference,omitempty"`
+}
+
+// stepMode tells when a step request is done.
+type stepMode int
+
+const (
+	stepNone stepMode = iota
+	stepIn            // Another line is reached
+	stepOver          // Another line is reached without entering calls
+	stepOut           // The current routine returns
+)
+
+type Server struct {
+	target   Target
+	symbols  *symbol.Table
+	lines    *lineMap
+	listener net.Listener
+
+	conn     net.Conn
+	requests chan *message
+	seq      int
+
+	attached    bool
+	configured  bool
+	stopped     bool
+	stopReason  string
+	polls       int
+	err         error
+	breakpoints map[string][]uint32   // Addresses of the breakpoints of each source
+	breakAddrs  map[uint32]*expr.Expr // Condition of each breakpoint, nil if none
+	breakPCs    [0x10000]bool
+
+	mode      stepMode
+	fromPath  string
+	fromLine  int
+	fromDepth int
+	steps     int // The instructions executed by the step request
+}
+
+// Listen starts listening on addr, e.g. "localhost:4711".
+func Listen(target Target, addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		target:      target,
+		lines:       newLineMap(),
+		listener:    listener,
+		breakpoints: map[string][]uint32{},
+		breakAddrs:  map[uint32]*expr.Expr{},
+	}, nil
+}
+
+// SetSymbols sets the symbols used to map source lines to addresses.
+func (s *Server) SetSymbols(symbols *symbol.Table) {
+	s.symbols = symbols
+	s.lines = newLineMap()
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Accept waits for a client. The emulation stops until the client finishes
+// the configuration, e.g. setting breakpoints.
+func (s *Server) Accept() error {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.requests = make(chan *message)
+	s.attached = true
+	s.configured = false
+	s.stopped = false
+	s.mode = stepNone
+	go s.readMessages(conn, s.requests)
+	return nil
+}
+
+func (s *Server) Close() error {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return s.listener.Close()
+}
+
+func (s *Server) readMessages(conn net.Conn, requests chan<- *message) {
+	defer close(requests)
+	r := textproto.NewReader(bufio.NewReader(conn))
+	for {
+		header, err := r.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			return
+		}
+		body := make([]uint8, length)
+		if _, err := io.ReadFull(r.R, body); err != nil {
+			return
+		}
+		msg := &message{}
+		if err := json.Unmarshal(body, msg); err != nil || msg.Type != "request" {
+			continue
+		}
+		requests <- msg
+	}
+}
+
+func (s *Server) write(v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.seq++
+	if _, err := fmt.Fprintf(s.conn, "Content-Length: %d\r\n\r\n%s", len(body), body); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) sendEvent(name string, body interface{}) error {
+	return s.write(&event{Seq: s.seq + 1, Type: "event", Event: name, Body: body})
+}
+
+func (s *Server) sendResponse(req *message, body interface{}, err error) error {
+	res := &response{
+		Seq:        s.seq + 1,
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    err == nil,
+		Command:    req.Command,
+		Body:       body,
+	}
+	if err != nil {
+		res.Message = err.Error()
+	}
+	return s.write(res)
+}
+
+// Attached returns true if a client is controlling the emulation.
+func (s *Server) Attached() bool {
+	return s.attached
+}
+
+// ShouldBreak is called before each instruction is executed, and returns true
+// if Run should be called since the emulation should stop.
+func (s *Server) ShouldBreak(pc uint16) bool {
+	if !s.attached {
+		return false
+	}
+	if !s.configured || s.stopped {
+		return true
+	}
+
+	// Handle the requests arriving while running, e.g. pause.
+	if s.polls++; s.polls >= pollInterval {
+		s.polls = 0
+		select {
+		case req, ok := <-s.requests:
+			if !ok {
+				s.detach()
+				return false
+			}
+			if err := s.handle(req); err != nil {
+				s.err = err // Returned by Run
+				return true
+			}
+			if s.stopped {
+				return true
+			}
+		default:
+		}
+	}
+
+	if s.breakPCs[pc] {
+		cond, ok := s.breakAddrs[addrKey(s.target.Bank(pc), pc)]
+		if ok && (cond == nil || cond.True(s.target)) {
+			s.stop("breakpoint")
+			return true
+		}
+	}
+	if s.mode != stepNone && s.stepDone(pc) {
+		s.stop("step")
+		return true
+	}
+	return false
+}
+
+// Fault stops the emulation since it failed at the current instruction.
+func (s *Server) Fault(err error) {
+	if s.attached {
+		s.sendEvent("output", map[string]interface{}{"category": "stderr", "output": err.Error() + "\n"})
+		s.stop("exception")
+	}
+}
+
+// Break stops the emulation before the next instruction as if a breakpoint
+// is hit.
+func (s *Server) Break() {
+	if s.attached {
+		s.stop("breakpoint")
+	}
+}
+
+func (s *Server) stop(reason string) {
+	s.stopped = true
+	s.stopReason = reason
+	s.mode = stepNone
+}
+
+func (s *Server) detach() {
+	s.attached = false
+	s.conn.Close()
+}
+
+// Run serves the client until it resumes the emulation.
+func (s *Server) Run() error {
+	if err := s.err; err != nil {
+		s.err = nil
+		return err
+	}
+	for {
+		// The client is told why it stopped once the configuration is done.
+		if s.configured && s.stopReason != "" {
+			err := s.sendEvent("stopped", map[string]interface{}{
+				"reason":            s.stopReason,
+				"threadId":          threadID,
+				"allThreadsStopped": true,
+			})
+			s.stopReason = ""
+			if err != nil {
+				return err
+			}
+		}
+
+		req, ok := <-s.requests
+		if !ok {
+			s.detach()
+			return nil
+		}
+		if err := s.handle(req); err != nil {
+			return err
+		}
+		if !s.attached || (s.configured && !s.stopped) {
+			return nil
+		}
+	}
+}
+
+// location returns the source line of the instruction at addr.
+func (s *Server) location(addr uint16) (string, int, bool) {
+	return s.lines.lookupAddr(s.target.Bank(addr), addr)
+}
+
+func (s *Server) stepDone(pc uint16) bool {
+	s.steps++
+	if s.steps >= maxStepInstructions {
+		return true
+	}
+	depth := len(s.target.CallStack())
+	if depth < s.fromDepth {
+		return true
+	}
+	if s.mode == stepOut || (s.mode == stepOver && depth > s.fromDepth) {
+		return false
+	}
+	path, line, ok := s.location(pc)
+	return ok && (path != s.fromPath || line != s.fromLine)
+}
+
+func (s *Server) startStep(mode stepMode) {
+	pc := s.target.State().PC
+	s.fromPath, s.fromLine, _ = s.location(pc)
+	s.fromDepth = len(s.target.CallStack())
+	s.mode = mode
+	s.steps = 0
+	s.stopped = false
+}
+
+func (s *Server) handle(req *message) error {
+	body, err := s.dispatch(req)
+	if errors.Is(err, ErrTerminated) {
+		s.sendResponse(req, nil, nil)
+		s.sendEvent("terminated", nil)
+		s.detach()
+		return err
+	}
+	if err := s.sendResponse(req, body, err); err != nil {
+		return err
+	}
+	switch req.Command {
+	case "initialize":
+		return s.sendEvent("initialized", nil)
+	case "disconnect":
+		s.detach()
+	}
+	return nil
+}
+
+func (s *Server) dispatch(req *message) (interface{}, error) {
+	switch req.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsTerminateRequest":         true,
+			"supportsConditionalBreakpoints":   true,
+		}, nil
+
+	case "launch", "attach":
+		var args struct {
+			StopOnEntry bool     `json:"stopOnEntry"`
+			Sources     []string `json:"sources"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		if args.StopOnEntry {
+			s.stop("entry")
+		}
+		for _, path := range args.Sources {
+			if err := s.loadSource(path); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+
+	case "configurationDone":
+		s.configured = true
+		return nil, nil
+
+	case "setBreakpoints":
+		return s.setBreakpoints(req.Arguments)
+
+	case "setExceptionBreakpoints":
+		return map[string]interface{}{"breakpoints": []breakpoint{}}, nil
+
+	case "threads":
+		return map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": threadID, "name": "SM83"}},
+		}, nil
+
+	case "stackTrace":
+		return s.stackTrace(), nil
+
+	case "scopes":
+		return map[string]interface{}{
+			"scopes": []map[string]interface{}{
+				{"name": "Registers", "variablesReference": refRegisters, "expensive": false},
+				{"name": "WRAM", "variablesReference": refWRAM, "expensive": false},
+				{"name": "HRAM", "variablesReference": refHRAM, "expensive": false},
+			},
+		}, nil
+
+	case "variables":
+		var args struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		return map[string]interface{}{"variables": s.variables(args.VariablesReference)}, nil
+
+	case "continue":
+		s.stopped = false
+		return map[string]interface{}{"allThreadsContinued": true}, nil
+
+	case "next":
+		s.startStep(stepOver)
+		return nil, nil
+
+	case "stepIn":
+		s.startStep(stepIn)
+		return nil, nil
+
+	case "stepOut":
+		s.startStep(stepOut)
+		return nil, nil
+
+	case "pause":
+		if !s.stopped {
+			s.stop("pause")
+		}
+		return nil, nil
+
+	case "terminate":
+		return nil, ErrTerminated
+
+	case "disconnect":
+		var args struct {
+			TerminateDebuggee bool `json:"terminateDebuggee"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		if args.TerminateDebuggee {
+			return nil, ErrTerminated
+		}
+		s.stopped = false
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Unsupported request: %s", req.Command)
+}
+
+func (s *Server) loadSource(path string) error {
+	if s.symbols == nil {
+		return fmt.Errorf("No symbols are loaded")
+	}
+	return s.lines.load(path, s.symbols)
+}
+
+func (s *Server) setBreakpoints(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		Source      source `json:"source"`
+		Breakpoints []struct {
+			Line      int    `json:"line"`
+			Condition string `json:"condition"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+
+	// Replace all the breakpoints of the source.
+	path := normalizePath(args.Source.Path)
+	for _, key := range s.breakpoints[path] {
+		delete(s.breakAddrs, key)
+	}
+	s.breakpoints[path] = nil
+	s.breakPCs = [0x10000]bool{}
+	for _, keys := range s.breakpoints {
+		for _, key := range keys {
+			s.breakPCs[uint16(key)] = true
+		}
+	}
+
+	loadErr := s.loadSource(path)
+	result := []breakpoint{}
+	for _, bp := range args.Breakpoints {
+		if loadErr != nil {
+			result = append(result, breakpoint{Message: loadErr.Error()})
+			continue
+		}
+		entry, ok := s.lines.lookupLine(path, bp.Line)
+		if !ok {
+			result = append(result, breakpoint{Message: "No code at the line"})
+			continue
+		}
+		var cond *expr.Expr
+		if bp.Condition != "" {
+			var err error
+			if cond, err = expr.Parse(bp.Condition); err != nil {
+				result = append(result, breakpoint{Line: entry.line, Message: err.Error()})
+				continue
+			}
+		}
+		key := addrKey(entry.bank, entry.addr)
+		s.breakpoints[path] = append(s.breakpoints[path], key)
+		s.breakAddrs[key] = cond
+		s.breakPCs[entry.addr] = true
+		result = append(result, breakpoint{Verified: true, Line: entry.line})
+	}
+	return map[string]interface{}{"breakpoints": result}, nil
+}
+
+func (s *Server) frame(id int, name string, addr uint16) stackFrame {
+	bank := s.target.Bank(addr)
+	f := stackFrame{
+		ID:                          id,
+		Name:                        name,
+		InstructionPointerReference: fmt.Sprintf("0x%04x", addr),
+	}
+	if path, line, ok := s.location(addr); ok {
+		f.Source = &source{Name: pathBase(path), Path: path}
+		f.Line, f.Column = line, 1
+	}
+	if f.Name == "" {
+		f.Name = fmt.Sprintf("%02x:%04x", bank, addr)
+		if s.symbols != nil {
+			if label := s.symbols.Symbolize(bank, addr); label != "" {
+				f.Name = label
+			}
+		}
+	}
+	return f
+}
+
+func pathBase(path string) string {
+	return path[strings.LastIndexAny(path, `/\`)+1:]
+}
+
+func (s *Server) stackTrace() interface{} {
+	frames := []stackFrame{s.frame(0, "", s.target.State().PC)}
+	for i, f := range s.target.CallStack() {
+		frames = append(frames, s.frame(i+1, "", f.CallerPC))
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}
+}
+
+func (s *Server) variables(ref int) []variable {
+	vars := []variable{}
+	switch ref {
+	case refRegisters:
+		st := s.target.State()
+		for _, reg := range []struct {
+			name  string
+			value uint16
+			wide  bool
+		}{
+			{"A", uint16(st.A), false}, {"F", uint16(st.F), false},
+			{"B", uint16(st.B), false}, {"C", uint16(st.C), false},
+			{"D", uint16(st.D), false}, {"E", uint16(st.E), false},
+			{"H", uint16(st.H), false}, {"L", uint16(st.L), false},
+			{"SP", st.SP, true}, {"PC", st.PC, true},
+		} {
+			value := fmt.Sprintf("$%02x", reg.value)
+			if reg.wide {
+				value = fmt.Sprintf("$%04x", reg.value)
+			}
+			vars = append(vars, variable{Name: reg.name, Value: value})
+		}
+		flags := []uint8("----")
+		for i, name := range "ZNHC" {
+			if st.F&(0x80>>i) != 0 {
+				flags[i] = uint8(name)
+			}
+		}
+		vars = append(vars,
+			variable{Name: "Flags", Value: string(flags)},
+			variable{Name: "IME", Value: strconv.FormatBool(st.IME)},
+			variable{Name: "IE", Value: fmt.Sprintf("$%02x", st.IE)},
+			variable{Name: "IF", Value: fmt.Sprintf("$%02x", st.IF)},
+		)
+
+	case refWRAM, refHRAM:
+		if s.symbols == nil {
+			break
+		}
+		for _, sym := range s.symbols.Symbols() {
+			inWRAM := 0xc000 <= sym.Addr && sym.Addr <= 0xdfff
+			inHRAM := 0xff80 <= sym.Addr && sym.Addr <= 0xfffe
+			if (ref == refWRAM && inWRAM) || (ref == refHRAM && inHRAM) {
+				vars = append(vars, variable{
+					Name:            sym.Name,
+					Value:           fmt.Sprintf("$%02x", s.target.Peek8(sym.Addr)),
+					MemoryReference: fmt.Sprintf("0x%04x", sym.Addr),
+				})
+			}
+		}
+	}
+	return vars
+}
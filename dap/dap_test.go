@@ -0,0 +1,347 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ushitora-anqou/aqboy/cpu"
+	"github.com/ushitora-anqou/aqboy/symbol"
+)
+
+const testSource = `SECTION "Main", ROM0[$150]
+Main:
+	nop
+	ld a, 1
+.loop:
+	call Sub
+	jr .loop
+Sub:
+	ret
+
+SECTION "Vars", WRAM0[$c000]
+wCount: ds 1
+`
+
+const testSymbols = `00:0150 Main
+00:0153 Main.loop
+00:0158 Sub
+00:c000 wCount
+`
+
+func writeTestFiles(t *testing.T) (string, *symbol.Table) {
+	t.Helper()
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "main.asm")
+	if err := os.WriteFile(srcPath, []uint8(testSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+	symPath := filepath.Join(dir, "main.sym")
+	if err := os.WriteFile(symPath, []uint8(testSymbols), 0644); err != nil {
+		t.Fatal(err)
+	}
+	symbols := symbol.NewTable()
+	if err := symbols.LoadFile(symPath); err != nil {
+		t.Fatal(err)
+	}
+	return srcPath, symbols
+}
+
+func TestLineMap(t *testing.T) {
+	srcPath, symbols := writeTestFiles(t)
+	m := newLineMap()
+	if err := m.load(srcPath, symbols); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		addr uint16
+		line int
+	}{
+		{0x0150, 3},
+		{0x0151, 4},
+		{0x0153, 6},
+		{0x0156, 7},
+		{0x0158, 9},
+	} {
+		path, line, ok := m.lookupAddr(0, tc.addr)
+		if !ok || path != normalizePath(srcPath) || line != tc.line {
+			t.Fatalf("lookupAddr %04x: (got: %v %v) (expected: %v)", tc.addr, line, ok, tc.line)
+		}
+	}
+	if _, _, ok := m.lookupAddr(0, 0x0152); ok {
+		t.Fatalf("lookupAddr 0152: (got: %v) (expected: %v)", ok, false)
+	}
+
+	for _, tc := range []struct {
+		line, actual int
+		addr         uint16
+	}{
+		{1, 3, 0x0150},
+		{5, 6, 0x0153},
+		{9, 9, 0x0158},
+	} {
+		entry, ok := m.lookupLine(srcPath, tc.line)
+		if !ok || entry.line != tc.actual || entry.addr != tc.addr {
+			t.Fatalf("lookupLine %d: (got: %v %v) (expected: %v %04x)", tc.line, entry, ok, tc.actual, tc.addr)
+		}
+	}
+	if _, ok := m.lookupLine(srcPath, 13); ok {
+		t.Fatalf("lookupLine 13: (got: %v) (expected: %v)", ok, false)
+	}
+}
+
+// testTarget runs the program of testSource.
+type testTarget struct {
+	state cpu.State
+	stack []cpu.Frame
+	mem   [0x10000]uint8
+}
+
+func (t *testTarget) State() cpu.State        { return t.state }
+func (t *testTarget) CallStack() []cpu.Frame  { return t.stack }
+func (t *testTarget) Peek8(addr uint16) uint8 { return t.mem[addr] }
+func (t *testTarget) Bank(addr uint16) int    { return 0 }
+func (t *testTarget) LY() uint8               { return 0 }
+func (t *testTarget) Frame() int              { return 0 }
+
+func (t *testTarget) step() {
+	switch t.state.PC {
+	case 0x0150:
+		t.state.PC = 0x0151
+	case 0x0151:
+		t.state.A = 1
+		t.state.PC = 0x0153
+	case 0x0153:
+		t.stack = append(t.stack, cpu.Frame{CallerPC: 0x0153, Target: 0x0158, ReturnAddr: 0x0156})
+		t.state.PC = 0x0158
+	case 0x0156:
+		t.state.PC = 0x0153
+	case 0x0158:
+		t.state.PC = t.stack[len(t.stack)-1].ReturnAddr
+		t.stack = t.stack[:len(t.stack)-1]
+	}
+}
+
+// run emulates the target like AQBoy.Step does.
+func run(server *Server, target *testTarget) error {
+	for server.Attached() {
+		if server.ShouldBreak(target.state.PC) {
+			if err := server.Run(); err != nil {
+				return err
+			}
+		}
+		target.step()
+	}
+	return nil
+}
+
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	r      *textproto.Reader
+	seq    int
+	events []map[string]interface{}
+}
+
+func (c *testClient) receive() map[string]interface{} {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, err := c.r.ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	body := make([]uint8, length)
+	if _, err := io.ReadFull(c.r.R, body); err != nil {
+		c.t.Fatal(err)
+	}
+	msg := map[string]interface{}{}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+// request sends a request and returns the body of its response.
+func (c *testClient) request(command string, args interface{}) map[string]interface{} {
+	c.t.Helper()
+	c.seq++
+	data, err := json.Marshal(map[string]interface{}{
+		"seq": c.seq, "type": "request", "command": command, "arguments": args,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(c.conn, "Content-Length: %d\r\n\r\n%s", len(data), data); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		msg := c.receive()
+		if msg["type"] == "event" {
+			c.events = append(c.events, msg)
+			continue
+		}
+		if msg["request_seq"] != float64(c.seq) || msg["success"] != true {
+			c.t.Fatalf("%s: (got: %v) (expected: a successful response)", command, msg)
+		}
+		body, _ := msg["body"].(map[string]interface{})
+		return body
+	}
+}
+
+// expectEvent waits for the event and returns its body.
+func (c *testClient) expectEvent(name string) map[string]interface{} {
+	c.t.Helper()
+	for {
+		var msg map[string]interface{}
+		if len(c.events) > 0 {
+			msg, c.events = c.events[0], c.events[1:]
+		} else {
+			msg = c.receive()
+		}
+		if msg["type"] != "event" {
+			c.t.Fatalf("Unexpected message: %v", msg)
+		}
+		if msg["event"] == name {
+			body, _ := msg["body"].(map[string]interface{})
+			return body
+		}
+	}
+}
+
+func (c *testClient) expectStopped(reason string, line int) {
+	c.t.Helper()
+	if got := c.expectEvent("stopped")["reason"]; got != reason {
+		c.t.Fatalf("stopped: (got: %v) (expected: %v)", got, reason)
+	}
+	frames := c.request("stackTrace", map[string]interface{}{"threadId": threadID})["stackFrames"].([]interface{})
+	if got := frames[0].(map[string]interface{})["line"]; got != float64(line) {
+		c.t.Fatalf("stackTrace: (got: %v) (expected: %v)", got, line)
+	}
+}
+
+func TestServer(t *testing.T) {
+	srcPath, symbols := writeTestFiles(t)
+	target := &testTarget{}
+	target.state.PC = 0x0150
+	target.mem[0xc000] = 0x2a
+
+	server, err := Listen(target, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetSymbols(symbols)
+	done := make(chan error, 1)
+	go func() {
+		if err := server.Accept(); err != nil {
+			done <- err
+			return
+		}
+		done <- run(server, target)
+	}()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testClient{t: t, conn: conn, r: textproto.NewReader(bufio.NewReader(conn))}
+
+	if got := c.request("initialize", map[string]interface{}{"adapterID": "aqboy"}); got["supportsConfigurationDoneRequest"] != true {
+		t.Fatalf("initialize: (got: %v) (expected: supportsConfigurationDoneRequest)", got)
+	}
+	c.expectEvent("initialized")
+	c.request("launch", map[string]interface{}{"stopOnEntry": true})
+	bps := c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": srcPath},
+		"breakpoints": []map[string]interface{}{{"line": 5, "condition": "a == 1"}, {"line": 13}, {"line": 9, "condition": "a =="}},
+	})["breakpoints"].([]interface{})
+	if bp := bps[0].(map[string]interface{}); bp["verified"] != true || bp["line"] != float64(6) {
+		t.Fatalf("setBreakpoints: (got: %v) (expected: verified at line 6)", bp)
+	}
+	for _, bp := range bps[1:] {
+		if bp := bp.(map[string]interface{}); bp["verified"] != false {
+			t.Fatalf("setBreakpoints: (got: %v) (expected: not verified)", bp)
+		}
+	}
+	c.request("configurationDone", nil)
+	c.expectStopped("entry", 3)
+
+	// Breakpoint
+	c.request("continue", map[string]interface{}{"threadId": threadID})
+	c.expectStopped("breakpoint", 6)
+	c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": srcPath},
+		"breakpoints": []map[string]interface{}{},
+	})
+
+	// Steps
+	c.request("stepIn", map[string]interface{}{"threadId": threadID})
+	c.expectStopped("step", 9)
+	frames := c.request("stackTrace", map[string]interface{}{"threadId": threadID})["stackFrames"].([]interface{})
+	if len(frames) != 2 || frames[0].(map[string]interface{})["name"] != "Sub" {
+		t.Fatalf("stackTrace: (got: %v) (expected: Sub and its caller)", frames)
+	}
+	c.request("stepOut", map[string]interface{}{"threadId": threadID})
+	c.expectStopped("step", 7)
+	c.request("next", map[string]interface{}{"threadId": threadID})
+	c.expectStopped("step", 6)
+	c.request("next", map[string]interface{}{"threadId": threadID})
+	c.expectStopped("step", 7)
+
+	// Variables
+	scopes := c.request("scopes", map[string]interface{}{"frameId": 0})["scopes"].([]interface{})
+	if len(scopes) != 3 {
+		t.Fatalf("scopes: (got: %v) (expected: 3 scopes)", scopes)
+	}
+	for _, tc := range []struct {
+		ref         int
+		name, value string
+	}{
+		{refRegisters, "A", "$01"},
+		{refRegisters, "PC", "$0156"},
+		{refWRAM, "wCount", "$2a"},
+	} {
+		vars := c.request("variables", map[string]interface{}{"variablesReference": tc.ref})["variables"].([]interface{})
+		found := false
+		for _, v := range vars {
+			v := v.(map[string]interface{})
+			if v["name"] == tc.name {
+				found = true
+				if v["value"] != tc.value {
+					t.Fatalf("variables %s: (got: %v) (expected: %v)", tc.name, v["value"], tc.value)
+				}
+			}
+		}
+		if !found {
+			t.Fatalf("variables: (got: %v) (expected: %s)", vars, tc.name)
+		}
+	}
+
+	// Pause
+	c.request("continue", map[string]interface{}{"threadId": threadID})
+	c.request("pause", map[string]interface{}{"threadId": threadID})
+	if got := c.expectEvent("stopped")["reason"]; got != "pause" {
+		t.Fatalf("stopped: (got: %v) (expected: %v)", got, "pause")
+	}
+
+	c.request("disconnect", map[string]interface{}{"terminateDebuggee": true})
+	c.expectEvent("terminated")
+	if err := <-done; !errors.Is(err, ErrTerminated) {
+		t.Fatalf("Run: (got: %v) (expected: %v)", err, ErrTerminated)
+	}
+}
@@ -0,0 +1,161 @@
+package dap
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ushitora-anqou/aqboy/asm"
+	"github.com/ushitora-anqou/aqboy/symbol"
+)
+
+/*
+	RGBDS does not tell which source line each address comes from, so the
+	lines are mapped by reading the sources: a line defining a label is at
+	the address of the label in the symbol file, and each following line is
+	placed after the previous one by its size. The mapping is lost at lines
+	whose size is unknown, e.g. macros and INCLUDE, until the next label.
+*/
+
+type sourceLine struct {
+	line int
+	bank int
+	addr uint16
+}
+
+type sourceFile struct {
+	path  string
+	lines []sourceLine // Sorted by line
+}
+
+type lineMap struct {
+	files map[string]*sourceFile
+	addrs map[uint32]sourceLine // Key is bank<<16|addr
+	paths map[uint32]string
+}
+
+func newLineMap() *lineMap {
+	return &lineMap{
+		files: map[string]*sourceFile{},
+		addrs: map[uint32]sourceLine{},
+		paths: map[uint32]string{},
+	}
+}
+
+func addrKey(bank int, addr uint16) uint32 {
+	return uint32(bank)<<16 | uint32(addr)
+}
+
+func normalizePath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return filepath.Clean(path)
+}
+
+// labelOf splits a line into the label it defines, if any, and the rest.
+func labelOf(line string) (string, string) {
+	if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == ';' {
+		return "", line
+	}
+	end := strings.IndexAny(line, " \t:;")
+	if end < 0 {
+		end = len(line)
+	}
+	name := line[:end]
+	if (end == len(line) || line[end] != ':') && !strings.HasPrefix(name, ".") {
+		return "", line // e.g. "Size EQU 10"
+	}
+	return name, strings.TrimLeft(line[end:], ":")
+}
+
+// load maps the lines of the source file at path to addresses.
+func (m *lineMap) load(path string, symbols *symbol.Table) error {
+	path = normalizePath(path)
+	if _, ok := m.files[path]; ok {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	src := &sourceFile{path: path}
+	scope := ""
+	known := false
+	var bank int
+	var addr uint16
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if name, _ := labelOf(line); name != "" {
+			if strings.HasPrefix(name, ".") {
+				name = scope + name
+			} else if !strings.Contains(name, ".") {
+				scope = name
+			}
+			sym, ok := symbols.Lookup(name)
+			known = ok
+			bank, addr = sym.Bank, sym.Addr
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.EqualFold(fields[0], "section") {
+			known = false
+			continue
+		}
+		if !known {
+			continue
+		}
+		size, err := asm.LineSize(line)
+		if err != nil {
+			known = false
+			continue
+		}
+		_, rest := labelOf(line)
+		if size == 0 && strings.TrimSpace(strings.SplitN(rest, ";", 2)[0]) == "" {
+			continue // Only a label or a comment
+		}
+		entry := sourceLine{line: lineno, bank: bank, addr: addr}
+		src.lines = append(src.lines, entry)
+		key := addrKey(bank, addr)
+		if _, ok := m.addrs[key]; !ok {
+			m.addrs[key] = entry
+			m.paths[key] = path
+		}
+		addr += uint16(size)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	m.files[path] = src
+	return nil
+}
+
+// lookupAddr returns the source line of the instruction at bank:addr.
+func (m *lineMap) lookupAddr(bank int, addr uint16) (string, int, bool) {
+	key := addrKey(bank, addr)
+	entry, ok := m.addrs[key]
+	if !ok {
+		return "", 0, false
+	}
+	return m.paths[key], entry.line, true
+}
+
+// lookupLine returns the first mapped line at or after line in the file.
+func (m *lineMap) lookupLine(path string, line int) (sourceLine, bool) {
+	src, ok := m.files[normalizePath(path)]
+	if !ok {
+		return sourceLine{}, false
+	}
+	i := sort.Search(len(src.lines), func(i int) bool {
+		return src.lines[i].line >= line
+	})
+	if i == len(src.lines) {
+		return sourceLine{}, false
+	}
+	return src.lines[i], true
+}
@@ -0,0 +1,850 @@
+// Package debugger provides an interactive debugger for the game running on
+// the emulator. It talks through a plain text stream, e.g. a terminal.
+package debugger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ushitora-anqou/aqboy/constant"
+	"github.com/ushitora-anqou/aqboy/cpu"
+	"github.com/ushitora-anqou/aqboy/expr"
+	"github.com/ushitora-anqou/aqboy/ioreg"
+	"github.com/ushitora-anqou/aqboy/mmu"
+	"github.com/ushitora-anqou/aqboy/symbol"
+)
+
+// ErrQuit is returned by Run when the user asks to quit the emulator.
+var ErrQuit = errors.New("Quit")
+
+// Machine is the emulator seen from the debugger.
+type Machine interface {
+	// Step executes one instruction and updates the other components accordingly.
+	Step() (uint, error)
+	// Replay executes one instruction again after Rewind like Step, without
+	// making the outputs, e.g. the trace, again.
+	Replay() (uint, error)
+	State() cpu.State
+	CallStack() []cpu.Frame
+	// Peek8 reads the memory without side effects.
+	Peek8(addr uint16) uint8
+	Bank(addr uint16) int
+	LY() uint8
+	Frame() int
+	SetWatchpoints(wps []mmu.Watchpoint)
+	// TakeWatchHit returns the access caught by a watchpoint since the last call.
+	TakeWatchHit() (mmu.WatchHit, bool)
+	// TakeSourceBreakpoint returns the address of the source breakpoint, i.e.
+	// "ld b, b", executed since the last call.
+	TakeSourceBreakpoint() (uint16, bool)
+	// Steps returns the number of the instructions executed since the power-on.
+	Steps() uint64
+	// Rewind restores the latest snapshot of the machine taken at or before
+	// the step-th instruction. It returns false if there is none.
+	Rewind(step uint64) bool
+	// IORegisters returns the hardware registers with their bitfields decoded.
+	IORegisters() []ioreg.Register
+	// Poke writes to the memory, patching the ROM. See mmu.MMU.Poke.
+	Poke(p mmu.Poke) error
+	// Freeze pokes p, and pokes it again at the end of every frame.
+	Freeze(p mmu.Poke) error
+	Unfreeze(index int)
+	Freezes() []mmu.Poke
+	// TileImage renders the tile data at 8000-97FF with the colors given by
+	// paletteData, e.g. BGP.
+	TileImage(paletteData uint8) *image.Paletted
+	// TileMapImage renders the background of the tile map at tileMapAddr,
+	// or at the one used for BG if 0, with the viewport and the window
+	// outlined.
+	TileMapImage(tileMapAddr uint16) *image.Paletted
+}
+
+// Breakpoint stops the emulation before the instruction at Bank:Addr is executed.
+type Breakpoint struct {
+	Bank int // -1 matches any bank
+	Addr uint16
+	Cond *expr.Expr // Checked before the instruction if not nil
+}
+
+func (bp Breakpoint) String() string {
+	s := fmt.Sprintf("%02x:%04x", bp.Bank, bp.Addr)
+	if bp.Bank < 0 {
+		s = fmt.Sprintf("**:%04x", bp.Addr)
+	}
+	if bp.Cond != nil {
+		s += " if " + bp.Cond.String()
+	}
+	return s
+}
+
+// Watchpoint stops the emulation after an instruction accesses the memory.
+type Watchpoint struct {
+	mmu.Watchpoint
+	Cond *expr.Expr // Checked after the access if not nil
+}
+
+func (wp Watchpoint) String() string {
+	if wp.Cond != nil {
+		return wp.Watchpoint.String() + " if " + wp.Cond.String()
+	}
+	return wp.Watchpoint.String()
+}
+
+// The commands running the emulation stop after this many ticks even if they
+// are not done, so that the debugger never hangs.
+const maxRunTicks = 60 * constant.FRAME_TICKS
+
+type Debugger struct {
+	m           Machine
+	symbols     *symbol.Table
+	breakpoints []Breakpoint
+	breakAddrs  [0x10000]bool // true if any breakpoint is at the address
+	watchpoints []Watchpoint
+	requested   bool
+	in          *bufio.Scanner
+	out         io.Writer
+	lastLine    string
+}
+
+func NewDebugger(m Machine, in io.Reader, out io.Writer) *Debugger {
+	return &Debugger{
+		m:   m,
+		in:  bufio.NewScanner(in),
+		out: out,
+	}
+}
+
+// SetSymbols makes the debugger accept and show labels.
+func (d *Debugger) SetSymbols(symbols *symbol.Table) {
+	d.symbols = symbols
+}
+
+// Break makes ShouldBreak return true for the next instruction.
+func (d *Debugger) Break() {
+	d.requested = true
+}
+
+func (d *Debugger) AddBreakpoint(bp Breakpoint) {
+	d.breakpoints = append(d.breakpoints, bp)
+	d.breakAddrs[bp.Addr] = true
+}
+
+func (d *Debugger) Breakpoints() []Breakpoint {
+	return d.breakpoints
+}
+
+func (d *Debugger) deleteBreakpoint(index int) {
+	bp := d.breakpoints[index]
+	d.breakpoints = append(d.breakpoints[:index], d.breakpoints[index+1:]...)
+	d.breakAddrs[bp.Addr] = false
+	for _, other := range d.breakpoints {
+		if other.Addr == bp.Addr {
+			d.breakAddrs[bp.Addr] = true
+		}
+	}
+}
+
+func (d *Debugger) AddWatchpoint(wp Watchpoint) {
+	d.watchpoints = append(d.watchpoints, wp)
+	d.updateWatchpoints()
+}
+
+func (d *Debugger) Watchpoints() []Watchpoint {
+	return d.watchpoints
+}
+
+func (d *Debugger) deleteWatchpoint(index int) {
+	d.watchpoints = append(d.watchpoints[:index], d.watchpoints[index+1:]...)
+	d.updateWatchpoints()
+}
+
+func (d *Debugger) updateWatchpoints() {
+	var wps []mmu.Watchpoint
+	for _, wp := range d.watchpoints {
+		wps = append(wps, wp.Watchpoint)
+	}
+	d.m.SetWatchpoints(wps)
+}
+
+// Stepped is called after the instruction at pc is executed. If it hit a
+// watchpoint or a source breakpoint, the hit is reported and ShouldBreak
+// returns true for the next instruction.
+func (d *Debugger) Stepped(pc uint16) {
+	if d.reportHit(pc) {
+		d.requested = true
+	}
+}
+
+// reportHit reports the watchpoint or the source breakpoint hit by the
+// instruction at pc, and returns true if any.
+func (d *Debugger) reportHit(pc uint16) bool {
+	msg := d.takeHit(pc)
+	if msg == "" {
+		return false
+	}
+	fmt.Fprintln(d.out, msg)
+	return true
+}
+
+// takeHit returns the report of the watchpoint or the source breakpoint hit
+// by the instruction at pc, or "" if none.
+func (d *Debugger) takeHit(pc uint16) string {
+	if addr, ok := d.m.TakeSourceBreakpoint(); ok {
+		d.m.TakeWatchHit() // Stop once for the instruction
+		return fmt.Sprintf("Source breakpoint at %s", d.where(addr))
+	}
+	hit, ok := d.m.TakeWatchHit()
+	if !ok {
+		return ""
+	}
+	index := -1
+	for i, wp := range d.watchpoints {
+		if wp.Watchpoint == hit.Watchpoint && (wp.Cond == nil || wp.Cond.True(d.m)) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return "" // The condition is not met
+	}
+	return fmt.Sprintf("Watchpoint %d: %v at %s", index, hit, d.where(pc))
+}
+
+// breakpointAt returns the index of the breakpoint at pc, or -1.
+func (d *Debugger) breakpointAt(pc uint16) int {
+	if !d.breakAddrs[pc] {
+		return -1
+	}
+	bank := d.m.Bank(pc)
+	for i, bp := range d.breakpoints {
+		if bp.Addr == pc && (bp.Bank < 0 || bp.Bank == bank) && (bp.Cond == nil || bp.Cond.True(d.m)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ShouldBreak is called before each instruction is executed, and returns true
+// if Run should be called since a breakpoint is hit or Break was called.
+func (d *Debugger) ShouldBreak(pc uint16) bool {
+	if d.requested {
+		d.requested = false
+		return true
+	}
+	if !d.breakAddrs[pc] {
+		return false
+	}
+	if i := d.breakpointAt(pc); i >= 0 {
+		fmt.Fprintf(d.out, "Breakpoint %d at %s\n", i, d.where(pc))
+		return true
+	}
+	return false
+}
+
+// where returns a string like "01:4003 (Banked+3)".
+func (d *Debugger) where(addr uint16) string {
+	bank := d.m.Bank(addr)
+	s := fmt.Sprintf("%02x:%04x", bank, addr)
+	if d.symbols != nil {
+		if name := d.symbols.Symbolize(bank, addr); name != "" {
+			s += " (" + name + ")"
+		}
+	}
+	return s
+}
+
+func (d *Debugger) disassemble(addr uint16) (string, uint16) {
+	return cpu.Disassemble(d.m.Peek8, addr)
+}
+
+func (d *Debugger) showLocation() {
+	pc := d.m.State().PC
+	text, _ := d.disassemble(pc)
+	fmt.Fprintf(d.out, "%s: %s\n", d.where(pc), text)
+}
+
+// Run reads and executes commands until the emulation is resumed. It returns
+// ErrQuit if the user quits or the input ends.
+func (d *Debugger) Run() error {
+	d.showLocation()
+	for {
+		fmt.Fprint(d.out, "(aqboy) ")
+		if !d.in.Scan() {
+			fmt.Fprintln(d.out)
+			if err := d.in.Err(); err != nil {
+				return err
+			}
+			return ErrQuit
+		}
+		line := strings.TrimSpace(d.in.Text())
+		if line == "" {
+			line = d.lastLine // Repeat the last command
+		}
+		d.lastLine = line
+		if line == "" {
+			continue
+		}
+
+		resume, err := d.execute(strings.Fields(line))
+		if err != nil {
+			if errors.Is(err, ErrQuit) {
+				return err
+			}
+			fmt.Fprintf(d.out, "Error: %v\n", err)
+		}
+		if resume {
+			return nil
+		}
+	}
+}
+
+const helpMessage = `Commands:
+  continue, c           Resume the emulation
+  step, s [N]           Execute N instructions (default: 1)
+  next, n               Execute an instruction, stepping over CALL and RST
+  finish, fin           Run until the current routine returns
+  reverse-step, rs [N]  Execute N instructions backwards (default: 1)
+  reverse-continue, rc  Run backwards until a breakpoint or a watchpoint
+  reverse-frame, rf [N] Go back to the start of the Nth previous frame
+                        (default: 1)
+  break, b LOC [if COND]
+                        Set a breakpoint
+  delete, d [N]         Delete the breakpoint N, or all of them
+  watch, w LOC[-END] [KIND] [if COND]
+                        Set a watchpoint on the addresses. KIND is r (read),
+                        w (write, default), rw or c (write changing the value)
+  unwatch, uw [N]       Delete the watchpoint N, or all of them
+  tiles FILE [PALETTE]  Write the tile data to FILE as a PNG image with the
+                        colors of PALETTE (default: BGP), e.g. e4
+  map FILE [ADDR]       Write the background of the tile map at ADDR, 9800 or
+                        9c00 (default: the one used for BG), to FILE as a PNG
+                        image with the viewport in red and the window in blue
+  poke LOC VAL...       Write the bytes to LOC and the following addresses.
+                        A write to the ROM patches it
+  freeze, fr LOC VAL    Keep LOC at VAL, writing it at the end of every frame
+  unfreeze, ufr [N]     Delete the freeze N, or all of them
+  info, i               List the breakpoints, the watchpoints and the freezes
+  regs, r               Show the registers and the flags
+  x [LOC [N]]           Dump N bytes of the memory (default: PC, 64)
+  disas, l [LOC [N]]    Disassemble N instructions (default: PC, 10)
+  bt                    Show the call stack
+  io [REG]              Show the I/O registers decoded, or only REG, e.g.
+                        LCDC or ff40
+  quit, q               Quit the emulator
+LOC is a label, BANK:ADDR or ADDR in hex, e.g. Main.loop, 01:4000 or $c000.
+COND is an expression like "a == 0x3c && [0xc0a0] > 5 && ly == 144".
+An empty line repeats the last command.
+`
+
+// execute runs a command and returns true if the emulation should be resumed.
+func (d *Debugger) execute(args []string) (bool, error) {
+	switch args[0] {
+	case "help", "h", "?":
+		fmt.Fprint(d.out, helpMessage)
+
+	case "continue", "c":
+		return true, nil
+
+	case "step", "s":
+		n, err := d.parseCount(args, 1, 1)
+		if err != nil {
+			return false, err
+		}
+		err = d.runUntil(func() bool {
+			n--
+			return n == 0
+		})
+		d.showLocation()
+		return false, err
+
+	case "next", "n":
+		err := d.stepOver()
+		d.showLocation()
+		return false, err
+
+	case "finish", "fin":
+		depth := len(d.m.CallStack())
+		if depth == 0 {
+			return false, fmt.Errorf("No caller")
+		}
+		err := d.runUntil(func() bool {
+			return len(d.m.CallStack()) < depth
+		})
+		d.showLocation()
+		return false, err
+
+	case "reverse-step", "rs":
+		n, err := d.parseCount(args, 1, 1)
+		if err != nil {
+			return false, err
+		}
+		err = d.reverseStep(uint64(n))
+		d.showLocation()
+		return false, err
+
+	case "reverse-continue", "rc":
+		err := d.reverseContinue()
+		d.showLocation()
+		return false, err
+
+	case "reverse-frame", "rf":
+		n, err := d.parseCount(args, 1, 1)
+		if err != nil {
+			return false, err
+		}
+		err = d.reverseFrame(n)
+		d.showLocation()
+		return false, err
+
+	case "break", "b":
+		if len(args) < 2 {
+			return false, fmt.Errorf("Location required")
+		}
+		args, cond, err := parseCondition(args)
+		if err != nil {
+			return false, err
+		}
+		if len(args) != 2 {
+			return false, fmt.Errorf("Invalid arguments")
+		}
+		bp, err := d.parseLocation(args[1])
+		if err != nil {
+			return false, err
+		}
+		bp.Cond = cond
+		d.AddBreakpoint(bp)
+		fmt.Fprintf(d.out, "Breakpoint %d at %v\n", len(d.breakpoints)-1, bp)
+
+	case "delete", "d":
+		if len(args) < 2 {
+			for len(d.breakpoints) > 0 {
+				d.deleteBreakpoint(0)
+			}
+			return false, nil
+		}
+		index, err := strconv.Atoi(args[1])
+		if err != nil || index < 0 || len(d.breakpoints) <= index {
+			return false, fmt.Errorf("No breakpoint: %s", args[1])
+		}
+		d.deleteBreakpoint(index)
+
+	case "watch", "w":
+		wp, err := d.parseWatchpoint(args)
+		if err != nil {
+			return false, err
+		}
+		d.AddWatchpoint(wp)
+		fmt.Fprintf(d.out, "Watchpoint %d at %v\n", len(d.watchpoints)-1, wp)
+
+	case "unwatch", "uw":
+		if len(args) < 2 {
+			d.watchpoints = nil
+			d.updateWatchpoints()
+			return false, nil
+		}
+		index, err := strconv.Atoi(args[1])
+		if err != nil || index < 0 || len(d.watchpoints) <= index {
+			return false, fmt.Errorf("No watchpoint: %s", args[1])
+		}
+		d.deleteWatchpoint(index)
+
+	case "tiles":
+		if len(args) < 2 {
+			return false, fmt.Errorf("File name required")
+		}
+		paletteData, err := d.parsePalette(args)
+		if err != nil {
+			return false, err
+		}
+		if err := WritePNG(args[1], d.m.TileImage(paletteData)); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(d.out, "Wrote %s\n", args[1])
+
+	case "map":
+		if len(args) < 2 {
+			return false, fmt.Errorf("File name required")
+		}
+		tileMapAddr := uint64(0)
+		if len(args) >= 3 {
+			var err error
+			tileMapAddr, err = ParseHex(args[2], 16)
+			if err != nil || (tileMapAddr != 0x9800 && tileMapAddr != 0x9c00) {
+				return false, fmt.Errorf("Invalid tile map (expected: 9800 or 9c00): %s", args[2])
+			}
+		}
+		if err := WritePNG(args[1], d.m.TileMapImage(uint16(tileMapAddr))); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(d.out, "Wrote %s\n", args[1])
+
+	case "poke":
+		pokes, err := d.parsePokes(args)
+		if err != nil {
+			return false, err
+		}
+		for _, p := range pokes {
+			if err := d.m.Poke(p); err != nil {
+				return false, err
+			}
+		}
+
+	case "freeze", "fr":
+		pokes, err := d.parsePokes(args)
+		if err != nil {
+			return false, err
+		}
+		if len(pokes) != 1 {
+			return false, fmt.Errorf("Invalid arguments")
+		}
+		if err := d.m.Freeze(pokes[0]); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(d.out, "Frozen %v\n", pokes[0])
+
+	case "unfreeze", "ufr":
+		n := len(d.m.Freezes())
+		if len(args) < 2 {
+			for ; n > 0; n-- {
+				d.m.Unfreeze(0)
+			}
+			return false, nil
+		}
+		index, err := strconv.Atoi(args[1])
+		if err != nil || index < 0 || n <= index {
+			return false, fmt.Errorf("No freeze: %s", args[1])
+		}
+		d.m.Unfreeze(index)
+
+	case "info", "i":
+		if len(d.breakpoints) == 0 {
+			fmt.Fprintln(d.out, "No breakpoints")
+		}
+		for i, bp := range d.breakpoints {
+			fmt.Fprintf(d.out, "%d: %v\n", i, bp)
+		}
+		if len(d.watchpoints) == 0 {
+			fmt.Fprintln(d.out, "No watchpoints")
+		}
+		for i, wp := range d.watchpoints {
+			fmt.Fprintf(d.out, "w%d: %v\n", i, wp)
+		}
+		for i, p := range d.m.Freezes() {
+			fmt.Fprintf(d.out, "f%d: %v\n", i, p)
+		}
+
+	case "regs", "r":
+		d.showRegisters()
+
+	case "x":
+		addr, err := d.parseAddr(args, d.m.State().PC)
+		if err != nil {
+			return false, err
+		}
+		n, err := d.parseCount(args, 2, 64)
+		if err != nil {
+			return false, err
+		}
+		d.dumpMemory(addr, n)
+
+	case "disas", "l":
+		addr, err := d.parseAddr(args, d.m.State().PC)
+		if err != nil {
+			return false, err
+		}
+		n, err := d.parseCount(args, 2, 10)
+		if err != nil {
+			return false, err
+		}
+		d.showDisassembly(addr, n)
+
+	case "bt":
+		for i, frame := range d.m.CallStack() {
+			fmt.Fprintf(d.out, "#%d %v\n", i, frame)
+		}
+
+	case "io":
+		regs := d.m.IORegisters()
+		if len(args) < 2 {
+			for _, r := range regs {
+				fmt.Fprintln(d.out, r)
+			}
+			return false, nil
+		}
+		r, ok := ioreg.Find(regs, args[1])
+		if !ok {
+			return false, fmt.Errorf("No I/O register: %s", args[1])
+		}
+		fmt.Fprintln(d.out, r)
+
+	case "quit", "q":
+		return false, ErrQuit
+
+	default:
+		return false, fmt.Errorf("Unknown command: %s (type \"help\" for the list)", args[0])
+	}
+	return false, nil
+}
+
+// runUntil steps the machine until done returns true or a breakpoint is hit.
+func (d *Debugger) runUntil(done func() bool) error {
+	for ticks := uint(0); ticks < maxRunTicks; {
+		pc := d.m.State().PC
+		tick, err := d.m.Step()
+		if err != nil {
+			return err
+		}
+		ticks += tick
+		if d.reportHit(pc) || done() {
+			return nil
+		}
+		pc = d.m.State().PC
+		if i := d.breakpointAt(pc); i >= 0 {
+			fmt.Fprintf(d.out, "Breakpoint %d at %s\n", i, d.where(pc))
+			return nil
+		}
+	}
+	fmt.Fprintf(d.out, "Stopped after %d ticks\n", maxRunTicks)
+	return nil
+}
+
+func isCall(opcode uint8) bool {
+	switch opcode {
+	case 0xcd, 0xc4, 0xcc, 0xd4, 0xdc: // CALL
+		return true
+	}
+	return opcode&0xc7 == 0xc7 // RST
+}
+
+func (d *Debugger) stepOver() error {
+	pc := d.m.State().PC
+	opcode := d.m.Peek8(pc)
+	if !isCall(opcode) {
+		return d.runUntil(func() bool { return true })
+	}
+	depth := len(d.m.CallStack())
+	next := pc + cpu.InstLength(opcode)
+	return d.runUntil(func() bool {
+		return d.m.State().PC == next && len(d.m.CallStack()) <= depth
+	})
+}
+
+func (d *Debugger) showRegisters() {
+	s := d.m.State()
+	flags := []uint8("----")
+	for i, name := range "ZNHC" {
+		if s.F&(0x80>>i) != 0 {
+			flags[i] = uint8(name)
+		}
+	}
+	fmt.Fprintf(d.out, "A:%02x F:%02x [%s] B:%02x C:%02x D:%02x E:%02x H:%02x L:%02x SP:%04x PC:%04x\n",
+		s.A, s.F, flags, s.B, s.C, s.D, s.E, s.H, s.L, s.SP, s.PC)
+	fmt.Fprintf(d.out, "IME:%d IE:%02x IF:%02x Halted:%v\n", b2i(s.IME), s.IE, s.IF, s.Halted)
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (d *Debugger) dumpMemory(addr uint16, n int) {
+	for i := 0; i < n; i += 16 {
+		var line strings.Builder
+		fmt.Fprintf(&line, "%04x:", addr+uint16(i))
+		for j := i; j < i+16 && j < n; j++ {
+			fmt.Fprintf(&line, " %02x", d.m.Peek8(addr+uint16(j)))
+		}
+		fmt.Fprintln(d.out, line.String())
+	}
+}
+
+func (d *Debugger) showDisassembly(addr uint16, n int) {
+	pc := d.m.State().PC
+	for i := 0; i < n; i++ {
+		if d.symbols != nil {
+			if sym, ok := d.symbols.Nearest(d.m.Bank(addr), addr); ok && sym.Addr == addr {
+				fmt.Fprintf(d.out, "%s:\n", sym.Name)
+			}
+		}
+		marker := "  "
+		if addr == pc {
+			marker = "=>"
+		}
+		text, length := d.disassemble(addr)
+		fmt.Fprintf(d.out, "%s %02x:%04x  %s\n", marker, d.m.Bank(addr), addr, text)
+		addr += length
+	}
+}
+
+func (d *Debugger) parseLocation(s string) (Breakpoint, error) {
+	return ParseLocation(d.symbols, s)
+}
+
+// ParseLocation parses a label of symbols, "BANK:ADDR" or "ADDR". Numbers
+// are in hex with an optional prefix "$" or "0x". symbols may be nil. The
+// bank is -1 if not given.
+func ParseLocation(symbols *symbol.Table, s string) (Breakpoint, error) {
+	if symbols != nil {
+		if sym, ok := symbols.Lookup(s); ok {
+			return Breakpoint{Bank: sym.Bank, Addr: sym.Addr}, nil
+		}
+	}
+	bank := -1
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		n, err := ParseHex(s[:i], 16)
+		if err != nil {
+			return Breakpoint{}, fmt.Errorf("Invalid bank: %s", s)
+		}
+		bank, s = int(n), s[i+1:]
+	}
+	addr, err := ParseHex(s, 16)
+	if err != nil {
+		return Breakpoint{}, fmt.Errorf("Invalid location: %s", s)
+	}
+	return Breakpoint{Bank: bank, Addr: uint16(addr)}, nil
+}
+
+// parseCondition splits "ARGS... if COND" into ARGS and COND. COND is nil
+// if there is no "if".
+func parseCondition(args []string) ([]string, *expr.Expr, error) {
+	for i, arg := range args {
+		if arg == "if" {
+			cond, err := expr.Parse(strings.Join(args[i+1:], " "))
+			return args[:i], cond, err
+		}
+	}
+	return args, nil, nil
+}
+
+// parsePalette parses args[2] as a palette like BGP if any, or returns BGP.
+func (d *Debugger) parsePalette(args []string) (uint8, error) {
+	if len(args) < 3 {
+		bgp, _ := ioreg.Find(d.m.IORegisters(), "BGP")
+		return bgp.Value, nil
+	}
+	val, err := ParseHex(args[2], 8)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid palette: %s", args[2])
+	}
+	return uint8(val), nil
+}
+
+// WritePNG writes img to the file in the PNG format.
+func WritePNG(filename string, img image.Image) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// parsePokes parses the arguments of the commands "poke" and "freeze", i.e.
+// a location and the values written to it and the following addresses.
+func (d *Debugger) parsePokes(args []string) ([]mmu.Poke, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("Location and value required")
+	}
+	loc, err := d.parseLocation(args[1])
+	if err != nil {
+		return nil, err
+	}
+	var pokes []mmu.Poke
+	for i, arg := range args[2:] {
+		val, err := ParseHex(arg, 8)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value: %s", arg)
+		}
+		if int(loc.Addr)+i > 0xffff {
+			return nil, fmt.Errorf("Too many values")
+		}
+		pokes = append(pokes, mmu.Poke{Bank: loc.Bank, Addr: loc.Addr + uint16(i), Val: uint8(val)})
+	}
+	return pokes, nil
+}
+
+// parseWatchpoint parses the arguments of the command "watch".
+func (d *Debugger) parseWatchpoint(args []string) (Watchpoint, error) {
+	args, cond, err := parseCondition(args)
+	if err != nil {
+		return Watchpoint{}, err
+	}
+	wp, err := d.parseWatchRange(args)
+	return Watchpoint{Watchpoint: wp, Cond: cond}, err
+}
+
+func (d *Debugger) parseWatchRange(args []string) (mmu.Watchpoint, error) {
+	if len(args) < 2 {
+		return mmu.Watchpoint{}, fmt.Errorf("Location required")
+	}
+	locs := strings.SplitN(args[1], "-", 2)
+	from, err := d.parseLocation(locs[0])
+	if err != nil {
+		return mmu.Watchpoint{}, err
+	}
+	to := from
+	if len(locs) == 2 {
+		if to, err = d.parseLocation(locs[1]); err != nil {
+			return mmu.Watchpoint{}, err
+		}
+		if to.Addr < from.Addr {
+			return mmu.Watchpoint{}, fmt.Errorf("Invalid range: %s", args[1])
+		}
+	}
+	wp := mmu.Watchpoint{Kind: mmu.WatchWrite, From: from.Addr, To: to.Addr}
+	if len(args) >= 3 {
+		switch args[2] {
+		case "r":
+			wp.Kind = mmu.WatchRead
+		case "w":
+			wp.Kind = mmu.WatchWrite
+		case "rw", "wr":
+			wp.Kind = mmu.WatchRead | mmu.WatchWrite
+		case "c":
+			wp.Kind = mmu.WatchChange
+		default:
+			return mmu.Watchpoint{}, fmt.Errorf("Invalid kind: %s", args[2])
+		}
+	}
+	return wp, nil
+}
+
+// ParseHex parses a number in hex with an optional prefix "$" or "0x".
+func ParseHex(s string, bitSize int) (uint64, error) {
+	s = strings.TrimPrefix(s, "$")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	return strconv.ParseUint(s, 16, bitSize)
+}
+
+// parseAddr parses args[1] as a location if any. The bank is ignored since
+// the memory is read as currently mapped.
+func (d *Debugger) parseAddr(args []string, defaultAddr uint16) (uint16, error) {
+	if len(args) < 2 {
+		return defaultAddr, nil
+	}
+	bp, err := d.parseLocation(args[1])
+	return bp.Addr, err
+}
+
+func (d *Debugger) parseCount(args []string, index, defaultCount int) (int, error) {
+	if len(args) <= index {
+		return defaultCount, nil
+	}
+	n, err := strconv.Atoi(args[index])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid count: %s", args[index])
+	}
+	return n, nil
+}
@@ -0,0 +1,103 @@
+package debugger
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The machine cannot go back further than its history. The history is made
+// of snapshots taken periodically, and the emulation between them is
+// deterministic, so the machine goes back to an instruction by restoring the
+// latest snapshot before it and executing the emulation again up to it.
+
+var errNoHistory = errors.New("The history does not go back that far")
+
+// seek makes the machine the state before the step-th instruction.
+func (d *Debugger) seek(step uint64) error {
+	if !d.m.Rewind(step) {
+		return errNoHistory
+	}
+	return d.replay(func() bool { return d.m.Steps() >= step })
+}
+
+// replay steps the machine until done returns true, ignoring the
+// breakpoints and the watchpoints.
+func (d *Debugger) replay(done func() bool) error {
+	for !done() {
+		if _, err := d.m.Replay(); err != nil {
+			return err
+		}
+		d.m.TakeWatchHit()
+		d.m.TakeSourceBreakpoint()
+	}
+	return nil
+}
+
+func (d *Debugger) reverseStep(n uint64) error {
+	steps := d.m.Steps()
+	if n > steps {
+		return errNoHistory
+	}
+	return d.seek(steps - n)
+}
+
+// reverseFrame goes back to the start of the nth previous frame.
+func (d *Debugger) reverseFrame(n int) error {
+	frame := d.m.Frame() - n
+	if frame < 0 {
+		return errNoHistory
+	}
+	steps := d.m.Steps()
+	for d.m.Frame() > frame {
+		if d.m.Steps() == 0 || !d.m.Rewind(d.m.Steps()-1) {
+			if err := d.seek(steps); err != nil {
+				return err
+			}
+			return errNoHistory
+		}
+	}
+	return d.replay(func() bool { return d.m.Frame() >= frame })
+}
+
+// reverseContinue goes back to the latest point where the emulation would
+// have stopped at a breakpoint, a watchpoint or a source breakpoint.
+func (d *Debugger) reverseContinue() error {
+	steps := d.m.Steps()
+
+	// Search the span between each snapshot and the next one from the latest.
+	for end := steps; end > 0; {
+		if !d.m.Rewind(end - 1) {
+			break
+		}
+		start := d.m.Steps()
+		found, stop, msg := false, uint64(0), ""
+		for d.m.Steps() < end {
+			step := d.m.Steps()
+			pc := d.m.State().PC
+			if i := d.breakpointAt(pc); i >= 0 {
+				found, stop, msg = true, step, fmt.Sprintf("Breakpoint %d at %s", i, d.where(pc))
+			}
+			if _, err := d.m.Replay(); err != nil {
+				return err
+			}
+			if hit := d.takeHit(pc); hit != "" && step+1 < end {
+				found, stop, msg = true, step+1, hit
+			}
+		}
+		if found {
+			if err := d.seek(stop); err != nil {
+				return err
+			}
+			fmt.Fprintln(d.out, msg)
+			return nil
+		}
+		end = start
+	}
+
+	// Come back to where it started.
+	if err := d.seek(steps); err != nil {
+		return err
+	}
+	fmt.Fprintln(d.out, "Reached the start of the history")
+	return nil
+}
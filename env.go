@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ushitora-anqou/aqboy/eventlog"
+	"github.com/ushitora-anqou/aqboy/expr"
+	"github.com/ushitora-anqou/aqboy/mmu"
+	"github.com/ushitora-anqou/aqboy/profiler"
+)
+
+// ConfigureFromEnv enables the debugging facilities requested through
+// environment variables:
+//
+//	AQBOY_SYMBOLS        Load labels from the RGBDS .sym or .map file.
+//	AQBOY_TRACE          Write the per-instruction CPU trace to the file.
+//	AQBOY_TRACE_FILTER   Trace only the instructions before which the
+//	                     expression is true, e.g. "ly == 144". See package
+//	                     expr.
+//	AQBOY_DEBUG_MESSAGES Recognize the debug instructions of BGB, and write
+//	                     the debug messages to the file, or to the standard
+//	                     output if "-".
+//	AQBOY_GUEST_PROFILE  Profile the guest code and write the result to the
+//	                     file in the pprof format, and to the file with
+//	                     ".txt" appended as a report.
+//	AQBOY_EVENT_LOG      Record the hardware events, e.g. interrupts and I/O
+//	                     register writes, and write the latest ones to the
+//	                     file at the end.
+//	AQBOY_TIMELINE       Write the timeline of the emulation to the file in
+//	                     the Chrome trace event format.
+//	AQBOY_TIMELINE_FRAMES
+//	                     The frames recorded by AQBOY_TIMELINE, e.g. "120"
+//	                     or "120-179". Defaults to the first 60 frames.
+//	AQBOY_HISTORY        Keep the latest N frames from the start for the
+//	                     reverse execution in the debugger. Without it, the
+//	                     latest 60 frames are kept from when the debugger is
+//	                     first entered.
+//	AQBOY_CRASH_DUMP     Write a crash dump to the directory when the
+//	                     emulation fails. See package crashdump.
+//	AQBOY_GDB            Wait for a GDB client on the address, e.g.
+//	                     "localhost:2345", before starting the emulation.
+//	AQBOY_DAP            Wait for a client of the Debug Adapter Protocol on
+//	                     the address, e.g. "localhost:4711", before starting
+//	                     the emulation.
+//	AQBOY_CDL            Record how each byte of the memory is accessed to
+//	                     the file. The records in an existing file are kept.
+func (a *AQBoy) ConfigureFromEnv() error {
+	if filename := os.Getenv("AQBOY_SYMBOLS"); filename != "" {
+		if err := a.LoadSymbols(filename); err != nil {
+			return err
+		}
+	}
+	if filename := os.Getenv("AQBOY_TRACE"); filename != "" {
+		file, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(file)
+		a.SetTraceWriter(w)
+		a.closers = append(a.closers, w.Flush, file.Close)
+	}
+	if src := os.Getenv("AQBOY_TRACE_FILTER"); src != "" {
+		cond, err := expr.Parse(src)
+		if err != nil {
+			return err
+		}
+		a.SetTraceFilter(cond)
+	}
+	if filename := os.Getenv("AQBOY_DEBUG_MESSAGES"); filename == "-" {
+		a.SetDebugMessageWriter(os.Stdout)
+	} else if filename != "" {
+		file, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		a.SetDebugMessageWriter(file)
+		a.closers = append(a.closers, file.Close)
+	}
+	if filename := os.Getenv("AQBOY_GUEST_PROFILE"); filename != "" {
+		prof := a.EnableProfiler()
+		a.closers = append(a.closers, func() error {
+			return writeProfile(prof, filename)
+		})
+	}
+	if filename := os.Getenv("AQBOY_CDL"); filename != "" {
+		cdl := a.EnableCDL()
+		if err := readCDL(cdl, filename); err != nil {
+			return err
+		}
+		a.closers = append(a.closers, func() error {
+			return writeCDL(cdl, filename)
+		})
+	}
+	if filename := os.Getenv("AQBOY_EVENT_LOG"); filename != "" {
+		events := a.EnableEventLog(eventLogSize)
+		a.closers = append(a.closers, func() error {
+			return writeEventLog(events, filename)
+		})
+	}
+	if filename := os.Getenv("AQBOY_TIMELINE"); filename != "" {
+		from, to, err := parseFrames(os.Getenv("AQBOY_TIMELINE_FRAMES"))
+		if err != nil {
+			return err
+		}
+		file, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(file)
+		a.RecordTimeline(from, to, w)
+		a.closers = append(a.closers, w.Flush, file.Close)
+	}
+	if dir := os.Getenv("AQBOY_CRASH_DUMP"); dir != "" {
+		a.EnableCrashDump(dir)
+	}
+	if src := os.Getenv("AQBOY_HISTORY"); src != "" {
+		frames, err := strconv.Atoi(src)
+		if err != nil || frames <= 0 {
+			return fmt.Errorf("Invalid AQBOY_HISTORY: %s", src)
+		}
+		a.EnableHistory(frames)
+	}
+	if addr := os.Getenv("AQBOY_GDB"); addr != "" {
+		if err := a.EnableGDB(addr); err != nil {
+			return err
+		}
+	}
+	if addr := os.Getenv("AQBOY_DAP"); addr != "" {
+		if err := a.EnableDAP(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The number of the events kept by AQBOY_EVENT_LOG
+const eventLogSize = 1 << 18
+
+func writeEventLog(events *eventlog.Log, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return eventlog.WriteText(file, events.Events())
+}
+
+// parseFrames parses the frames like "120" or "120-179". An empty src means
+// the first 60 frames.
+func parseFrames(src string) (int, int, error) {
+	if src == "" {
+		return 0, 59, nil
+	}
+	from, to := src, src
+	if i := strings.IndexByte(src, '-'); i >= 0 {
+		from, to = src[:i], src[i+1:]
+	}
+	f, err1 := strconv.Atoi(from)
+	t, err2 := strconv.Atoi(to)
+	if err1 != nil || err2 != nil || f < 0 || t < f {
+		return 0, 0, fmt.Errorf("Invalid frames: %s", src)
+	}
+	return f, t, nil
+}
+
+func readCDL(cdl *mmu.CDL, filename string) error {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := cdl.MergeFile(bufio.NewReader(file)); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
+
+func writeCDL(cdl *mmu.CDL, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := cdl.WriteFile(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func writeProfile(prof *profiler.Profiler, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := prof.WritePprof(file); err != nil {
+		return err
+	}
+
+	report, err := os.Create(filename + ".txt")
+	if err != nil {
+		return err
+	}
+	defer report.Close()
+	w := bufio.NewWriter(report)
+	if err := prof.WriteReport(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,174 @@
+// Package eventlog records hardware events, e.g. interrupts and I/O register
+// writes, with the time when they happen. The events are kept in a ring
+// buffer, so that only the latest ones are kept however long the emulation
+// runs.
+package eventlog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+type Kind uint8
+
+const (
+	IRQ           Kind = iota // An interrupt is requested. Value is its bit.
+	Dispatch                  // An interrupt is dispatched. Value is its bit, and Addr is the vector.
+	IOWrite                   // The I/O register at Addr is written with Value.
+	PPUMode                   // The PPU enters the mode Value.
+	OAMDMA                    // OAM DMA starts from Addr.
+	TimerOverflow             // TIMA overflows and is reloaded with Value.
+	AudioBuffer               // An audio buffer is pushed to the frontend.
+)
+
+var kindNames = []string{"IRQ", "Dispatch", "IOWrite", "PPUMode", "OAMDMA", "TimerOverflow", "AudioBuffer"}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", k)
+}
+
+// Bits of the interrupts
+const (
+	VBlank uint8 = iota
+	STAT
+	Timer
+	Serial
+	Joypad
+)
+
+var interruptNames = []string{"VBlank", "STAT", "Timer", "Serial", "Joypad"}
+
+// InterruptName returns the name of the interrupt of bit, e.g. "STAT".
+func InterruptName(bit uint8) string {
+	if int(bit) < len(interruptNames) {
+		return interruptNames[bit]
+	}
+	return fmt.Sprintf("INT%d", bit)
+}
+
+// Event is a hardware event. The time is accurate to an instruction, i.e.
+// the events caused by the PPU and the timer are stamped at the end of the
+// instruction during which they happen.
+type Event struct {
+	Cycle uint64 // Clock cycles since the power-on
+	Frame int
+	LY    uint8
+	Dot   int // Clock cycles since the start of the scanline
+	Kind  Kind
+	Addr  uint16
+	Value uint8
+}
+
+// String returns a line like "    1234567 f=12 ly=045 dot=252 IRQ STAT".
+func (e Event) String() string {
+	s := fmt.Sprintf("%11d f=%d ly=%03d dot=%03d %v", e.Cycle, e.Frame, e.LY, e.Dot, e.Kind)
+	switch e.Kind {
+	case IRQ:
+		s += " " + InterruptName(e.Value)
+	case Dispatch:
+		s += fmt.Sprintf(" %s $%04x", InterruptName(e.Value), e.Addr)
+	case IOWrite:
+		s += fmt.Sprintf(" $%04x = $%02x", e.Addr, e.Value)
+	case PPUMode:
+		s += fmt.Sprintf(" %d", e.Value)
+	case OAMDMA:
+		s += fmt.Sprintf(" $%04x", e.Addr)
+	case TimerOverflow:
+		s += fmt.Sprintf(" TMA=$%02x", e.Value)
+	}
+	return s
+}
+
+// Clock tells the current time.
+type Clock interface {
+	Cycle() uint64
+	Frame() int
+	LY() uint8
+	Dot() int
+}
+
+type Log struct {
+	clock  Clock
+	events []Event
+	next   int // Index to store the next event
+	full   bool
+}
+
+// NewLog returns a log keeping the latest size events.
+func NewLog(size int, clock Clock) *Log {
+	return &Log{
+		clock:  clock,
+		events: make([]Event, size),
+	}
+}
+
+// Add records an event happening now.
+func (l *Log) Add(kind Kind, addr uint16, value uint8) {
+	if len(l.events) == 0 {
+		return
+	}
+	l.events[l.next] = Event{
+		Cycle: l.clock.Cycle(),
+		Frame: l.clock.Frame(),
+		LY:    l.clock.LY(),
+		Dot:   l.clock.Dot(),
+		Kind:  kind,
+		Addr:  addr,
+		Value: value,
+	}
+	l.next++
+	if l.next == len(l.events) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// Len returns the number of the recorded events.
+func (l *Log) Len() int {
+	if l.full {
+		return len(l.events)
+	}
+	return l.next
+}
+
+// Clear discards all the events.
+func (l *Log) Clear() {
+	l.next = 0
+	l.full = false
+}
+
+// Events returns the recorded events from the oldest.
+func (l *Log) Events() []Event {
+	return l.Query(nil)
+}
+
+// Query returns the recorded events for which match returns true, from the
+// oldest. A nil match matches all of them.
+func (l *Log) Query(match func(e Event) bool) []Event {
+	var result []Event
+	add := func(events []Event) {
+		for _, e := range events {
+			if match == nil || match(e) {
+				result = append(result, e)
+			}
+		}
+	}
+	if l.full {
+		add(l.events[l.next:])
+	}
+	add(l.events[:l.next])
+	return result
+}
+
+// WriteText writes the events one per line. See Event.String.
+func WriteText(w io.Writer, events []Event) error {
+	bw := bufio.NewWriter(w)
+	for _, e := range events {
+		fmt.Fprintln(bw, e)
+	}
+	return bw.Flush()
+}
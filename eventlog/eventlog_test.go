@@ -0,0 +1,77 @@
+package eventlog
+
+import (
+	"strings"
+	"testing"
+)
+
+type testClock struct {
+	cycle uint64
+}
+
+func (c *testClock) Cycle() uint64 { return c.cycle }
+func (c *testClock) Frame() int    { return int(c.cycle / 100) }
+func (c *testClock) LY() uint8     { return uint8(c.cycle % 100 / 10) }
+func (c *testClock) Dot() int      { return int(c.cycle % 10) }
+
+func TestLog(t *testing.T) {
+	clock := &testClock{}
+	log := NewLog(3, clock)
+	if log.Len() != 0 || len(log.Events()) != 0 {
+		t.Fatalf("Len: (got: %d) (expected: 0)", log.Len())
+	}
+
+	for i := 0; i < 5; i++ {
+		clock.cycle = uint64(i * 111)
+		log.Add(IRQ, 0xff0f, uint8(i))
+	}
+	events := log.Events()
+	if log.Len() != 3 || len(events) != 3 {
+		t.Fatalf("Len: (got: %d %d) (expected: 3)", log.Len(), len(events))
+	}
+	for i, e := range events {
+		expected := Event{Cycle: uint64((i + 2) * 111), Frame: i + 2, LY: uint8(i + 2), Dot: i + 2, Kind: IRQ, Addr: 0xff0f, Value: uint8(i + 2)}
+		if e != expected {
+			t.Fatalf("Events[%d]: (got: %+v) (expected: %+v)", i, e, expected)
+		}
+	}
+
+	stat := log.Query(func(e Event) bool { return e.Value == STAT })
+	if len(stat) != 0 {
+		t.Fatalf("Query: (got: %v) (expected: none)", stat)
+	}
+	timer := log.Query(func(e Event) bool { return e.Kind == IRQ && e.Value == Timer && e.Frame == 2 })
+	if len(timer) != 1 || timer[0].Cycle != 222 {
+		t.Fatalf("Query: (got: %v) (expected: the event at 222)", timer)
+	}
+
+	log.Clear()
+	if log.Len() != 0 {
+		t.Fatalf("Len: (got: %d) (expected: 0)", log.Len())
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	var out strings.Builder
+	err := WriteText(&out, []Event{
+		{Cycle: 1234567, Frame: 12, LY: 45, Dot: 252, Kind: IRQ, Value: STAT},
+		{Cycle: 1234590, Frame: 12, LY: 45, Dot: 275, Kind: Dispatch, Addr: 0x0048, Value: STAT},
+		{Cycle: 1234600, Frame: 12, LY: 45, Dot: 285, Kind: IOWrite, Addr: 0xff41, Value: 0x40},
+		{Cycle: 1234700, Frame: 12, LY: 46, Dot: 0, Kind: PPUMode, Value: 2},
+		{Cycle: 1234800, Frame: 12, LY: 46, Dot: 100, Kind: OAMDMA, Addr: 0xc000},
+		{Cycle: 1234900, Frame: 12, LY: 46, Dot: 200, Kind: TimerOverflow, Value: 0xf0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `    1234567 f=12 ly=045 dot=252 IRQ STAT
+    1234590 f=12 ly=045 dot=275 Dispatch STAT $0048
+    1234600 f=12 ly=045 dot=285 IOWrite $ff41 = $40
+    1234700 f=12 ly=046 dot=000 PPUMode 2
+    1234800 f=12 ly=046 dot=100 OAMDMA $c000
+    1234900 f=12 ly=046 dot=200 TimerOverflow TMA=$f0
+`
+	if out.String() != expected {
+		t.Fatalf("WriteText: (got: %q) (expected: %q)", out.String(), expected)
+	}
+}
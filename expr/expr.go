@@ -0,0 +1,404 @@
+// Package expr implements the expressions used as the conditions of
+// breakpoints and watchpoints, and as the filter of the CPU trace, e.g.
+//
+//	a == 0x3c && [0xc0a0] > 5 && ly == 144
+//
+// The values are integers, and an expression is true if its value is not 0.
+// The operators are those of C, with the same precedence:
+//
+//	||  &&  |  ^  &  == !=  < <= > >=  << >>  + -  * / %  unary ! - ~
+//
+// The operands are:
+//
+//	123, 0x7b, $7b, 0b1111011            Numbers
+//	a f b c d e h l                      8-bit registers
+//	af bc de hl sp pc                    16-bit registers
+//	zf nf hf cf                          Flags, 0 or 1
+//	ime                                  Interrupt master enable, 0 or 1
+//	bank                                 ROM bank mapped at 4000-7FFF
+//	ly                                   LCD Y coordinate
+//	frame                                Number of frames emulated
+//	[ADDR]                               Byte in the memory
+//	w[ADDR]                              Little endian word in the memory
+//
+// The names are case-insensitive. Division by zero results in 0.
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ushitora-anqou/aqboy/cpu"
+)
+
+// Env gives the values of the operands.
+type Env interface {
+	State() cpu.State
+	// Peek8 reads the memory without side effects.
+	Peek8(addr uint16) uint8
+	Bank(addr uint16) int
+	LY() uint8
+	Frame() int
+}
+
+type evalFunc func(env Env) int
+
+type Expr struct {
+	src  string
+	eval evalFunc
+}
+
+// Parse compiles src into an expression.
+func Parse(src string) (*Expr, error) {
+	p := &parser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	eval, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("Unexpected %q", p.tok.text)
+	}
+	return &Expr{src: strings.TrimSpace(src), eval: eval}, nil
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval returns the value of the expression.
+func (e *Expr) Eval(env Env) int {
+	return e.eval(env)
+}
+
+// True returns true if the value of the expression is not 0.
+func (e *Expr) True(env Env) bool {
+	return e.eval(env) != 0
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokName
+	tokOp
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value int
+	pos   int
+}
+
+type parser struct {
+	src string
+	pos int
+	tok token
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid expression at %d: %s", p.tok.pos+1, fmt.Sprintf(format, args...))
+}
+
+// Operators sorted so that longer ones are tried first
+var operators = []string{
+	"||", "&&", "==", "!=", "<=", ">=", "<<", ">>",
+	"|", "^", "&", "<", ">", "+", "-", "*", "/", "%", "!", "~", "(", ")", "[", "]",
+}
+
+func isNameChar(ch byte) bool {
+	return ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ('0' <= ch && ch <= '9')
+}
+
+// next reads the next token to p.tok.
+func (p *parser) next() error {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+	start := p.pos
+	p.tok = token{pos: start}
+	if start == len(p.src) {
+		p.tok.kind = tokEOF
+		return nil
+	}
+
+	ch := p.src[start]
+	numStart, base := -1, 0
+	switch {
+	case ch == '$' && start+1 < len(p.src) && isNameChar(p.src[start+1]):
+		numStart, base = start+1, 16
+	case ch == '0' && start+1 < len(p.src) && (p.src[start+1] == 'x' || p.src[start+1] == 'X'):
+		numStart, base = start+2, 16
+	case ch == '0' && start+1 < len(p.src) && (p.src[start+1] == 'b' || p.src[start+1] == 'B'):
+		numStart, base = start+2, 2
+	case '0' <= ch && ch <= '9':
+		numStart, base = start, 10
+	}
+	if numStart >= 0 {
+		end := numStart
+		for end < len(p.src) && isNameChar(p.src[end]) {
+			end++
+		}
+		text := p.src[numStart:end]
+		value, err := strconv.ParseInt(text, base, 32)
+		if err != nil {
+			p.tok.text = p.src[start:end]
+			return p.errorf("Invalid number %q", p.tok.text)
+		}
+		p.pos = end
+		p.tok = token{kind: tokNumber, text: p.src[start:end], value: int(value), pos: start}
+		return nil
+	}
+
+	if isNameChar(ch) {
+		end := start
+		for end < len(p.src) && isNameChar(p.src[end]) {
+			end++
+		}
+		p.pos = end
+		p.tok = token{kind: tokName, text: strings.ToLower(p.src[start:end]), pos: start}
+		return nil
+	}
+
+	for _, op := range operators {
+		if strings.HasPrefix(p.src[start:], op) {
+			p.pos += len(op)
+			p.tok = token{kind: tokOp, text: op, pos: start}
+			return nil
+		}
+	}
+	p.tok.text = p.src[start : start+1]
+	return p.errorf("Unexpected %q", p.tok.text)
+}
+
+func (p *parser) expect(op string) error {
+	if p.tok.kind != tokOp || p.tok.text != op {
+		if p.tok.kind == tokEOF {
+			return p.errorf("%q expected", op)
+		}
+		return p.errorf("%q expected but got %q", op, p.tok.text)
+	}
+	return p.next()
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Binary operators from the lowest precedence
+var binaryOps = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func binaryFunc(op string, lhs, rhs evalFunc) evalFunc {
+	switch op {
+	case "||":
+		return func(env Env) int { return b2i(lhs(env) != 0 || rhs(env) != 0) }
+	case "&&":
+		return func(env Env) int { return b2i(lhs(env) != 0 && rhs(env) != 0) }
+	case "|":
+		return func(env Env) int { return lhs(env) | rhs(env) }
+	case "^":
+		return func(env Env) int { return lhs(env) ^ rhs(env) }
+	case "&":
+		return func(env Env) int { return lhs(env) & rhs(env) }
+	case "==":
+		return func(env Env) int { return b2i(lhs(env) == rhs(env)) }
+	case "!=":
+		return func(env Env) int { return b2i(lhs(env) != rhs(env)) }
+	case "<":
+		return func(env Env) int { return b2i(lhs(env) < rhs(env)) }
+	case "<=":
+		return func(env Env) int { return b2i(lhs(env) <= rhs(env)) }
+	case ">":
+		return func(env Env) int { return b2i(lhs(env) > rhs(env)) }
+	case ">=":
+		return func(env Env) int { return b2i(lhs(env) >= rhs(env)) }
+	case "<<":
+		return func(env Env) int { return lhs(env) << uint(rhs(env)&63) }
+	case ">>":
+		return func(env Env) int { return lhs(env) >> uint(rhs(env)&63) }
+	case "+":
+		return func(env Env) int { return lhs(env) + rhs(env) }
+	case "-":
+		return func(env Env) int { return lhs(env) - rhs(env) }
+	case "*":
+		return func(env Env) int { return lhs(env) * rhs(env) }
+	case "/":
+		return func(env Env) int {
+			if r := rhs(env); r != 0 {
+				return lhs(env) / r
+			}
+			return 0
+		}
+	case "%":
+		return func(env Env) int {
+			if r := rhs(env); r != 0 {
+				return lhs(env) % r
+			}
+			return 0
+		}
+	}
+	panic("Unknown operator: " + op)
+}
+
+// parseBinary parses the operators of binaryOps[level] and higher.
+func (p *parser) parseBinary(level int) (evalFunc, error) {
+	if level == len(binaryOps) {
+		return p.parseUnary()
+	}
+	lhs, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokOp {
+		op := p.tok.text
+		found := false
+		for _, candidate := range binaryOps[level] {
+			found = found || candidate == op
+		}
+		if !found {
+			break
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		rhs, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		lhs = binaryFunc(op, lhs, rhs)
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseUnary() (evalFunc, error) {
+	if p.tok.kind == tokOp {
+		op := p.tok.text
+		switch op {
+		case "!", "-", "~":
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			operand, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			switch op {
+			case "!":
+				return func(env Env) int { return b2i(operand(env) == 0) }, nil
+			case "-":
+				return func(env Env) int { return -operand(env) }, nil
+			default:
+				return func(env Env) int { return ^operand(env) }, nil
+			}
+		}
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (evalFunc, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokNumber:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		value := tok.value
+		return func(env Env) int { return value }, nil
+
+	case tokName:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if tok.text == "w" && p.tok.kind == tokOp && p.tok.text == "[" {
+			addr, err := p.parseAddr()
+			if err != nil {
+				return nil, err
+			}
+			return func(env Env) int {
+				a := uint16(addr(env))
+				return int(env.Peek8(a)) | int(env.Peek8(a+1))<<8
+			}, nil
+		}
+		if eval, ok := names[tok.text]; ok {
+			return eval, nil
+		}
+		return nil, fmt.Errorf("Invalid expression at %d: Unknown name %q", tok.pos+1, tok.text)
+
+	case tokOp:
+		switch tok.text {
+		case "(":
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			eval, err := p.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+			return eval, p.expect(")")
+		case "[":
+			addr, err := p.parseAddr()
+			if err != nil {
+				return nil, err
+			}
+			return func(env Env) int { return int(env.Peek8(uint16(addr(env)))) }, nil
+		}
+		return nil, p.errorf("Unexpected %q", tok.text)
+	}
+	return nil, p.errorf("Unexpected end")
+}
+
+// parseAddr parses "[ADDR]".
+func (p *parser) parseAddr() (evalFunc, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	addr, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	return addr, p.expect("]")
+}
+
+var names = map[string]evalFunc{
+	"a":     func(env Env) int { return int(env.State().A) },
+	"f":     func(env Env) int { return int(env.State().F) },
+	"b":     func(env Env) int { return int(env.State().B) },
+	"c":     func(env Env) int { return int(env.State().C) },
+	"d":     func(env Env) int { return int(env.State().D) },
+	"e":     func(env Env) int { return int(env.State().E) },
+	"h":     func(env Env) int { return int(env.State().H) },
+	"l":     func(env Env) int { return int(env.State().L) },
+	"af":    func(env Env) int { s := env.State(); return int(s.A)<<8 | int(s.F) },
+	"bc":    func(env Env) int { s := env.State(); return int(s.B)<<8 | int(s.C) },
+	"de":    func(env Env) int { s := env.State(); return int(s.D)<<8 | int(s.E) },
+	"hl":    func(env Env) int { s := env.State(); return int(s.H)<<8 | int(s.L) },
+	"sp":    func(env Env) int { return int(env.State().SP) },
+	"pc":    func(env Env) int { return int(env.State().PC) },
+	"zf":    func(env Env) int { return int(env.State().F>>7) & 1 },
+	"nf":    func(env Env) int { return int(env.State().F>>6) & 1 },
+	"hf":    func(env Env) int { return int(env.State().F>>5) & 1 },
+	"cf":    func(env Env) int { return int(env.State().F>>4) & 1 },
+	"ime":   func(env Env) int { return b2i(env.State().IME) },
+	"bank":  func(env Env) int { return env.Bank(0x4000) },
+	"ly":    func(env Env) int { return int(env.LY()) },
+	"frame": func(env Env) int { return env.Frame() },
+}
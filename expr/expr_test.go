@@ -0,0 +1,84 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/ushitora-anqou/aqboy/cpu"
+)
+
+type testEnv struct {
+	state cpu.State
+	mem   [0x10000]uint8
+}
+
+func (env *testEnv) State() cpu.State        { return env.state }
+func (env *testEnv) Peek8(addr uint16) uint8 { return env.mem[addr] }
+func (env *testEnv) Bank(addr uint16) int    { return 3 }
+func (env *testEnv) LY() uint8               { return 144 }
+func (env *testEnv) Frame() int              { return 42 }
+
+func TestEval(t *testing.T) {
+	env := &testEnv{}
+	env.state.A, env.state.F = 0x3c, 0x90
+	env.state.H, env.state.L = 0xc0, 0xa0
+	env.state.SP, env.state.PC = 0xfffe, 0x0150
+	env.mem[0xc0a0], env.mem[0xc0a1] = 6, 0x12
+
+	for _, tc := range []struct {
+		src      string
+		expected int
+	}{
+		{"A == 0x3C && [0xC0A0] > 5 && ly == 144", 1},
+		{"a == $3c && [hl] > 6", 0},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"7 / 2 + 7 % 2", 4},
+		{"1 / 0", 0},
+		{"1 << 4 | 1", 17},
+		{"0xf0 & 0x3c ^ 0x0f", 0x3f},
+		{"-1 < 0", 1},
+		{"!0 + !5 + ~0", 0},
+		{"0b101 >= 5", 1},
+		{"hl", 0xc0a0},
+		{"af", 0x3c90},
+		{"w[hl]", 0x1206},
+		{"[hl + 1]", 0x12},
+		{"zf * 8 + nf * 4 + hf * 2 + cf", 9},
+		{"bank == 3 && frame == 42", 1},
+		{"sp - pc", 0xfeae},
+		{"ime || 0", 0},
+	} {
+		e, err := Parse(tc.src)
+		if err != nil {
+			t.Fatalf("Parse %q: %v", tc.src, err)
+		}
+		if got := e.Eval(env); got != tc.expected {
+			t.Fatalf("Eval %q: (got: %d) (expected: %d)", tc.src, got, tc.expected)
+		}
+		if got := e.True(env); got != (tc.expected != 0) {
+			t.Fatalf("True %q: (got: %v) (expected: %v)", tc.src, got, tc.expected != 0)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, tc := range []struct {
+		src, expected string
+	}{
+		{"", "Invalid expression at 1: Unexpected end"},
+		{"a ==", "Invalid expression at 5: Unexpected end"},
+		{"(a", `Invalid expression at 3: ")" expected`},
+		{"[c000", `Invalid expression at 2: Unknown name "c000"`},
+		{"[$c000", `Invalid expression at 7: "]" expected`},
+		{"a b", `Invalid expression at 3: Unexpected "b"`},
+		{"0x", `Invalid expression at 1: Invalid number "0x"`},
+		{"a # 1", `Invalid expression at 3: Unexpected "#"`},
+		{"x", `Invalid expression at 1: Unknown name "x"`},
+	} {
+		_, err := Parse(tc.src)
+		if err == nil || err.Error() != tc.expected {
+			t.Fatalf("Parse %q: (got: %v) (expected: %v)", tc.src, err, tc.expected)
+		}
+	}
+}
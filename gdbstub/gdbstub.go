@@ -0,0 +1,505 @@
+// Package gdbstub implements a server of the GDB remote serial protocol, so
+// that remote debuggers can control the emulated CPU over TCP.
+//
+// The registers are AF, BC, DE, HL, SP and PC in this order, each of which is
+// 16-bit little endian. The memory is the 64 KiB address space of the bus.
+// Writes to the ROM patch it instead of switching the banks.
+// The server tells the register layout to clients by target.xml.
+package gdbstub
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ushitora-anqou/aqboy/cpu"
+)
+
+// ErrKilled is returned by Run when the client kills the program.
+var ErrKilled = errors.New("Killed by GDB")
+
+// Target is the emulator seen from the server. The emulator executes the
+// instructions itself, asking the server by ShouldBreak whether to stop.
+type Target interface {
+	State() cpu.State
+	Restore(state cpu.State)
+	// Peek8 reads the memory without side effects.
+	Peek8(addr uint16) uint8
+	// CheckWrite returns an error if Write cannot write addr.
+	CheckWrite(addr uint16) error
+	// Write writes the memory for debugging. See mmu.MMU.Write.
+	Write(addr uint16, val uint8) error
+}
+
+// Signals reported to the client
+const (
+	sigINT  = 2
+	sigILL  = 4
+	sigTRAP = 5
+)
+
+const targetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.aqboy.sm83">
+    <reg name="af" bitsize="16" type="uint16" regnum="0"/>
+    <reg name="bc" bitsize="16" type="uint16"/>
+    <reg name="de" bitsize="16" type="uint16"/>
+    <reg name="hl" bitsize="16" type="uint16"/>
+    <reg name="sp" bitsize="16" type="data_ptr"/>
+    <reg name="pc" bitsize="16" type="code_ptr"/>
+  </feature>
+</target>
+`
+
+const numRegisters = 6
+
+type Server struct {
+	target   Target
+	listener net.Listener
+
+	conn        net.Conn
+	packets     chan string
+	writeMu     sync.Mutex
+	noAck       int32 // Accessed atomically
+	interrupted int32 // Accessed atomically
+
+	attached    bool
+	waiting     bool // The client has resumed the emulation and waits for it to stop
+	stepping    bool
+	signal      int // The signal to report when stopping, or 0 while running
+	breakpoints [0x10000]bool
+}
+
+// Listen starts listening on addr, e.g. "localhost:2345".
+func Listen(target Target, addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		target:   target,
+		listener: listener,
+	}, nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Accept waits for a client. The emulation stops at the next instruction
+// once the client is attached.
+func (s *Server) Accept() error {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.packets = make(chan string)
+	atomic.StoreInt32(&s.noAck, 0)
+	atomic.StoreInt32(&s.interrupted, 0)
+	s.attached = true
+	s.waiting = false
+	s.stepping = false
+	s.signal = sigTRAP
+	go s.readPackets(conn, s.packets)
+	return nil
+}
+
+func (s *Server) Close() error {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return s.listener.Close()
+}
+
+// readPackets receives packets from the client until the connection is closed.
+// The interrupt request (0x03) may arrive while the emulation is running, so
+// it is handled here rather than by Run.
+func (s *Server) readPackets(conn net.Conn, packets chan<- string) {
+	defer close(packets)
+	r := bufio.NewReader(conn)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch c {
+		case 0x03:
+			atomic.StoreInt32(&s.interrupted, 1)
+			continue
+		case '$':
+		default: // Acks and garbage
+			continue
+		}
+
+		data, err := r.ReadString('#')
+		if err != nil {
+			return
+		}
+		data = data[:len(data)-1]
+		var checksum [2]uint8
+		if _, err := io.ReadFull(r, checksum[:]); err != nil {
+			return
+		}
+		if atomic.LoadInt32(&s.noAck) == 0 {
+			ack := "+"
+			if sum, err := strconv.ParseUint(string(checksum[:]), 16, 8); err != nil || uint8(sum) != packetChecksum(data) {
+				ack = "-" // Ask the client to send it again
+			}
+			s.write(ack)
+			if ack == "-" {
+				continue
+			}
+		}
+		if data == "QStartNoAckMode" {
+			atomic.StoreInt32(&s.noAck, 1)
+		}
+		packets <- unescape(data)
+	}
+}
+
+func packetChecksum(data string) uint8 {
+	var sum uint8
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// unescape decodes the escaped bytes in binary data: "}X" means X^0x20.
+func unescape(data string) string {
+	if !strings.Contains(data, "}") {
+		return data
+	}
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] == '}' && i+1 < len(data) {
+			i++
+			b.WriteByte(data[i] ^ 0x20)
+		} else {
+			b.WriteByte(data[i])
+		}
+	}
+	return b.String()
+}
+
+func (s *Server) write(data string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := io.WriteString(s.conn, data)
+	return err
+}
+
+func (s *Server) send(data string) error {
+	return s.write(fmt.Sprintf("$%s#%02x", data, packetChecksum(data)))
+}
+
+// ShouldBreak is called before each instruction is executed, and returns true
+// if Run should be called since the client is waiting for the emulation to stop.
+func (s *Server) ShouldBreak(pc uint16) bool {
+	if !s.attached {
+		return false
+	}
+	switch {
+	case s.signal != 0: // Already stopped, e.g. by Fault
+	case s.stepping, s.breakpoints[pc]:
+		s.signal = sigTRAP
+	case atomic.LoadInt32(&s.interrupted) != 0:
+		s.signal = sigINT
+	default:
+		return false
+	}
+	s.stepping = false
+	atomic.StoreInt32(&s.interrupted, 0)
+	return true
+}
+
+// Fault tells the client that the emulation failed at the current instruction.
+// The emulation should stop, i.e. ShouldBreak returns true.
+func (s *Server) Fault() {
+	if s.attached {
+		s.signal = sigILL
+	}
+}
+
+// Break stops the emulation before the next instruction as if a breakpoint
+// is hit.
+func (s *Server) Break() {
+	if s.attached {
+		s.signal = sigTRAP
+	}
+}
+
+// Attached returns true if a client is controlling the emulation.
+func (s *Server) Attached() bool {
+	return s.attached
+}
+
+// Run serves the client until it resumes the emulation.
+func (s *Server) Run() error {
+	// The client asks by '?' why the emulation is stopped when it attaches,
+	// so only report stops after resuming.
+	if s.waiting {
+		s.waiting = false
+		if err := s.send(fmt.Sprintf("S%02x", s.signal)); err != nil {
+			return err
+		}
+	}
+	for data := range s.packets {
+		resume, err := s.handle(data)
+		if err != nil {
+			return err
+		}
+		if resume {
+			s.signal = 0
+			return nil
+		}
+	}
+	// The connection is closed without detaching.
+	s.detach()
+	return nil
+}
+
+func (s *Server) detach() {
+	s.attached = false
+	s.conn.Close()
+}
+
+// handle processes a packet, and returns true if the emulation is resumed.
+func (s *Server) handle(data string) (bool, error) {
+	reply, resume, err := s.reply(data)
+	if err != nil {
+		return false, err
+	}
+	if resume {
+		return true, nil
+	}
+	if err := s.send(reply); err != nil {
+		return false, err
+	}
+	if data == "D" {
+		s.detach()
+		return true, nil
+	}
+	return false, nil
+}
+
+func errorReply(code int) string {
+	return fmt.Sprintf("E%02x", code)
+}
+
+// reply returns the reply to a packet, or true if the emulation is resumed
+// and the reply is deferred until it stops.
+func (s *Server) reply(data string) (string, bool, error) {
+	if data == "" {
+		return "", false, nil
+	}
+	target := s.target
+	args := data[1:]
+	switch data[0] {
+	case '?':
+		return fmt.Sprintf("S%02x", s.signal), false, nil
+
+	case 'g':
+		regs := registers(target.State())
+		var b strings.Builder
+		for _, reg := range regs {
+			fmt.Fprintf(&b, "%02x%02x", uint8(reg), uint8(reg>>8))
+		}
+		return b.String(), false, nil
+
+	case 'G':
+		raw, err := hex.DecodeString(args)
+		if err != nil || len(raw) != numRegisters*2 {
+			return errorReply(1), false, nil
+		}
+		var regs [numRegisters]uint16
+		for i := range regs {
+			regs[i] = uint16(raw[i*2]) | uint16(raw[i*2+1])<<8
+		}
+		target.Restore(setRegisters(target.State(), regs))
+		return "OK", false, nil
+
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 8)
+		if err != nil || n >= numRegisters {
+			return errorReply(1), false, nil
+		}
+		reg := registers(target.State())[n]
+		return fmt.Sprintf("%02x%02x", uint8(reg), uint8(reg>>8)), false, nil
+
+	case 'P':
+		parts := strings.SplitN(args, "=", 2)
+		if len(parts) != 2 {
+			return errorReply(1), false, nil
+		}
+		n, err1 := strconv.ParseUint(parts[0], 16, 8)
+		raw, err2 := hex.DecodeString(parts[1])
+		if err1 != nil || err2 != nil || n >= numRegisters || len(raw) != 2 {
+			return errorReply(1), false, nil
+		}
+		regs := registers(target.State())
+		regs[n] = uint16(raw[0]) | uint16(raw[1])<<8
+		target.Restore(setRegisters(target.State(), regs))
+		return "OK", false, nil
+
+	case 'm':
+		addr, length, ok := parseAddrLength(args)
+		if !ok {
+			return errorReply(1), false, nil
+		}
+		var b strings.Builder
+		for i := 0; i < length; i++ {
+			fmt.Fprintf(&b, "%02x", target.Peek8(addr+uint16(i)))
+		}
+		return b.String(), false, nil
+
+	case 'M', 'X':
+		parts := strings.SplitN(args, ":", 2)
+		if len(parts) != 2 {
+			return errorReply(1), false, nil
+		}
+		addr, length, ok := parseAddrLength(parts[0])
+		if !ok {
+			return errorReply(1), false, nil
+		}
+		raw := []uint8(parts[1]) // Binary data for 'X'
+		if data[0] == 'M' {
+			var err error
+			if raw, err = hex.DecodeString(parts[1]); err != nil {
+				return errorReply(1), false, nil
+			}
+		}
+		if len(raw) != length {
+			return errorReply(1), false, nil
+		}
+		// Write nothing unless all of them can be written.
+		for i := range raw {
+			if err := target.CheckWrite(addr + uint16(i)); err != nil {
+				return errorReply(14), false, nil // EFAULT
+			}
+		}
+		for i, val := range raw {
+			if err := target.Write(addr+uint16(i), val); err != nil {
+				return errorReply(14), false, nil
+			}
+		}
+		return "OK", false, nil
+
+	case 'c', 's':
+		if args != "" {
+			addr, err := strconv.ParseUint(args, 16, 16)
+			if err != nil {
+				return errorReply(1), false, nil
+			}
+			state := target.State()
+			state.PC = uint16(addr)
+			target.Restore(state)
+		}
+		s.stepping = data[0] == 's'
+		s.waiting = true
+		return "", true, nil
+
+	case 'Z', 'z':
+		parts := strings.Split(args, ",")
+		if len(parts) < 2 || (parts[0] != "0" && parts[0] != "1") { // Only execution breakpoints
+			return "", false, nil
+		}
+		addr, err := strconv.ParseUint(parts[1], 16, 16)
+		if err != nil {
+			return errorReply(1), false, nil
+		}
+		s.breakpoints[addr] = data[0] == 'Z'
+		return "OK", false, nil
+
+	case 'H':
+		return "OK", false, nil
+
+	case 'D':
+		return "OK", false, nil
+
+	case 'k':
+		s.detach()
+		return "", false, ErrKilled
+
+	case 'q', 'Q':
+		return s.replyQuery(data), false, nil
+	}
+	return "", false, nil // Unsupported
+}
+
+func (s *Server) replyQuery(data string) string {
+	switch {
+	case strings.HasPrefix(data, "qSupported"):
+		return "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+"
+	case data == "QStartNoAckMode":
+		return "OK"
+	case data == "qAttached":
+		return "1"
+	case data == "qC":
+		return "QC1"
+	case data == "qfThreadInfo":
+		return "m1"
+	case data == "qsThreadInfo":
+		return "l"
+	case strings.HasPrefix(data, "qXfer:features:read:target.xml:"):
+		offset, length, ok := parseAddrLength(strings.TrimPrefix(data, "qXfer:features:read:target.xml:"))
+		if !ok {
+			return errorReply(1)
+		}
+		if int(offset) >= len(targetXML) {
+			return "l"
+		}
+		chunk := targetXML[offset:]
+		if len(chunk) > length {
+			return "m" + chunk[:length]
+		}
+		return "l" + chunk
+	}
+	return ""
+}
+
+func parseAddrLength(s string) (uint16, int, bool) {
+	parts := strings.SplitN(s, ",", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	addr, err1 := strconv.ParseUint(parts[0], 16, 16)
+	length, err2 := strconv.ParseUint(parts[1], 16, 16)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return uint16(addr), int(length), true
+}
+
+func registers(state cpu.State) [numRegisters]uint16 {
+	pair := func(hi, lo uint8) uint16 {
+		return uint16(hi)<<8 | uint16(lo)
+	}
+	return [numRegisters]uint16{
+		pair(state.A, state.F),
+		pair(state.B, state.C),
+		pair(state.D, state.E),
+		pair(state.H, state.L),
+		state.SP,
+		state.PC,
+	}
+}
+
+func setRegisters(state cpu.State, regs [numRegisters]uint16) cpu.State {
+	state.A, state.F = uint8(regs[0]>>8), uint8(regs[0])&0xf0
+	state.B, state.C = uint8(regs[1]>>8), uint8(regs[1])
+	state.D, state.E = uint8(regs[2]>>8), uint8(regs[2])
+	state.H, state.L = uint8(regs[3]>>8), uint8(regs[3])
+	state.SP = regs[4]
+	state.PC = regs[5]
+	return state
+}
@@ -0,0 +1,164 @@
+package gdbstub
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ushitora-anqou/aqboy/cpu"
+)
+
+// testTarget executes NOP everywhere.
+type testTarget struct {
+	state cpu.State
+	mem   [0x10000]uint8
+}
+
+func (t *testTarget) State() cpu.State        { return t.state }
+func (t *testTarget) Restore(state cpu.State) { t.state = state }
+func (t *testTarget) Peek8(addr uint16) uint8 { return t.mem[addr] }
+func (t *testTarget) step()                   { t.state.PC++ }
+
+// CheckWrite rejects LY, which is read-only as in mmu.MMU.
+func (t *testTarget) CheckWrite(addr uint16) error {
+	if addr == 0xff44 {
+		return fmt.Errorf("Not a writable I/O register: %04x", addr)
+	}
+	return nil
+}
+
+func (t *testTarget) Write(addr uint16, val uint8) error {
+	t.mem[addr] = val
+	return nil
+}
+
+// run emulates the target like AQBoy.Step does.
+func run(server *Server, target *testTarget) error {
+	for server.Attached() {
+		if server.ShouldBreak(target.state.PC) {
+			if err := server.Run(); err != nil {
+				return err
+			}
+		}
+		target.step()
+	}
+	return nil
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *testClient) send(data string) {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.conn, "$%s#%02x", data, packetChecksum(data)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) receive() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if b == '$' {
+			break
+		}
+	}
+	data, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.r.Discard(2); err != nil {
+		c.t.Fatal(err)
+	}
+	return data[:len(data)-1]
+}
+
+func (c *testClient) expect(data, expected string) {
+	c.t.Helper()
+	c.send(data)
+	if got := c.receive(); got != expected {
+		c.t.Fatalf("%s: (got: %q) (expected: %q)", data, got, expected)
+	}
+}
+
+func TestServer(t *testing.T) {
+	target := &testTarget{}
+	target.state.PC = 0x0100
+	target.state.A, target.state.F = 0x01, 0xb0
+	target.state.SP = 0xfffe
+	copy(target.mem[0xc000:], []uint8{0xde, 0xad})
+
+	server, err := Listen(target, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	done := make(chan error, 1)
+	go func() {
+		if err := server.Accept(); err != nil {
+			done <- err
+			return
+		}
+		done <- run(server, target)
+	}()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	c.expect("qSupported:xmlRegisters=i386", "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+")
+	c.expect("QStartNoAckMode", "OK")
+	c.expect("?", "S05")
+	c.expect("qXfer:features:read:target.xml:0,a", "m<?xml vers")
+	c.expect("g", "b001"+"0000"+"0000"+"0000"+"feff"+"0001")
+	c.expect("p5", "0001")
+	c.expect("mc000,3", "dead00")
+	c.expect("Mc002,2:beef", "OK")
+	c.expect("mc000,4", "deadbeef")
+	c.expect("Mff40,1:91", "OK") // LCDC
+	c.expect("mff40,1", "91")
+	c.expect("Mff43,2:1234", "E0e") // LY is read-only
+	c.expect("mff43,1", "00")
+	c.expect("Xc010,4:}]}\x03}\x04}\n", "OK") // Escaped "}#$*"
+	c.expect("mc010,4", "7d23242a")
+	c.expect("P1=3412", "OK")
+	c.expect("g", "b001"+"3412"+"0000"+"0000"+"feff"+"0001")
+	c.expect("vMustReplyEmpty", "")
+
+	// Single step
+	c.expect("s", "S05")
+	c.expect("p5", "0101")
+
+	// Breakpoint
+	c.expect("Z0,0180,1", "OK")
+	c.expect("c", "S05")
+	c.expect("p5", "8001")
+	c.expect("z0,0180,1", "OK")
+
+	// Interrupt
+	c.send("c")
+	time.Sleep(10 * time.Millisecond)
+	if _, err := conn.Write([]uint8{0x03}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.receive(); got != "S02" {
+		t.Fatalf("Interrupt: (got: %q) (expected: %q)", got, "S02")
+	}
+
+	c.expect("D", "OK")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/ushitora-anqou/aqboy/apu"
+	"github.com/ushitora-anqou/aqboy/cpu"
+	"github.com/ushitora-anqou/aqboy/joypad"
+	"github.com/ushitora-anqou/aqboy/mmu"
+	"github.com/ushitora-anqou/aqboy/ppu"
+	"github.com/ushitora-anqou/aqboy/timer"
+)
+
+// The number of the frames kept by the history unless AQBOY_HISTORY is set
+const defaultHistoryFrames = 60
+
+// snapshot is the whole state of the machine at the start of a frame.
+type snapshot struct {
+	steps, cycles uint64
+	frames, cnt   int
+	cpu           *cpu.SavedState
+	mmu           *mmu.SavedState
+	ppu           *ppu.SavedState
+	timer         *timer.SavedState
+	apu           *apu.SavedState
+	joypad        *joypad.SavedState
+}
+
+// EnableHistory starts taking a snapshot of the machine at the start of each
+// frame, keeping the latest frames ones, so that the debugger can execute the
+// emulation backwards by restoring one and executing it again up to the
+// instruction in question.
+func (a *AQBoy) EnableHistory(frames int) {
+	a.historySize = frames
+	if len(a.history) > frames {
+		a.history = append(a.history[:0], a.history[len(a.history)-frames:]...)
+	}
+	if len(a.history) == 0 {
+		a.saveSnapshot()
+	}
+}
+
+func (a *AQBoy) saveSnapshot() {
+	// Drop the snapshots of the future discarded by rewinding.
+	n := len(a.history)
+	for n > 0 && a.history[n-1].steps >= a.steps {
+		n--
+	}
+	a.history = a.history[:n]
+
+	if len(a.history) == a.historySize {
+		a.history = append(a.history[:0], a.history[1:]...)
+	}
+	a.history = append(a.history, snapshot{
+		steps:  a.steps,
+		cycles: a.cycles,
+		frames: a.frames,
+		cnt:    a.cnt,
+		cpu:    a.cpu.SaveState(),
+		mmu:    a.mmu.SaveState(),
+		ppu:    a.ppu.SaveState(),
+		timer:  a.timer.SaveState(),
+		apu:    a.apu.SaveState(),
+		joypad: a.joypad.SaveState(),
+	})
+}
+
+// rewind restores the latest snapshot taken at or before the step-th
+// instruction, and returns false if there is none.
+func (a *AQBoy) rewind(step uint64) bool {
+	for i := len(a.history) - 1; i >= 0; i-- {
+		s := &a.history[i]
+		if s.steps > step {
+			continue
+		}
+		a.steps, a.cycles = s.steps, s.cycles
+		a.frames, a.cnt = s.frames, s.cnt
+		a.cpu.LoadState(s.cpu)
+		a.mmu.LoadState(s.mmu)
+		a.ppu.LoadState(s.ppu)
+		a.timer.LoadState(s.timer)
+		a.apu.LoadState(s.apu)
+		a.joypad.LoadState(s.joypad)
+		return true
+	}
+	return false
+}
+
+// replay executes one instruction again after rewind. The emulation is the
+// same as step, but the outputs already made the first time, i.e. the trace,
+// the debug messages, the event log, the profile, the timeline, the audio
+// and the last instructions for the crash dump, are not made again.
+func (a *AQBoy) replay() (uint, error) {
+	events := a.bus.Events
+	a.bus.Events = nil
+	a.cpu.SetQuiet(true)
+	a.replaying = true
+	defer func() {
+		a.bus.Events = events
+		a.cpu.SetQuiet(false)
+		a.replaying = false
+	}()
+	return a.step()
+}
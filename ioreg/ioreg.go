@@ -0,0 +1,86 @@
+// Package ioreg describes the hardware registers with their bitfields
+// decoded, so that they can be inspected without decoding hex by hand. The
+// components decode their own registers from their live state.
+package ioreg
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Field is a bitfield of a register, e.g. {"OBJ size", "8x16"}.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Register is a hardware register, e.g. LCDC at FF40.
+type Register struct {
+	Addr   uint16
+	Name   string
+	Value  uint8
+	Fields []Field // Empty if the register is a plain number
+}
+
+// String returns the register on a line, e.g.
+// "ff07 TAC  = 05  Enable: on, Clock: 262144 Hz".
+func (r Register) String() string {
+	s := fmt.Sprintf("%04x %-4s = %02x", r.Addr, r.Name, r.Value)
+	if len(r.Fields) == 0 {
+		return s + fmt.Sprintf("  (%d)", r.Value)
+	}
+	fields := make([]string, len(r.Fields))
+	for i, f := range r.Fields {
+		fields[i] = f.Name + ": " + f.Value
+	}
+	return s + "  " + strings.Join(fields, ", ")
+}
+
+// Sort sorts regs by the address.
+func Sort(regs []Register) {
+	sort.Slice(regs, func(i, j int) bool { return regs[i].Addr < regs[j].Addr })
+}
+
+// Find returns the register in regs named name, case-insensitively, or at
+// the address name in hex, e.g. "lcdc" or "ff40".
+func Find(regs []Register, name string) (Register, bool) {
+	addr, err := strconv.ParseUint(strings.TrimPrefix(name, "$"), 16, 16)
+	for _, r := range regs {
+		if strings.EqualFold(r.Name, name) || (err == nil && uint64(r.Addr) == addr) {
+			return r, true
+		}
+	}
+	return Register{}, false
+}
+
+// OnOff returns "on" if b is true, or "off".
+func OnOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+var interruptNames = []string{"VBlank", "STAT", "Timer", "Serial", "Joypad"}
+
+// Interrupts decodes IE and IF, which have a bit per interrupt.
+func Interrupts(val uint8) []Field {
+	fields := make([]Field, len(interruptNames))
+	for i, name := range interruptNames {
+		fields[i] = Field{name, OnOff((val>>i)&1 != 0)}
+	}
+	return fields
+}
+
+var shades = []string{"white", "light gray", "dark gray", "black"}
+
+// Palette decodes BGP, OBP0 and OBP1, which have a shade per color.
+func Palette(val uint8) []Field {
+	fields := make([]Field, 4)
+	for i := range fields {
+		fields[i] = Field{fmt.Sprintf("Color %d", i), shades[(val>>(i*2))&3]}
+	}
+	return fields
+}
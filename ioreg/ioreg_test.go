@@ -0,0 +1,45 @@
+package ioreg
+
+import "testing"
+
+func TestString(t *testing.T) {
+	cases := []struct {
+		reg      Register
+		expected string
+	}{
+		{Register{0xff42, "SCY", 0x10, nil}, "ff42 SCY  = 10  (16)"},
+		{
+			Register{0xff07, "TAC", 0x05, []Field{{"Enable", "on"}, {"Clock", "262144 Hz"}}},
+			"ff07 TAC  = 05  Enable: on, Clock: 262144 Hz",
+		},
+		{
+			Register{0xffff, "IE", 0x05, Interrupts(0x05)},
+			"ffff IE   = 05  VBlank: on, STAT: off, Timer: on, Serial: off, Joypad: off",
+		},
+		{
+			Register{0xff47, "BGP", 0xe4, Palette(0xe4)},
+			"ff47 BGP  = e4  Color 0: white, Color 1: light gray, Color 2: dark gray, Color 3: black",
+		},
+	}
+	for _, c := range cases {
+		if got := c.reg.String(); got != c.expected {
+			t.Fatalf("String: (got: %q) (expected: %q)", got, c.expected)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	regs := []Register{{Addr: 0xffff, Name: "IE"}, {Addr: 0xff40, Name: "LCDC"}}
+	Sort(regs)
+	if regs[0].Name != "LCDC" {
+		t.Fatalf("Sort: (got: %v) (expected: LCDC first)", regs)
+	}
+	for _, name := range []string{"lcdc", "LCDC", "ff40", "$FF40"} {
+		if r, ok := Find(regs, name); !ok || r.Addr != 0xff40 {
+			t.Fatalf("Find %s: (got: %v, %v) (expected: LCDC)", name, r, ok)
+		}
+	}
+	if _, ok := Find(regs, "ff41"); ok {
+		t.Fatalf("Find ff41: (got: found) (expected: not found)")
+	}
+}
@@ -0,0 +1,55 @@
+package joypad
+
+import (
+	"strings"
+
+	"github.com/ushitora-anqou/aqboy/ioreg"
+)
+
+var (
+	actionNames    = []string{"A", "B", "Select", "Start"}
+	directionNames = []string{"Right", "Left", "Up", "Down"}
+)
+
+// Registers returns P1 with the selected buttons decoded.
+func (j *Joypad) Registers() []ioreg.Register {
+	val := uint8(0xc0) | j.Get()
+	var selected []string
+	if !j.selectAction {
+		val |= 0x20
+	} else {
+		selected = append(selected, "action")
+	}
+	if !j.selectDirection {
+		val |= 0x10
+	} else {
+		selected = append(selected, "direction")
+	}
+
+	var names, pressed []string
+	switch {
+	case j.selectAction:
+		names = actionNames
+	case j.selectDirection:
+		names = directionNames
+	}
+	for i, name := range names {
+		if (val>>i)&1 == 0 {
+			pressed = append(pressed, name)
+		}
+	}
+
+	return []ioreg.Register{
+		{Addr: 0xff00, Name: "P1", Value: val, Fields: []ioreg.Field{
+			{Name: "Select", Value: list(selected)},
+			{Name: "Pressed", Value: list(pressed)},
+		}},
+	}
+}
+
+func list(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, " ")
+}
@@ -0,0 +1,18 @@
+package joypad
+
+// SavedState is the state of the joypad, including the pressed buttons,
+// saved by SaveState.
+type SavedState struct {
+	joypad Joypad
+}
+
+// SaveState returns the state of the joypad, which can be restored by
+// LoadState.
+func (j *Joypad) SaveState() *SavedState {
+	return &SavedState{joypad: *j}
+}
+
+// LoadState restores the state saved by SaveState.
+func (j *Joypad) LoadState(s *SavedState) {
+	*j = s.joypad
+}
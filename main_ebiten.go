@@ -3,6 +3,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -10,7 +11,9 @@ import (
 	"runtime/pprof"
 
 	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
 	"github.com/ushitora-anqou/aqboy/constant"
+	"github.com/ushitora-anqou/aqboy/debugger"
 	"github.com/ushitora-anqou/aqboy/util"
 	"github.com/ushitora-anqou/aqboy/window"
 )
@@ -34,6 +37,9 @@ func (g *Game) Layout(outsideWidth, outsideHeight int) (int, int) {
 
 func (g *Game) Update() error {
 	if ebiten.IsKeyPressed(ebiten.KeyEscape) {
+		if err := g.aqboy.Close(); err != nil {
+			return err
+		}
 		os.Exit(0)
 	}
 
@@ -46,8 +52,17 @@ func (g *Game) Update() error {
 	event.Action |= util.BoolToU8(ebiten.IsKeyPressed(ebiten.KeyJ)) << constant.ACT_B
 	event.Action |= util.BoolToU8(ebiten.IsKeyPressed(ebiten.KeyEnter)) << constant.ACT_START
 	event.Action |= util.BoolToU8(ebiten.IsKeyPressed(ebiten.KeySpace)) << constant.ACT_SELECT
-
-	g.aqboy.Update(event)
+	event.Debug = inpututil.IsKeyJustPressed(ebiten.KeyF12)
+
+	if err := g.aqboy.Update(event); err != nil {
+		if errors.Is(err, debugger.ErrQuit) {
+			if err := g.aqboy.Close(); err != nil {
+				return err
+			}
+			os.Exit(0)
+		}
+		return err
+	}
 
 	return nil
 }
@@ -57,7 +72,7 @@ func (g *Game) Draw(screen *ebiten.Image) {
 	screen.ReplacePixels(pixels)
 }
 
-func runEbiten(rom []uint8) error {
+func runEbiten(rom []uint8, debug bool) error {
 	if err := window.EbitenInitialize(); err != nil {
 		return err
 	}
@@ -71,6 +86,13 @@ func runEbiten(rom []uint8) error {
 	if err != nil {
 		return err
 	}
+	defer aqboy.Close()
+	if err := aqboy.ConfigureFromEnv(); err != nil {
+		return err
+	}
+	if debug {
+		aqboy.Break()
+	}
 
 	game, err := NewGame(wind, aqboy)
 	if err != nil {
@@ -82,6 +104,7 @@ func runEbiten(rom []uint8) error {
 
 func run() error {
 	// Parse options and arguments
+	debug := flag.Bool("debug", false, "Start in the debugger (F12 enters it while running)")
 	flag.Parse()
 	if flag.NArg() < 1 {
 		return fmt.Errorf("Usage: %s PATH", os.Args[0])
@@ -104,7 +127,7 @@ func run() error {
 		return err
 	}
 
-	return runEbiten(rom)
+	return runEbiten(rom, *debug)
 }
 
 func main() {
@@ -0,0 +1,188 @@
+//go:build !sdl2 && !ebiten
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime/pprof"
+	"strings"
+
+	"github.com/ushitora-anqou/aqboy/debugger"
+	"github.com/ushitora-anqou/aqboy/mmu"
+	"github.com/ushitora-anqou/aqboy/tracediff"
+	"github.com/ushitora-anqou/aqboy/window"
+)
+
+// The headless frontend runs the emulator without any window or audio, which
+// is useful for debugging and testing in a plain terminal.
+func runHeadless() (err error) {
+	// Parse options and arguments
+	frames := flag.Int("frames", 0, "Quit after running the frames (0 means forever)")
+	debug := flag.Bool("debug", false, "Start in the debugger")
+	crashDump := flag.String("crashdump", "", "Inspect the crash dump in the directory, written for the ROM")
+	traceDiff := flag.String("tracediff", "", "Compare the CPU trace with the reference log, and report the first divergence (see -dmg)")
+	dmg := flag.Bool("dmg", false, "Start with the registers of a DMG after the boot ROM, as the logs of gameboy-doctor do (default: CGB)")
+	tiles := flag.String("tiles", "", "Write the tile data to the file as a PNG image at the end")
+	palette := flag.String("palette", "", "The palette of -tiles in hex, e.g. e4 (default: BGP)")
+	tileMap := flag.String("map", "", "Write the background of the tile map to the file as a PNG image at the end, with the viewport and the window outlined")
+	tileMapAddr := flag.String("mapaddr", "", "The tile map of -map, 9800 or 9c00 (default: the one used for BG)")
+	var pokes, freezes listFlag
+	flag.Var(&pokes, "poke", "Write the values to the memory before starting, e.g. c000=de,ad or 01:4000=c9 to patch the ROM (repeatable)")
+	flag.Var(&freezes, "freeze", "Keep the memory at the values, writing them at the end of every frame, e.g. Lives=3 (repeatable)")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		return fmt.Errorf("Usage: %s [OPTIONS] PATH", os.Args[0])
+	}
+	romPath := flag.Arg(0)
+	if filename := os.Getenv("AQBOY_CPUPROFILE"); filename != "" {
+		file, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := pprof.StartCPUProfile(file); err != nil {
+			return err
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	rom, err := os.ReadFile(romPath)
+	if err != nil {
+		return err
+	}
+
+	if *crashDump != "" {
+		return InspectCrashDump(*crashDump, rom, os.Stdin, os.Stdout)
+	}
+
+	aqboy, err := NewAQBoy(window.NewHeadlessWindow(), rom)
+	if err != nil {
+		return err
+	}
+	defer aqboy.Close()
+	if err := aqboy.ConfigureFromEnv(); err != nil {
+		return err
+	}
+	if *dmg {
+		aqboy.UseDMGRegisters()
+	}
+	for _, s := range pokes {
+		if err := pokeAll(aqboy, s, aqboy.Poke); err != nil {
+			return err
+		}
+	}
+	for _, s := range freezes {
+		if err := pokeAll(aqboy, s, aqboy.Freeze); err != nil {
+			return err
+		}
+	}
+	if *debug {
+		aqboy.Break()
+	}
+	if *tiles != "" {
+		usePalette, paletteData := *palette != "", uint8(0)
+		if usePalette {
+			val, err := debugger.ParseHex(*palette, 8)
+			if err != nil {
+				return fmt.Errorf("Invalid palette: %s", *palette)
+			}
+			paletteData = uint8(val)
+		}
+		defer func() {
+			if !usePalette {
+				paletteData = aqboy.ppu.BGP()
+			}
+			if err == nil {
+				err = debugger.WritePNG(*tiles, aqboy.TileImage(paletteData))
+			}
+		}()
+	}
+	if *tileMap != "" {
+		addr := uint64(0)
+		if *tileMapAddr != "" {
+			addr, err = debugger.ParseHex(*tileMapAddr, 16)
+			if err != nil || (addr != 0x9800 && addr != 0x9c00) {
+				return fmt.Errorf("Invalid tile map (expected: 9800 or 9c00): %s", *tileMapAddr)
+			}
+		}
+		defer func() {
+			if err == nil {
+				err = debugger.WritePNG(*tileMap, aqboy.TileMapImage(uint16(addr)))
+			}
+		}()
+	}
+	var differ *tracediff.Differ
+	if *traceDiff != "" {
+		ref, err := os.Open(*traceDiff)
+		if err != nil {
+			return err
+		}
+		defer ref.Close()
+		differ = tracediff.NewDiffer(bufio.NewReader(ref))
+		aqboy.SetTraceWriter(differ)
+	}
+
+	for i := 0; *frames == 0 || i < *frames; i++ {
+		if err := aqboy.Update(&window.WindowEvent{}); err != nil {
+			if errors.Is(err, debugger.ErrQuit) {
+				return nil
+			}
+			if errors.Is(err, tracediff.ErrEndOfReference) {
+				fmt.Printf("Trace matches the reference for all the %d instructions\n", differ.Lines())
+				return nil
+			}
+			var div *tracediff.Divergence
+			if errors.As(err, &div) {
+				div.Report(os.Stdout)
+				return div
+			}
+			if errors.Is(err, ErrSourceBreakpoint) {
+				fmt.Fprintln(os.Stderr, err)
+				return nil
+			}
+			return err
+		}
+	}
+	if differ != nil {
+		fmt.Printf("Trace matches the first %d instructions of the reference\n", differ.Lines())
+	}
+	return nil
+}
+
+// listFlag is a flag which may be given more than once.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *listFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// pokeAll parses the value of -poke or -freeze, and passes the pokes to do.
+func pokeAll(aqboy *AQBoy, s string, do func(p mmu.Poke) error) error {
+	pokes, err := aqboy.ParsePokes(s)
+	if err != nil {
+		return err
+	}
+	for _, p := range pokes {
+		if err := do(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	err := runHeadless()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -3,17 +3,20 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"runtime/pprof"
 
+	"github.com/ushitora-anqou/aqboy/debugger"
 	"github.com/ushitora-anqou/aqboy/window"
 )
 
 func runSDL2() error {
 	// Parse options and arguments
+	debug := flag.Bool("debug", false, "Start in the debugger (F12 enters it while running)")
 	flag.Parse()
 	if flag.NArg() < 1 {
 		return fmt.Errorf("Usage: %s PATH", os.Args[0])
@@ -53,6 +56,13 @@ func runSDL2() error {
 	if err != nil {
 		return err
 	}
+	defer aqboy.Close()
+	if err := aqboy.ConfigureFromEnv(); err != nil {
+		return err
+	}
+	if *debug {
+		aqboy.Break()
+	}
 
 	// Main loop
 	synchronizer := window.NewSDLTimeSynchronizer(60 /* FPS */)
@@ -64,7 +74,12 @@ func runSDL2() error {
 		}
 
 		// Update the emulator
-		aqboy.Update(event)
+		if err := aqboy.Update(event); err != nil {
+			if errors.Is(err, debugger.ErrQuit) {
+				break
+			}
+			return err
+		}
 
 		// Draw
 		err := wind.UpdateScreen()
@@ -4,4 +4,18 @@ type Cartridge interface {
 	get8(addr uint16) uint8
 	set8(addr uint16, val uint8)
 	getSliceXX00(prefix, size int) []uint8
+	bank(addr uint16) int
+	index(addr uint16) int // Index of addr in the ROM or the RAM
+	sizes() (rom, ram int)
+	// saveState returns the state of the banking and the RAM, which can be
+	// restored by loadState.
+	saveState() interface{}
+	loadState(s interface{})
+	ramData() []uint8
+	// romData returns the ROM including the patches.
+	romData() []uint8
+	// patchROM overwrites the byte of the ROM at index.
+	patchROM(index int, val uint8)
+	// String describes the state of the mapper.
+	String() string
 }
@@ -0,0 +1,121 @@
+package mmu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Flags of a byte recorded by CDL
+const (
+	CDLCode    uint8 = 1 << iota // Fetched as the first byte of an instruction
+	CDLOperand                   // Fetched as an operand of an instruction
+	CDLData                      // Read by an instruction
+	CDLDMA                       // Read as the source of OAM DMA
+)
+
+const cdlMagic = "AQBOYCDL"
+
+// CDL (code/data logger) records how each byte of the memory has been
+// accessed. ROM and cartridge RAM are indexed by their physical address,
+// i.e. bank*size+offset, so that bank switching is taken into account.
+type CDL struct {
+	ROM, VRAM, CartRAM, WRAM, HRAM []uint8
+}
+
+func newCDL(romSize, ramSize int) *CDL {
+	return &CDL{
+		ROM:     make([]uint8, romSize),
+		VRAM:    make([]uint8, 0x2000),
+		CartRAM: make([]uint8, ramSize),
+		WRAM:    make([]uint8, 0x2000),
+		HRAM:    make([]uint8, 0x007f),
+	}
+}
+
+func (cdl *CDL) regions() [][]uint8 {
+	return [][]uint8{cdl.ROM, cdl.VRAM, cdl.CartRAM, cdl.WRAM, cdl.HRAM}
+}
+
+/*
+	File format (integers are little endian):
+
+	"AQBOYCDL"
+	uint32 size of each region (ROM, VRAM, cartridge RAM, WRAM, HRAM)
+	flags of each byte of the regions in the same order
+*/
+
+// WriteFile writes the log in the CDL file format.
+func (cdl *CDL) WriteFile(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString(cdlMagic)
+	for _, region := range cdl.regions() {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(region)))
+	}
+	for _, region := range cdl.regions() {
+		buf.Write(region)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// MergeFile reads a log written by WriteFile and merges it into cdl, so that
+// the coverage accumulates across sessions.
+func (cdl *CDL) MergeFile(r io.Reader) error {
+	magic := make([]uint8, len(cdlMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != cdlMagic {
+		return fmt.Errorf("Invalid CDL file")
+	}
+	regions := cdl.regions()
+	sizes := make([]uint32, len(regions))
+	if err := binary.Read(r, binary.LittleEndian, sizes); err != nil {
+		return fmt.Errorf("Invalid CDL file: %w", err)
+	}
+	for i, region := range regions {
+		if int(sizes[i]) != len(region) {
+			return fmt.Errorf("CDL file does not match the cartridge")
+		}
+	}
+	for _, region := range regions {
+		src := make([]uint8, len(region))
+		if _, err := io.ReadFull(r, src); err != nil {
+			return fmt.Errorf("Invalid CDL file: %w", err)
+		}
+		for i, flags := range src {
+			region[i] |= flags
+		}
+	}
+	return nil
+}
+
+// EnableCDL starts recording the accesses to the memory, and returns the log.
+// The CPU caches decoded instructions, so their bytes are logged as code when
+// they are decoded; flush the cache to log the instructions decoded before.
+func (mmu *MMU) EnableCDL() *CDL {
+	if mmu.cdl == nil {
+		romSize, ramSize := mmu.cat.sizes()
+		mmu.cdl = newCDL(romSize, ramSize)
+	}
+	return mmu.cdl
+}
+
+func (mmu *MMU) logAccess(addr uint16, flag uint8) {
+	cdl := mmu.cdl
+	switch {
+	case 0x0000 <= addr && addr <= 0x7fff:
+		cdl.ROM[mmu.cat.index(addr)] |= flag
+	case 0x8000 <= addr && addr <= 0x9fff:
+		cdl.VRAM[addr-0x8000] |= flag
+	case 0xa000 <= addr && addr <= 0xbfff:
+		if index := mmu.cat.index(addr); index < len(cdl.CartRAM) {
+			cdl.CartRAM[index] |= flag
+		}
+	case 0xc000 <= addr && addr <= 0xdfff:
+		cdl.WRAM[addr-0xc000] |= flag
+	case 0xe000 <= addr && addr <= 0xfdff:
+		cdl.WRAM[addr-0xe000] |= flag
+	case 0xff80 <= addr && addr <= 0xfffe:
+		cdl.HRAM[addr-0xff80] |= flag
+	}
+}
@@ -9,6 +9,7 @@ type MBC1Cartridge struct {
 	rom, ram                                               []uint8
 	log2ROMBanks, romBankNumber, bankingMode, secondaryReg int
 	ramEnabled, largeROM                                   bool
+	romPatched                                             bool // rom is a copy of the source
 }
 
 func NewMBC1Cartridge(src []uint8) (*MBC1Cartridge, error) {
@@ -80,7 +81,7 @@ func (cat *MBC1Cartridge) set8(addr uint16, val uint8) {
 		cat.ram[index] = val
 
 	default:
-		log.Fatalf("Invalid address")
+		log.Panicf("Invalid address")
 	}
 }
 
@@ -120,6 +121,24 @@ func (cat *MBC1Cartridge) getRAMIndex(addr uint16) int {
 	return index
 }
 
+func (cat *MBC1Cartridge) bank(addr uint16) int {
+	if addr <= 0x7fff {
+		return cat.getROMIndex(addr) / 0x4000
+	}
+	return cat.getRAMIndex(addr) / 0x2000
+}
+
+func (cat *MBC1Cartridge) index(addr uint16) int {
+	if addr <= 0x7fff {
+		return cat.getROMIndex(addr)
+	}
+	return cat.getRAMIndex(addr)
+}
+
+func (cat *MBC1Cartridge) sizes() (int, int) {
+	return len(cat.rom), len(cat.ram)
+}
+
 func (cat *MBC1Cartridge) get8(addr uint16) uint8 {
 	switch {
 	case 0x0000 <= addr && addr <= 0x7fff: // ROM Bank
@@ -131,7 +150,7 @@ func (cat *MBC1Cartridge) get8(addr uint16) uint8 {
 		return cat.ram[index]
 	}
 
-	log.Fatalf("Invalid address")
+	log.Panicf("Invalid address")
 	return 0
 }
 
@@ -146,6 +165,43 @@ func (cat *MBC1Cartridge) getSliceXX00(prefix, size int) []uint8 {
 		return cat.ram[off : off+size]
 	}
 
-	log.Fatalf("Invalid address")
+	log.Panicf("Invalid address")
 	return nil
 }
+
+func (cat *MBC1Cartridge) saveState() interface{} {
+	s := *cat
+	s.ram = append([]uint8(nil), cat.ram...)
+	return &s
+}
+
+// loadState restores the state, keeping the patches to the ROM.
+func (cat *MBC1Cartridge) loadState(state interface{}) {
+	s := state.(*MBC1Cartridge)
+	rom, romPatched, ram := cat.rom, cat.romPatched, cat.ram
+	*cat = *s
+	cat.rom, cat.romPatched = rom, romPatched
+	cat.ram = append(ram[:0], s.ram...)
+}
+
+func (cat *MBC1Cartridge) ramData() []uint8 {
+	return cat.ram
+}
+
+func (cat *MBC1Cartridge) romData() []uint8 {
+	return cat.rom
+}
+
+func (cat *MBC1Cartridge) patchROM(index int, val uint8) {
+	// Leave the source intact, e.g. for the hash in a crash dump.
+	if !cat.romPatched {
+		cat.rom = append([]uint8(nil), cat.rom...)
+		cat.romPatched = true
+	}
+	cat.rom[index] = val
+}
+
+func (cat *MBC1Cartridge) String() string {
+	return fmt.Sprintf("MBC1 ROM bank=%02x secondary=%d mode=%d RAM enabled=%v (ROM %d KiB, RAM %d KiB)",
+		cat.romBankNumber, cat.secondaryReg, cat.bankingMode, cat.ramEnabled, len(cat.rom)/1024, len(cat.ram)/1024)
+}
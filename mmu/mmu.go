@@ -4,6 +4,7 @@ import (
 	"log"
 
 	"github.com/ushitora-anqou/aqboy/bus"
+	"github.com/ushitora-anqou/aqboy/eventlog"
 	"github.com/ushitora-anqou/aqboy/util"
 )
 
@@ -28,6 +29,11 @@ type MMU struct {
 	bus        *bus.Bus
 	cat        Cartridge
 	wram, hram []uint8
+	cdl        *CDL
+
+	watchpoints []Watchpoint
+	watchHit    WatchHit
+	watchHitOK  bool
 }
 
 func NewMMU(bus *bus.Bus, rom []uint8) (*MMU, error) {
@@ -45,6 +51,16 @@ func NewMMU(bus *bus.Bus, rom []uint8) (*MMU, error) {
 }
 
 func (mmu *MMU) Set8(addr uint16, val uint8) {
+	if mmu.watchpoints != nil {
+		mmu.watchWrite(addr, val)
+	}
+	if mmu.bus.Events != nil && (0xff00 <= addr && addr <= 0xff7f || addr == 0xffff) {
+		mmu.bus.Events.Add(eventlog.IOWrite, addr, val)
+	}
+	mmu.set8(addr, val)
+}
+
+func (mmu *MMU) set8(addr uint16, val uint8) {
 	cpu := mmu.bus.CPU
 	ppu := mmu.bus.PPU
 	timer := mmu.bus.Timer
@@ -54,21 +70,27 @@ func (mmu *MMU) Set8(addr uint16, val uint8) {
 	switch {
 	case 0x0000 <= addr && addr <= 0x7fff:
 		mmu.cat.set8(addr, val)
+		cpu.InvalidateCode(addr)
 		return
 	case 0x8000 <= addr && addr <= 0x9FFF:
 		ppu.SetVRAM8(addr-0x8000, val)
+		cpu.InvalidateCode(addr)
 		return
 	case 0xa000 <= addr && addr <= 0xbfff:
 		mmu.cat.set8(addr, val)
+		cpu.InvalidateCode(addr)
 		return
 	case 0xc000 <= addr && addr <= 0xdfff:
 		mmu.wram[addr-0xc000] = val
+		cpu.InvalidateCode(addr)
 		return
 	case 0xe000 <= addr && addr <= 0xfdff:
 		mmu.wram[addr-0xe000] = val
+		cpu.InvalidateCode(addr)
 		return
 	case 0xfe00 <= addr && addr <= 0xfe9f:
 		ppu.SetOAM8(addr-0xfe00, val)
+		cpu.InvalidateCode(addr)
 		return
 	case 0xfea0 <= addr && addr <= 0xfeff:
 		// FIXME: What behaviour is expected here?
@@ -78,6 +100,7 @@ func (mmu *MMU) Set8(addr uint16, val uint8) {
 		return
 	case 0xff80 <= addr && addr <= 0xfffe:
 		mmu.hram[addr-0xff80] = val
+		cpu.InvalidateCode(addr)
 		return
 	}
 
@@ -122,6 +145,9 @@ func (mmu *MMU) Set8(addr uint16, val uint8) {
 	case 0xff46:
 		util.Trace1("\t<<<WRITE: OMA DMA Transfer: 0x%02x>>>", val)
 		mmu.bus.PPU.StartTransferOAM(val)
+		for oamAddr := uint16(0xfe00); oamAddr <= 0xfe9f; oamAddr++ {
+			cpu.InvalidateCode(oamAddr)
+		}
 	case 0xff47:
 		util.Trace1("\t<<<WRITE: BGP BG Palette Data Non CGB Mode Only: %08b>>>", val)
 		ppu.SetBGP(val)
@@ -149,11 +175,55 @@ func (mmu *MMU) Set8(addr uint16, val uint8) {
 		util.Trace1("\t<<<WRITE: IE Interrupt Enable: %b>>>", val)
 		cpu.SetIE(val)
 	default:
-		log.Fatalf("Invalid memory access of Set8: 0x%02x at 0x%08x", val, addr)
+		log.Panicf("Invalid memory access of Set8: 0x%02x at 0x%08x", val, addr)
 	}
 }
 
 func (mmu *MMU) Get8(addr uint16) uint8 {
+	if mmu.cdl != nil {
+		mmu.logAccess(addr, CDLData)
+	}
+	val := mmu.get8(addr)
+	if mmu.watchpoints != nil {
+		mmu.watchRead(addr, val)
+	}
+	return val
+}
+
+// FetchOpcode reads the first byte of an instruction.
+func (mmu *MMU) FetchOpcode(addr uint16) uint8 {
+	if mmu.cdl != nil {
+		mmu.logAccess(addr, CDLCode)
+	}
+	return mmu.get8(addr)
+}
+
+// FetchOperand reads a byte of an instruction following its opcode.
+func (mmu *MMU) FetchOperand(addr uint16) uint8 {
+	if mmu.cdl != nil {
+		mmu.logAccess(addr, CDLOperand)
+	}
+	return mmu.get8(addr)
+}
+
+// Peek8 reads addr for debugging. Unlike Get8, it is not logged to CDL, and
+// unmapped addresses read as 0xff instead of stopping the emulator.
+func (mmu *MMU) Peek8(addr uint16) uint8 {
+	switch {
+	case 0xa000 <= addr && addr <= 0xbfff:
+		if _, ramSize := mmu.cat.sizes(); mmu.cat.index(addr) >= ramSize {
+			return 0xff
+		}
+	case 0xff24 <= addr && addr <= 0xff26: // Readable sound registers
+	case addr == 0xff00, 0xff04 <= addr && addr <= 0xff07, addr == 0xff0f:
+	case addr == 0xff40, addr == 0xff41, addr == 0xff44, addr == 0xff4d, addr == 0xff68:
+	case 0xff00 <= addr && addr <= 0xff7f:
+		return 0xff
+	}
+	return mmu.get8(addr)
+}
+
+func (mmu *MMU) get8(addr uint16) uint8 {
 	ppu := mmu.bus.PPU
 	cpu := mmu.bus.CPU
 	timer := mmu.bus.Timer
@@ -222,7 +292,7 @@ func (mmu *MMU) Get8(addr uint16) uint8 {
 	case 0xff68:
 		util.Trace0("\t<<<READ: BCPS/BGPI CGB Mode Only Background Palette Index>>>")
 	default:
-		log.Fatalf("Invalid memory access of Get8: at 0x%08x", addr)
+		log.Panicf("Invalid memory access of Get8: at 0x%08x", addr)
 	}
 
 	return 0
@@ -239,7 +309,23 @@ func (mmu *MMU) Set16(addr uint16, val uint16) {
 	mmu.Set8(addr+1, uint8(val>>8))
 }
 
+// Bank returns the number of the bank mapped at addr.
+// It is 0 for addresses that are not banked.
+func (mmu *MMU) Bank(addr uint16) int {
+	switch {
+	case 0x0000 <= addr && addr <= 0x7fff, 0xa000 <= addr && addr <= 0xbfff:
+		return mmu.cat.bank(addr)
+	}
+	return 0
+}
+
 func (mmu *MMU) GetSliceXX00(prefix, size int) []uint8 {
+	if mmu.cdl != nil {
+		for i := 0; i < size; i++ {
+			mmu.logAccess(uint16(prefix<<8+i), CDLDMA)
+		}
+	}
+
 	switch {
 	case (0x00 <= prefix && prefix <= 0x7F) || (0xa0 <= prefix && prefix <= 0xbf):
 		return mmu.cat.getSliceXX00(prefix, size)
@@ -249,7 +335,23 @@ func (mmu *MMU) GetSliceXX00(prefix, size int) []uint8 {
 		return mmu.wram[off : off+size]
 
 	default:
-		log.Fatalf("GetSliceXX00: Invalid prefix: %02x", prefix)
+		log.Panicf("GetSliceXX00: Invalid prefix: %02x", prefix)
 	}
 	return nil
 }
+
+// MapperState describes the state of the mapper of the cartridge.
+func (mmu *MMU) MapperState() string {
+	return mmu.cat.String()
+}
+
+// ROM returns the ROM including the patches made by Poke. It must not be
+// modified.
+func (mmu *MMU) ROM() []uint8 {
+	return mmu.cat.romData()
+}
+
+// CartridgeRAM returns a copy of the whole RAM of the cartridge.
+func (mmu *MMU) CartridgeRAM() []uint8 {
+	return append([]uint8(nil), mmu.cat.ramData()...)
+}
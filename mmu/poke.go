@@ -0,0 +1,111 @@
+package mmu
+
+import "fmt"
+
+// Poke is a write to the memory for debugging. See MMU.Poke.
+type Poke struct {
+	Bank int // -1 means the bank currently mapped at Addr
+	Addr uint16
+	Val  uint8
+}
+
+func (p Poke) String() string {
+	if p.Bank < 0 {
+		return fmt.Sprintf("%04x = %02x", p.Addr, p.Val)
+	}
+	return fmt.Sprintf("%02x:%04x = %02x", p.Bank, p.Addr, p.Val)
+}
+
+// Poke writes to VRAM, OAM, WRAM, HRAM, the cartridge RAM or the ROM for
+// debugging. Unlike Set8, a write to the ROM patches it instead of
+// controlling the mapper, the bank need not be mapped, and the write is not
+// caught by the watchpoints. The I/O registers cannot be poked.
+func (mmu *MMU) Poke(p Poke) error {
+	romSize, ramSize := mmu.cat.sizes()
+	switch {
+	case p.Addr <= 0x7fff:
+		index := mmu.cat.index(p.Addr)
+		if p.Bank >= 0 {
+			index = p.Bank*0x4000 + int(p.Addr%0x4000)
+		}
+		if index >= romSize {
+			return fmt.Errorf("Out of the ROM: %v", p)
+		}
+		mmu.cat.patchROM(index, p.Val)
+		// The patched bank may have been decoded even if it is not mapped.
+		mmu.bus.CPU.FlushBlockCache()
+		return nil
+
+	case 0xa000 <= p.Addr && p.Addr <= 0xbfff:
+		index := mmu.cat.index(p.Addr)
+		if p.Bank >= 0 {
+			index = p.Bank*0x2000 + int(p.Addr-0xa000)
+		}
+		if index >= ramSize {
+			return fmt.Errorf("Out of the cartridge RAM: %v", p)
+		}
+		mmu.cat.ramData()[index] = p.Val
+		mmu.bus.CPU.InvalidateCode(p.Addr)
+		return nil
+	}
+
+	if p.Bank > 0 {
+		return fmt.Errorf("Not banked: %v", p)
+	}
+	switch {
+	case 0xfea0 <= p.Addr && p.Addr <= 0xfeff:
+		return fmt.Errorf("Not usable: %v", p)
+	case 0xff00 <= p.Addr && p.Addr <= 0xff7f, p.Addr == 0xffff:
+		return fmt.Errorf("Cannot poke an I/O register: %v", p)
+	}
+	mmu.set8(p.Addr, p.Val)
+	return nil
+}
+
+// CheckWrite returns an error if Write cannot write addr.
+func (mmu *MMU) CheckWrite(addr uint16) error {
+	romSize, ramSize := mmu.cat.sizes()
+	switch {
+	case addr <= 0x7fff:
+		if mmu.cat.index(addr) >= romSize {
+			return fmt.Errorf("Out of the ROM: %04x", addr)
+		}
+	case 0xa000 <= addr && addr <= 0xbfff:
+		if mmu.cat.index(addr) >= ramSize {
+			return fmt.Errorf("Out of the cartridge RAM: %04x", addr)
+		}
+	case 0xff00 <= addr && addr <= 0xff7f, addr == 0xffff:
+		if !ioWritable(addr) {
+			return fmt.Errorf("Not a writable I/O register: %04x", addr)
+		}
+	}
+	return nil
+}
+
+// Write writes val to addr for debuggers which see the memory as the bus
+// does. A write to the ROM patches it by Poke, and the others are written by
+// Set8 as the CPU does, including the I/O registers.
+func (mmu *MMU) Write(addr uint16, val uint8) error {
+	if err := mmu.CheckWrite(addr); err != nil {
+		return err
+	}
+	if addr <= 0x7fff {
+		return mmu.Poke(Poke{Bank: -1, Addr: addr, Val: val})
+	}
+	mmu.Set8(addr, val)
+	return nil
+}
+
+// ioWritable returns true if Set8 handles a write to the I/O register at
+// addr. A write to the others is an invalid access.
+func ioWritable(addr uint16) bool {
+	switch {
+	case addr == 0xff00, addr == 0xff01, addr == 0xff02, 0xff04 <= addr && addr <= 0xff07, addr == 0xff0f:
+	case 0xff10 <= addr && addr <= 0xff26 && addr != 0xff15 && addr != 0xff1f, 0xff30 <= addr && addr <= 0xff3f:
+	case 0xff40 <= addr && addr <= 0xff43, 0xff45 <= addr && addr <= 0xff4b:
+	case addr == 0xff4d, addr == 0xff4f, addr == 0xff68, addr == 0xff69, addr == 0xffff:
+	default:
+		return false
+	}
+	return true
+}
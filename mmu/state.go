@@ -0,0 +1,26 @@
+package mmu
+
+// SavedState is the state of the memory saved by SaveState. The ROM, the
+// code/data log and the watchpoints are not part of it.
+type SavedState struct {
+	wram, hram []uint8
+	cat        interface{}
+}
+
+// SaveState returns the contents of WRAM, HRAM and the cartridge RAM, and
+// the state of the banking, which can be restored by LoadState.
+func (mmu *MMU) SaveState() *SavedState {
+	return &SavedState{
+		wram: append([]uint8(nil), mmu.wram...),
+		hram: append([]uint8(nil), mmu.hram...),
+		cat:  mmu.cat.saveState(),
+	}
+}
+
+// LoadState restores the state saved by SaveState.
+func (mmu *MMU) LoadState(s *SavedState) {
+	copy(mmu.wram, s.wram)
+	copy(mmu.hram, s.hram)
+	mmu.cat.loadState(s.cat)
+	mmu.watchHitOK = false
+}
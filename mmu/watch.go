@@ -0,0 +1,101 @@
+package mmu
+
+import "fmt"
+
+// Kinds of accesses caught by a watchpoint
+type WatchKind uint8
+
+const (
+	WatchRead   WatchKind = 1 << iota // Read by an instruction
+	WatchWrite                        // Written by an instruction
+	WatchChange                       // Written with a value different from the current one
+)
+
+func (k WatchKind) String() string {
+	s := ""
+	if k&WatchRead != 0 {
+		s += "r"
+	}
+	if k&WatchWrite != 0 {
+		s += "w"
+	}
+	if k&WatchChange != 0 {
+		s += "c"
+	}
+	return s
+}
+
+// Watchpoint catches the accesses to the addresses From-To, inclusive.
+// The addresses are as currently mapped, i.e. the banks are not taken into
+// account.
+type Watchpoint struct {
+	Kind     WatchKind
+	From, To uint16
+}
+
+func (wp Watchpoint) String() string {
+	if wp.From == wp.To {
+		return fmt.Sprintf("%04x %v", wp.From, wp.Kind)
+	}
+	return fmt.Sprintf("%04x-%04x %v", wp.From, wp.To, wp.Kind)
+}
+
+// WatchHit is an access caught by a watchpoint.
+type WatchHit struct {
+	Watchpoint Watchpoint
+	Kind       WatchKind // WatchRead or WatchWrite
+	Addr       uint16
+	Old, Val   uint8 // Old is the value before the write
+}
+
+func (hit WatchHit) String() string {
+	if hit.Kind == WatchRead {
+		return fmt.Sprintf("read %04x = %02x", hit.Addr, hit.Val)
+	}
+	return fmt.Sprintf("write %04x = %02x (was %02x)", hit.Addr, hit.Val, hit.Old)
+}
+
+// SetWatchpoints replaces the watchpoints. Only the first hit is kept until
+// it is taken by TakeWatchHit.
+func (mmu *MMU) SetWatchpoints(wps []Watchpoint) {
+	if len(wps) == 0 {
+		mmu.watchpoints = nil // Skip the checks entirely
+		return
+	}
+	mmu.watchpoints = append([]Watchpoint(nil), wps...)
+}
+
+// TakeWatchHit returns the access caught since the last call, if any.
+func (mmu *MMU) TakeWatchHit() (WatchHit, bool) {
+	hit, ok := mmu.watchHit, mmu.watchHitOK
+	mmu.watchHitOK = false
+	return hit, ok
+}
+
+func (mmu *MMU) watchRead(addr uint16, val uint8) {
+	if mmu.watchHitOK {
+		return
+	}
+	for _, wp := range mmu.watchpoints {
+		if wp.Kind&WatchRead != 0 && wp.From <= addr && addr <= wp.To {
+			mmu.watchHit = WatchHit{Watchpoint: wp, Kind: WatchRead, Addr: addr, Val: val}
+			mmu.watchHitOK = true
+			return
+		}
+	}
+}
+
+func (mmu *MMU) watchWrite(addr uint16, val uint8) {
+	if mmu.watchHitOK {
+		return
+	}
+	old := mmu.Peek8(addr)
+	for _, wp := range mmu.watchpoints {
+		if wp.From <= addr && addr <= wp.To &&
+			(wp.Kind&WatchWrite != 0 || (wp.Kind&WatchChange != 0 && old != val)) {
+			mmu.watchHit = WatchHit{Watchpoint: wp, Kind: WatchWrite, Addr: addr, Old: old, Val: val}
+			mmu.watchHitOK = true
+			return
+		}
+	}
+}
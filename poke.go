@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ushitora-anqou/aqboy/debugger"
+	"github.com/ushitora-anqou/aqboy/mmu"
+)
+
+// Poke writes to the memory while the game runs. See mmu.MMU.Poke.
+func (a *AQBoy) Poke(p mmu.Poke) error {
+	if err := a.mmu.Poke(p); err != nil {
+		return err
+	}
+	// Replace the snapshots ahead, which no longer follow from the state, so
+	// that going backwards and forwards again keeps the poke.
+	if a.historySize > 0 {
+		a.saveSnapshot()
+	}
+	return nil
+}
+
+// Freeze pokes p, and pokes it again at the end of every frame so that the
+// game cannot change the value. It replaces the freeze at the same address.
+func (a *AQBoy) Freeze(p mmu.Poke) error {
+	if err := a.Poke(p); err != nil {
+		return err
+	}
+	for i, f := range a.freezes {
+		if f.Bank == p.Bank && f.Addr == p.Addr {
+			a.freezes[i] = p
+			return nil
+		}
+	}
+	a.freezes = append(a.freezes, p)
+	return nil
+}
+
+// Unfreeze deletes the index-th freeze. The value is left as it is.
+func (a *AQBoy) Unfreeze(index int) {
+	a.freezes = append(a.freezes[:index], a.freezes[index+1:]...)
+}
+
+// Freezes returns the pokes made by Freeze in the order they are made.
+func (a *AQBoy) Freezes() []mmu.Poke {
+	return a.freezes
+}
+
+func (a *AQBoy) reassertFreezes() {
+	for _, p := range a.freezes {
+		// They have succeeded once, so they cannot fail.
+		a.mmu.Poke(p)
+	}
+}
+
+// ParsePokes parses "LOC=VAL,VAL,...", which writes the values to LOC and
+// the following addresses. LOC is a label, BANK:ADDR or ADDR, e.g. "Lives=3",
+// "01:4000=c9" or "c000=de,ad". Numbers are in hex with an optional prefix
+// "$" or "0x".
+func (a *AQBoy) ParsePokes(s string) ([]mmu.Poke, error) {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return nil, fmt.Errorf("Invalid poke (expected: LOC=VAL): %s", s)
+	}
+	loc, vals := s[:i], s[i+1:]
+
+	at, err := debugger.ParseLocation(a.symbols, loc)
+	if err != nil {
+		return nil, err
+	}
+	bank, addr := at.Bank, int(at.Addr)
+
+	var pokes []mmu.Poke
+	for _, v := range strings.Split(vals, ",") {
+		val, err := debugger.ParseHex(v, 8)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value: %s", v)
+		}
+		if addr > 0xffff {
+			return nil, fmt.Errorf("Too many values: %s", s)
+		}
+		pokes = append(pokes, mmu.Poke{Bank: bank, Addr: uint16(addr), Val: uint8(val)})
+		addr++
+	}
+	return pokes, nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/ushitora-anqou/aqboy/bus"
 	"github.com/ushitora-anqou/aqboy/constant"
+	"github.com/ushitora-anqou/aqboy/eventlog"
 )
 
 type PPU struct {
@@ -129,9 +130,23 @@ func (ppu *PPU) Mode() uint8 {
 }
 
 func (ppu *PPU) SetMode(mode uint8) {
+	if events := ppu.bus.Events; events != nil && mode != ppu.Mode() {
+		events.Add(eventlog.PPUMode, 0xff41, mode)
+	}
 	ppu.stat = (ppu.stat & 0xfc) | mode
 }
 
+// Dot returns the clock cycles since the start of the current scanline.
+func (ppu *PPU) Dot() int {
+	switch ppu.Mode() {
+	case 3: // Pixel Transfer
+		return 80 + int(ppu.tick)
+	case 0: // H-Blank
+		return 80 + 168 + int(ppu.tick)
+	}
+	return int(ppu.tick)
+}
+
 func (ppu *PPU) getLCDDisplayEnable() bool {
 	return (ppu.LCDC()>>7)&1 != 0
 }
@@ -176,53 +191,65 @@ func (ppu *PPU) getBGWindowDisplayPriority() bool {
 	return (ppu.LCDC()>>0)&1 != 0
 }
 
-func (ppu *PPU) fetchTileIndex(isBG bool, x, y int) uint8 {
+func (ppu *PPU) fetchTileIndex(tileMapAddr uint16, x, y int) uint8 {
 	tile_x, tile_y := x/8, y/8
-
-	var tileMapAddr uint16
-	if isBG {
-		tileMapAddr = ppu.getBGTileMapAddr()
-	} else {
-		tileMapAddr = ppu.getWindowTileMapAddr()
-	}
-
 	tileNo := ppu.GetVRAM8(uint16(int(tileMapAddr) - 0x8000 + 32*tile_y + tile_x))
 	return tileNo
 }
 
 func (ppu *PPU) fetchTileColor(isObject bool, tileNo, paletteData uint8, pixX, pixY int) (uint8, uint8) {
 	var off uint16
-	switch {
-	case isObject:
+	if isObject {
 		if ppu.getOBJYSize() == 16 {
 			// Bit 0 of tile index for 8x16 objects should be ignored.
 			tileNo &^= 1 << 0
 		}
-		off = uint16(int(tileNo)*16 + 2*pixY)
-	case ppu.getBGWindowTileDataArea():
-		off = uint16(int(tileNo)*16 + 2*pixY)
-	default:
-		off = uint16(0x1000 + int(int8(tileNo))*16 + 2*pixY)
+		off = uint16(int(tileNo) * 16)
+	} else {
+		off = ppu.bgWindowTileOffset(tileNo)
 	}
 
+	paletteIdx := ppu.decodeTilePixel(off, pixX, pixY)
+	return paletteIdx, paletteColor(paletteData, paletteIdx)
+}
+
+// bgWindowTileOffset returns the offset in VRAM of the tile for BG and
+// Window, which is addressed from 8000 or 9000 with a signed index
+// according to LCDC.
+func (ppu *PPU) bgWindowTileOffset(tileNo uint8) uint16 {
+	if ppu.getBGWindowTileDataArea() {
+		return uint16(int(tileNo) * 16)
+	}
+	return uint16(0x1000 + int(int8(tileNo))*16)
+}
+
+// decodeTilePixel decodes the pixel of the 2bpp tile at off in VRAM into
+// the index in the palette. Tiles are 8 rows of 2 bytes, the first of which
+// has the lower bits of the indices.
+func (ppu *PPU) decodeTilePixel(off uint16, pixX, pixY int) uint8 {
+	off += uint16(2 * pixY)
 	paletteIdxLSB := (ppu.GetVRAM8(off) >> (7 - pixX)) & 1
 	paletteIdxMSB := (ppu.GetVRAM8(off+1) >> (7 - pixX)) & 1
-	paletteIdx := paletteIdxLSB | (paletteIdxMSB << 1)
-	color := (paletteData >> (2 * paletteIdx)) & 3
-	return paletteIdx, color
+	return paletteIdxLSB | (paletteIdxMSB << 1)
+}
+
+// paletteColor returns the color of the index in the palette, e.g. BGP.
+func paletteColor(paletteData, paletteIdx uint8) uint8 {
+	return (paletteData >> (2 * paletteIdx)) & 3
 }
 
-func (ppu *PPU) fetchBGWindowTileColor(isBG bool, x, y int) uint8 {
-	tileNo := ppu.fetchTileIndex(isBG, x, y)
+func (ppu *PPU) fetchBGWindowTileColor(tileMapAddr uint16, x, y int) uint8 {
+	tileNo := ppu.fetchTileIndex(tileMapAddr, x, y)
 	_, color := ppu.fetchTileColor(false, tileNo, ppu.BGP(), x%8, y%8)
 	return color
 }
 
 func (ppu *PPU) drawLineBG(scanline []uint8) {
+	tileMapAddr := ppu.getBGTileMapAddr()
 	y := int(ppu.ly + ppu.scy) // NOTE: wrap around
 	for ax := 0; ax < constant.LCD_WIDTH; ax++ {
 		x := int(uint8(ax) + ppu.scx) // NOTE: wrap around
-		scanline[ax] = ppu.fetchBGWindowTileColor(true, x, y)
+		scanline[ax] = ppu.fetchBGWindowTileColor(tileMapAddr, x, y)
 	}
 }
 
@@ -230,12 +257,13 @@ func (ppu *PPU) drawLineWindow(scanline []uint8) {
 	if !ppu.getWindowDisplayEnable() {
 		return
 	}
+	tileMapAddr := ppu.getWindowTileMapAddr()
 	y, wx, wy := int(ppu.LY()), int(ppu.WX()-7), int(ppu.WY())
 	for x := 0; x < constant.LCD_WIDTH; x++ {
 		if x < wx || y < wy {
 			continue
 		}
-		scanline[x] = ppu.fetchBGWindowTileColor(false, x-wx, int(ppu.wly))
+		scanline[x] = ppu.fetchBGWindowTileColor(tileMapAddr, x-wx, int(ppu.wly))
 	}
 }
 
@@ -378,6 +406,9 @@ func (ppu *PPU) Update(elapsedTick uint) error {
 }
 
 func (ppu *PPU) StartTransferOAM(srcPrefix uint8) {
+	if events := ppu.bus.Events; events != nil {
+		events.Add(eventlog.OAMDMA, uint16(srcPrefix)<<8, 0)
+	}
 	copy(ppu.oam[:], ppu.bus.MMU.GetSliceXX00(int(srcPrefix), 0xa0))
 	ppu.remainingTransferTick = 160
 }
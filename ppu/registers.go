@@ -0,0 +1,58 @@
+package ppu
+
+import (
+	"fmt"
+
+	"github.com/ushitora-anqou/aqboy/ioreg"
+)
+
+var modeNames = []string{"H-Blank", "V-Blank", "OAM Search", "Pixel Transfer"}
+
+// Registers returns the LCD registers with their bitfields decoded.
+// DMA is not included since it is not kept after the transfer starts.
+func (ppu *PPU) Registers() []ioreg.Register {
+	tileData := "8800-97ff"
+	if ppu.getBGWindowTileDataArea() {
+		tileData = "8000-8fff"
+	}
+	lcdc := []ioreg.Field{
+		{Name: "LCD", Value: ioreg.OnOff(ppu.getLCDDisplayEnable())},
+		{Name: "Window map", Value: tileMapRange(ppu.getWindowTileMapAddr())},
+		{Name: "Window", Value: ioreg.OnOff(ppu.getWindowDisplayEnable())},
+		{Name: "Tile data", Value: tileData},
+		{Name: "BG map", Value: tileMapRange(ppu.getBGTileMapAddr())},
+		{Name: "OBJ size", Value: fmt.Sprintf("8x%d", ppu.getOBJYSize())},
+		{Name: "OBJ", Value: ioreg.OnOff(ppu.getOBJDisplayEnable())},
+		{Name: "BG/Window", Value: ioreg.OnOff(ppu.getBGWindowDisplayPriority())},
+	}
+
+	stat := ppu.STAT()
+	statFields := []ioreg.Field{
+		{Name: "Mode", Value: fmt.Sprintf("%d (%s)", ppu.Mode(), modeNames[ppu.Mode()])},
+		{Name: "LYC=LY", Value: fmt.Sprint((stat>>2)&1 != 0)},
+		{Name: "Mode 0 int", Value: ioreg.OnOff((stat>>3)&1 != 0)},
+		{Name: "Mode 1 int", Value: ioreg.OnOff((stat>>4)&1 != 0)},
+		{Name: "Mode 2 int", Value: ioreg.OnOff((stat>>5)&1 != 0)},
+		{Name: "LYC int", Value: ioreg.OnOff((stat>>6)&1 != 0)},
+	}
+
+	return []ioreg.Register{
+		{Addr: 0xff40, Name: "LCDC", Value: ppu.LCDC(), Fields: lcdc},
+		{Addr: 0xff41, Name: "STAT", Value: stat, Fields: statFields},
+		{Addr: 0xff42, Name: "SCY", Value: ppu.SCY()},
+		{Addr: 0xff43, Name: "SCX", Value: ppu.SCX()},
+		{Addr: 0xff44, Name: "LY", Value: ppu.LY()},
+		{Addr: 0xff45, Name: "LYC", Value: ppu.LYC()},
+		{Addr: 0xff47, Name: "BGP", Value: ppu.BGP(), Fields: ioreg.Palette(ppu.BGP())},
+		{Addr: 0xff48, Name: "OBP0", Value: ppu.OBP0(), Fields: ioreg.Palette(ppu.OBP0())},
+		{Addr: 0xff49, Name: "OBP1", Value: ppu.OBP1(), Fields: ioreg.Palette(ppu.OBP1())},
+		{Addr: 0xff4a, Name: "WY", Value: ppu.WY()},
+		{Addr: 0xff4b, Name: "WX", Value: ppu.WX(), Fields: []ioreg.Field{
+			{Name: "X", Value: fmt.Sprint(int(ppu.WX()) - 7)},
+		}},
+	}
+}
+
+func tileMapRange(addr uint16) string {
+	return fmt.Sprintf("%04x-%04x", addr, addr+0x3ff)
+}
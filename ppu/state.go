@@ -0,0 +1,20 @@
+package ppu
+
+// SavedState is the state of the PPU, including VRAM and OAM, saved by
+// SaveState.
+type SavedState struct {
+	ppu PPU
+}
+
+// SaveState returns the state of the PPU, which can be restored by
+// LoadState.
+func (ppu *PPU) SaveState() *SavedState {
+	return &SavedState{ppu: *ppu}
+}
+
+// LoadState restores the state saved by SaveState.
+func (ppu *PPU) LoadState(s *SavedState) {
+	bus := ppu.bus
+	*ppu = s.ppu
+	ppu.bus = bus
+}
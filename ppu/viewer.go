@@ -0,0 +1,95 @@
+package ppu
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/ushitora-anqou/aqboy/constant"
+)
+
+// The layout of the tile data in TileImage
+const (
+	NumTiles    = 384 // At 8000-97FF
+	TilesPerRow = 16
+)
+
+// Shades are the colors of the LCD, from the color 0 to 3.
+var Shades = color.Palette{
+	color.Gray{constant.COLOR_WHITE},
+	color.Gray{constant.COLOR_LIGHT_GRAY},
+	color.Gray{constant.COLOR_DARK_GRAY},
+	color.Gray{constant.COLOR_BLACK},
+}
+
+// The colors of the overlays of TileMapImage, which follow Shades in the
+// palette of the image
+const (
+	ViewportColor = 4 // The area of the BG shown on the screen
+	WindowColor   = 5 // The area covered by the window
+)
+
+var tileMapPalette = color.Palette{
+	Shades[0], Shades[1], Shades[2], Shades[3],
+	color.RGBA{0xff, 0x00, 0x00, 0xff},
+	color.RGBA{0x00, 0x00, 0xff, 0xff},
+}
+
+// TileImage renders the tiles at 8000-97FF in a grid of 16 by 24 tiles in
+// the order of the addresses, with the colors given by paletteData, e.g. BGP.
+func (ppu *PPU) TileImage(paletteData uint8) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, TilesPerRow*8, NumTiles/TilesPerRow*8), Shades)
+	for tile := 0; tile < NumTiles; tile++ {
+		x0, y0 := tile%TilesPerRow*8, tile/TilesPerRow*8
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				paletteIdx := ppu.decodeTilePixel(uint16(tile*16), x, y)
+				img.SetColorIndex(x0+x, y0+y, paletteColor(paletteData, paletteIdx))
+			}
+		}
+	}
+	return img
+}
+
+// TileMapImage renders the 256x256 background of the tile map at
+// tileMapAddr, 9800 or 9C00, or at the one used for BG if 0, as the PPU
+// would draw it. The outline of the viewport at SCX and SCY is drawn on top,
+// as well as the outline of the area covered by the window if enabled. The
+// outlines wrap around the edges like the viewport does.
+func (ppu *PPU) TileMapImage(tileMapAddr uint16) *image.Paletted {
+	if tileMapAddr == 0 {
+		tileMapAddr = ppu.getBGTileMapAddr()
+	}
+	img := image.NewPaletted(image.Rect(0, 0, 256, 256), tileMapPalette)
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			img.SetColorIndex(x, y, ppu.fetchBGWindowTileColor(tileMapAddr, x, y))
+		}
+	}
+
+	scx, scy := int(ppu.SCX()), int(ppu.SCY())
+	wx, wy := int(ppu.WX())-7, int(ppu.WY())
+	if wx < 0 {
+		wx = 0
+	}
+	if ppu.getWindowDisplayEnable() && wx < constant.LCD_WIDTH && wy < constant.LCD_HEIGHT {
+		drawOutline(img, scx+wx, scy+wy, constant.LCD_WIDTH-wx, constant.LCD_HEIGHT-wy, WindowColor)
+	}
+	drawOutline(img, scx, scy, constant.LCD_WIDTH, constant.LCD_HEIGHT, ViewportColor)
+	return img
+}
+
+// drawOutline draws the outline of the rectangle on the 256x256 img,
+// wrapping around the edges.
+func drawOutline(img *image.Paletted, x, y, width, height int, colorIdx uint8) {
+	set := func(x, y int) {
+		img.SetColorIndex(x%256, y%256, colorIdx)
+	}
+	for i := 0; i < width; i++ {
+		set(x+i, y)
+		set(x+i, y+height-1)
+	}
+	for i := 0; i < height; i++ {
+		set(x, y+i)
+		set(x+width-1, y+i)
+	}
+}
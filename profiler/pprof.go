@@ -0,0 +1,165 @@
+package profiler
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+/*
+	The pprof format is a gzipped protocol buffer defined in
+	https://github.com/google/pprof/blob/main/proto/profile.proto.
+	Only the fields below are written, so it is encoded by hand rather than
+	depending on a protobuf library.
+*/
+
+const (
+	// Profile
+	pprofSampleType  = 1
+	pprofSample      = 2
+	pprofLocation    = 4
+	pprofFunction    = 5
+	pprofStringTable = 6
+	pprofPeriodType  = 11
+	pprofPeriod      = 12
+
+	// ValueType
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	// Sample
+	pprofSampleLocationID = 1
+	pprofSampleValue      = 2
+
+	// Location
+	pprofLocationID      = 1
+	pprofLocationAddress = 3
+	pprofLocationLine    = 4
+
+	// Line
+	pprofLineFunctionID = 1
+
+	// Function
+	pprofFunctionID         = 1
+	pprofFunctionName       = 2
+	pprofFunctionSystemName = 3
+)
+
+type protoBuffer struct {
+	buf []uint8
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.buf = append(b.buf, uint8(x)|0x80)
+		x >>= 7
+	}
+	b.buf = append(b.buf, uint8(x))
+}
+
+func (b *protoBuffer) uint64(tag int, x uint64) {
+	b.varint(uint64(tag)<<3 | 0) // Varint
+	b.varint(x)
+}
+
+func (b *protoBuffer) bytes(tag int, data []uint8) {
+	b.varint(uint64(tag)<<3 | 2) // Length-delimited
+	b.varint(uint64(len(data)))
+	b.buf = append(b.buf, data...)
+}
+
+func (b *protoBuffer) packed(tag int, xs []uint64) {
+	var body protoBuffer
+	for _, x := range xs {
+		body.varint(x)
+	}
+	b.bytes(tag, body.buf)
+}
+
+func (b *protoBuffer) message(tag int, f func(*protoBuffer)) {
+	var body protoBuffer
+	f(&body)
+	b.bytes(tag, body.buf)
+}
+
+// WritePprof writes the profile in the pprof format. Each routine appears
+// as a function, and each location is addressed by bank<<16|addr.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	var b protoBuffer
+
+	strings := []string{""}
+	stringIndex := map[string]uint64{"": 0}
+	str := func(s string) uint64 {
+		if i, ok := stringIndex[s]; ok {
+			return i
+		}
+		i := uint64(len(strings))
+		strings = append(strings, s)
+		stringIndex[s] = i
+		return i
+	}
+
+	valueType := func(tag int, typ, unit string) {
+		b.message(tag, func(b *protoBuffer) {
+			b.uint64(pprofValueTypeType, str(typ))
+			b.uint64(pprofValueTypeUnit, str(unit))
+		})
+	}
+	valueType(pprofSampleType, "instructions", "count")
+	valueType(pprofSampleType, "cycles", "count")
+
+	functionIDs := map[string]uint64{}
+	locationIDs := map[site]uint64{}
+	var functions, locations protoBuffer
+	location := func(s site) uint64 {
+		if id, ok := locationIDs[s]; ok {
+			return id
+		}
+		name := p.functionName(s)
+		fid, ok := functionIDs[name]
+		if !ok {
+			fid = uint64(len(functionIDs) + 1)
+			functionIDs[name] = fid
+			functions.message(pprofFunction, func(b *protoBuffer) {
+				b.uint64(pprofFunctionID, fid)
+				b.uint64(pprofFunctionName, str(name))
+				b.uint64(pprofFunctionSystemName, str(s.entry.String()))
+			})
+		}
+		id := uint64(len(locationIDs) + 1)
+		locationIDs[s] = id
+		locations.message(pprofLocation, func(b *protoBuffer) {
+			b.uint64(pprofLocationID, id)
+			b.uint64(pprofLocationAddress, uint64(s.loc.bank)<<16|uint64(s.loc.addr))
+			b.message(pprofLocationLine, func(b *protoBuffer) {
+				b.uint64(pprofLineFunctionID, fid)
+			})
+		})
+		return id
+	}
+
+	for _, s := range p.samples {
+		ids := make([]uint64, len(s.stack))
+		for i, st := range s.stack {
+			ids[i] = location(st)
+		}
+		b.message(pprofSample, func(b *protoBuffer) {
+			b.packed(pprofSampleLocationID, ids)
+			b.packed(pprofSampleValue, []uint64{s.instructions, s.cycles})
+		})
+	}
+	b.buf = append(b.buf, locations.buf...)
+	b.buf = append(b.buf, functions.buf...)
+
+	valueType(pprofPeriodType, "cycles", "count")
+	b.uint64(pprofPeriod, 1)
+
+	for _, s := range strings {
+		b.bytes(pprofStringTable, []uint8(s))
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(b.buf); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,184 @@
+// Package profiler attributes the cycles spent by the emulated game to its
+// routines, which is useful to find hot spots in ROM code.
+package profiler
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ushitora-anqou/aqboy/cpu"
+)
+
+// Symbolizer converts an address to a label like "Main.loop+3".
+// It returns "" if no label is known.
+type Symbolizer interface {
+	Symbolize(bank int, addr uint16) string
+}
+
+type location struct {
+	bank int
+	addr uint16
+}
+
+func (l location) String() string {
+	return fmt.Sprintf("%02x:%04x", l.bank, l.addr)
+}
+
+// site is a location along with the entry point of the routine it belongs to.
+type site struct {
+	loc, entry location
+}
+
+type sample struct {
+	stack                []site // Innermost first
+	instructions, cycles uint64
+}
+
+type Profiler struct {
+	symbols Symbolizer
+	samples map[string]*sample
+	cycles  uint64
+
+	// The instruction being executed
+	key    []uint8
+	frames []cpu.Frame
+	leaf   location
+}
+
+func NewProfiler() *Profiler {
+	return &Profiler{
+		samples: map[string]*sample{},
+	}
+}
+
+// SetSymbolizer makes the reports use labels as names of the routines.
+func (p *Profiler) SetSymbolizer(symbols Symbolizer) {
+	p.symbols = symbols
+}
+
+// BeginStep must be called before the CPU executes the instruction at bank:pc.
+func (p *Profiler) BeginStep(bank int, pc uint16, c *cpu.CPU) {
+	p.frames = c.AppendCallStack(p.frames[:0])
+
+	// Build the key of the stack without allocation.
+	key := append(p.key[:0], uint8(bank), uint8(pc>>8), uint8(pc))
+	for _, f := range p.frames {
+		key = append(key,
+			uint8(f.CallerBank), uint8(f.CallerPC>>8), uint8(f.CallerPC),
+			uint8(f.TargetBank), uint8(f.Target>>8), uint8(f.Target))
+	}
+	p.key = key
+	p.leaf = location{bank, pc}
+}
+
+// EndStep records that the instruction given to BeginStep took ticks cycles.
+func (p *Profiler) EndStep(ticks uint) {
+	p.cycles += uint64(ticks)
+	s, ok := p.samples[string(p.key)]
+	if !ok {
+		s = &sample{stack: p.buildStack(p.leaf)}
+		p.samples[string(p.key)] = s
+	}
+	s.instructions++
+	s.cycles += uint64(ticks)
+}
+
+func (p *Profiler) buildStack(leaf location) []site {
+	// Without symbols, the code from the reset vector is in the routine 00:0100.
+	entry := func(i int) location {
+		if i < len(p.frames) {
+			return location{p.frames[i].TargetBank, p.frames[i].Target}
+		}
+		return location{0, 0x0100}
+	}
+	stack := []site{{leaf, entry(0)}}
+	for i, f := range p.frames {
+		stack = append(stack, site{location{f.CallerBank, f.CallerPC}, entry(i + 1)})
+	}
+	return stack
+}
+
+// functionName returns the name of the routine containing s.
+func (p *Profiler) functionName(s site) string {
+	if p.symbols != nil {
+		if name := p.symbols.Symbolize(s.loc.bank, s.loc.addr); name != "" {
+			// Strip the offset and the local label: "Main.loop+3" --> "Main"
+			if i := strings.IndexAny(name, "+."); i > 0 {
+				name = name[:i]
+			}
+			return name
+		}
+	}
+	return s.entry.String()
+}
+
+type FunctionStat struct {
+	Name                string
+	SelfCycles, Cycles  uint64 // Cycles excludes and includes callees respectively
+	SelfInstructions    uint64
+	SelfRatio, CumRatio float64
+}
+
+// Functions returns the statistics of the routines sorted by self cycles.
+func (p *Profiler) Functions() []FunctionStat {
+	stats := map[string]*FunctionStat{}
+	get := func(name string) *FunctionStat {
+		if stat, ok := stats[name]; ok {
+			return stat
+		}
+		stat := &FunctionStat{Name: name}
+		stats[name] = stat
+		return stat
+	}
+
+	for _, s := range p.samples {
+		leaf := get(p.functionName(s.stack[0]))
+		leaf.SelfCycles += s.cycles
+		leaf.SelfInstructions += s.instructions
+
+		// Count recursive routines only once.
+		seen := map[string]bool{}
+		for _, st := range s.stack {
+			name := p.functionName(st)
+			if !seen[name] {
+				seen[name] = true
+				get(name).Cycles += s.cycles
+			}
+		}
+	}
+
+	ret := []FunctionStat{}
+	for _, stat := range stats {
+		if p.cycles != 0 {
+			stat.SelfRatio = float64(stat.SelfCycles) / float64(p.cycles)
+			stat.CumRatio = float64(stat.Cycles) / float64(p.cycles)
+		}
+		ret = append(ret, *stat)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].SelfCycles != ret[j].SelfCycles {
+			return ret[i].SelfCycles > ret[j].SelfCycles
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// WriteReport writes a table of the routines sorted by self cycles.
+func (p *Profiler) WriteReport(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "Total: %d cycles\n%12s %7s %12s %7s %12s  %s\n",
+		p.cycles, "self", "self%", "cum", "cum%", "insts", "routine"); err != nil {
+		return err
+	}
+	for _, stat := range p.Functions() {
+		_, err := fmt.Fprintf(w, "%12d %6.2f%% %12d %6.2f%% %12d  %s\n",
+			stat.SelfCycles, stat.SelfRatio*100, stat.Cycles, stat.CumRatio*100,
+			stat.SelfInstructions, stat.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+// Package symbol resolves labels of the game to addresses and vice versa,
+// using the symbol files emitted by RGBDS.
+package symbol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Symbol struct {
+	Name string
+	Bank int
+	Addr uint16
+}
+
+func (s Symbol) String() string {
+	return fmt.Sprintf("%02x:%04x %s", s.Bank, s.Addr, s.Name)
+}
+
+func (s Symbol) isLocal() bool {
+	return strings.Contains(s.Name, ".")
+}
+
+type Table struct {
+	symbols []Symbol // Sorted by bank and address if sorted is true
+	sorted  bool
+	byName  map[string]Symbol
+}
+
+func NewTable() *Table {
+	return &Table{
+		sorted: true,
+		byName: map[string]Symbol{},
+	}
+}
+
+// Add adds a label. The bank is ignored unless addr is in ROMX or SRAM,
+// since the other regions, e.g. WRAMX, are not banked on DMG.
+func (t *Table) Add(name string, bank int, addr uint16) {
+	if r := region(addr); r != regionROMX && r != regionSRAM {
+		bank = 0
+	}
+	sym := Symbol{Name: name, Bank: bank, Addr: addr}
+	if old, ok := t.byName[name]; ok {
+		if old == sym {
+			return
+		}
+		for i := range t.symbols {
+			if t.symbols[i].Name == name {
+				t.symbols[i] = sym
+			}
+		}
+	} else {
+		t.symbols = append(t.symbols, sym)
+	}
+	t.byName[name] = sym
+	t.sorted = false
+}
+
+func (t *Table) Len() int {
+	return len(t.symbols)
+}
+
+// LoadFile loads a .sym or .map file depending on the extension of filename.
+func (t *Table) LoadFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(filename), ".map") {
+		err = t.LoadMap(file)
+	} else {
+		err = t.LoadSym(file)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
+
+// LoadSym loads a .sym file, whose lines look like "01:4000 Main.loop".
+// Text after ';' is a comment.
+func (t *Table) LoadSym(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: Invalid symbol: %s", lineno, line)
+		}
+		bankAddr := strings.SplitN(fields[0], ":", 2)
+		if len(bankAddr) != 2 {
+			return fmt.Errorf("line %d: Invalid symbol: %s", lineno, line)
+		}
+		bank, err1 := strconv.ParseUint(bankAddr[0], 16, 16)
+		addr, err2 := strconv.ParseUint(bankAddr[1], 16, 16)
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("line %d: Invalid address: %s", lineno, fields[0])
+		}
+		t.Add(fields[1], int(bank), uint16(addr))
+	}
+	return scanner.Err()
+}
+
+var (
+	mapBankRegexp   = regexp.MustCompile(`^(?:\w+ bank|ROM Bank) #(\d+)`)
+	mapSymbolRegexp = regexp.MustCompile(`^\s+\$([0-9A-Fa-f]{1,4}) = (\S+)`)
+)
+
+// LoadMap loads a .map file. Only the labels listed under the sections of
+// the banks are read:
+//
+//	ROMX bank #1:
+//		SECTION: $4000-$4002 ($0003 bytes) ["Banked"]
+//		         $4000 = Banked
+func (t *Table) LoadMap(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	bank := -1
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if m := mapBankRegexp.FindStringSubmatch(line); m != nil {
+			n, err := strconv.Atoi(m[1])
+			if err != nil {
+				return fmt.Errorf("line %d: Invalid bank: %s", lineno, m[1])
+			}
+			bank = n
+			continue
+		}
+		if m := mapSymbolRegexp.FindStringSubmatch(line); m != nil {
+			if bank < 0 {
+				return fmt.Errorf("line %d: Symbol outside of banks: %s", lineno, m[2])
+			}
+			addr, _ := strconv.ParseUint(m[1], 16, 16)
+			t.Add(m[2], bank, uint16(addr))
+		}
+	}
+	return scanner.Err()
+}
+
+func (t *Table) sort() {
+	if t.sorted {
+		return
+	}
+	// Prefer global labels to local ones at the same address.
+	sort.Slice(t.symbols, func(i, j int) bool {
+		x, y := t.symbols[i], t.symbols[j]
+		if x.Bank != y.Bank {
+			return x.Bank < y.Bank
+		}
+		if x.Addr != y.Addr {
+			return x.Addr < y.Addr
+		}
+		if x.isLocal() != y.isLocal() {
+			return !x.isLocal()
+		}
+		return x.Name < y.Name
+	})
+	t.sorted = true
+}
+
+// Symbols returns all the labels sorted by bank and address.
+func (t *Table) Symbols() []Symbol {
+	t.sort()
+	return append([]Symbol{}, t.symbols...)
+}
+
+func (t *Table) Lookup(name string) (Symbol, bool) {
+	sym, ok := t.byName[name]
+	return sym, ok
+}
+
+const (
+	regionROM0 = iota
+	regionROMX
+	regionVRAM
+	regionSRAM
+	regionWRAM
+	regionOAM
+	regionIO
+	regionHRAM
+)
+
+// region returns the memory region containing addr. A label in a region does
+// not cover addresses in another one.
+func region(addr uint16) int {
+	switch {
+	case addr <= 0x3fff:
+		return regionROM0
+	case addr <= 0x7fff:
+		return regionROMX
+	case addr <= 0x9fff:
+		return regionVRAM
+	case addr <= 0xbfff:
+		return regionSRAM
+	case addr <= 0xdfff:
+		return regionWRAM
+	case addr <= 0xfeff: // Echo RAM and OAM
+		return regionOAM
+	case addr <= 0xff7f:
+		return regionIO
+	default:
+		return regionHRAM
+	}
+}
+
+// Nearest returns the label at or nearest before bank:addr.
+func (t *Table) Nearest(bank int, addr uint16) (Symbol, bool) {
+	t.sort()
+	i := sort.Search(len(t.symbols), func(i int) bool {
+		s := t.symbols[i]
+		return s.Bank > bank || (s.Bank == bank && s.Addr > addr)
+	})
+	if i == 0 {
+		return Symbol{}, false
+	}
+	sym := t.symbols[i-1]
+	for j := i - 2; j >= 0 && t.symbols[j].Bank == sym.Bank && t.symbols[j].Addr == sym.Addr; j-- {
+		sym = t.symbols[j]
+	}
+	if sym.Bank != bank || region(sym.Addr) != region(addr) {
+		return Symbol{}, false
+	}
+	return sym, true
+}
+
+// Symbolize returns a string like "Main.loop+3" for bank:addr, or "" if no
+// label covers it.
+func (t *Table) Symbolize(bank int, addr uint16) string {
+	sym, ok := t.Nearest(bank, addr)
+	if !ok {
+		return ""
+	}
+	if sym.Addr == addr {
+		return sym.Name
+	}
+	return fmt.Sprintf("%s+%d", sym.Name, addr-sym.Addr)
+}
@@ -0,0 +1,102 @@
+package symbol
+
+import (
+	"strings"
+	"testing"
+)
+
+const testSym = `; File generated by rgblink
+00:0150 Main
+00:0150 Main.init
+00:0158 Main.loop
+01:4000 Banked
+02:4000 Other
+01:c000 wCounter
+00:ff80 hFlag
+`
+
+const testMap = `SUMMARY:
+	ROM0: 16 bytes used / 16368 free
+
+ROM0 bank #0:
+	SECTION: $0150-$015f ($0010 bytes) ["main"]
+	         $0150 = Main
+	         $0150 = Main.init
+	         $0158 = Main.loop
+	EMPTY: $0160-$3fff ($3ea0 bytes)
+
+ROMX bank #1:
+	SECTION: $4000-$4003 ($0004 bytes) ["banked"]
+	         $4000 = Banked
+
+ROMX bank #2:
+	SECTION: $4000-$4003 ($0004 bytes) ["other"]
+	         $4000 = Other
+
+WRAMX bank #1:
+	SECTION: $c000-$c000 ($0001 byte) ["vars"]
+	         $c000 = wCounter
+
+HRAM bank #0:
+	SECTION: $ff80-$ff80 ($0001 byte) ["hram"]
+	         $ff80 = hFlag
+`
+
+func TestSymbolize(t *testing.T) {
+	for _, src := range []struct {
+		name string
+		load func(*Table) error
+	}{
+		{"sym", func(t *Table) error { return t.LoadSym(strings.NewReader(testSym)) }},
+		{"map", func(t *Table) error { return t.LoadMap(strings.NewReader(testMap)) }},
+	} {
+		table := NewTable()
+		if err := src.load(table); err != nil {
+			t.Fatalf("%s: %v", src.name, err)
+		}
+		if table.Len() != 7 {
+			t.Fatalf("%s: Number of symbols: (got: %d) (expected: 7)", src.name, table.Len())
+		}
+
+		for _, entry := range []struct {
+			bank     int
+			addr     uint16
+			expected string
+		}{
+			{0, 0x0100, ""},
+			{0, 0x0150, "Main"},
+			{0, 0x0153, "Main+3"},
+			{0, 0x015b, "Main.loop+3"},
+			{0, 0x3fff, "Main.loop+16039"},
+			{1, 0x4002, "Banked+2"},
+			{2, 0x4002, "Other+2"},
+			{3, 0x4002, ""},
+			{0, 0x4002, ""},
+			{0, 0xc001, "wCounter+1"},
+			{0, 0xff80, "hFlag"},
+			{0, 0xff40, ""},
+		} {
+			if got := table.Symbolize(entry.bank, entry.addr); got != entry.expected {
+				t.Fatalf("%s: Symbolize(%02x:%04x): (got: %q) (expected: %q)",
+					src.name, entry.bank, entry.addr, got, entry.expected)
+			}
+		}
+
+		sym, ok := table.Lookup("Main.loop")
+		if !ok || sym.Bank != 0 || sym.Addr != 0x0158 {
+			t.Fatalf("%s: Lookup: (got: %v) (expected: 00:0158 Main.loop)", src.name, sym)
+		}
+	}
+}
+
+func TestLoadSymError(t *testing.T) {
+	for _, src := range []string{
+		"0150 Main",
+		"00:0150",
+		"00:xyzw Main",
+	} {
+		if err := NewTable().LoadSym(strings.NewReader(src)); err == nil {
+			t.Fatalf("Expected an error: %q", src)
+		}
+	}
+}
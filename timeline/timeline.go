@@ -0,0 +1,240 @@
+// Package timeline exports a span of the emulation in the Chrome trace event
+// format, which can be loaded into trace viewers such as Perfetto and
+// chrome://tracing.
+//
+// The trace has a track per subsystem: the routines running on the CPU, the
+// PPU modes of each scanline, the interrupts, OAM DMA and the audio buffers
+// pushed to the frontend. The CPU track is recorded by Recorder, and the
+// others are built from the hardware events of package eventlog.
+package timeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/ushitora-anqou/aqboy/cpu"
+	"github.com/ushitora-anqou/aqboy/eventlog"
+)
+
+// Clock cycles per microsecond
+const cyclesPerMicrosecond = 4.194304
+
+// Clock cycles of OAM DMA as emulated by the PPU
+const oamDMACycles = 160
+
+// Clock cycles of dispatching an interrupt
+const dispatchCycles = 20
+
+// Tracks
+const (
+	tidCPU = iota + 1
+	tidPPU
+	tidInterrupts
+	tidDMA
+	tidAudio
+)
+
+var trackNames = map[int]string{
+	tidCPU:        "CPU",
+	tidPPU:        "PPU",
+	tidInterrupts: "Interrupts",
+	tidDMA:        "DMA",
+	tidAudio:      "Audio",
+}
+
+var modeNames = []string{"H-Blank", "V-Blank", "OAM Search", "Pixel Transfer"}
+
+// traceEvent is an event of the Chrome trace event format.
+type traceEvent struct {
+	Name  string                 `json:"name"`
+	Phase string                 `json:"ph"`
+	TS    float64                `json:"ts"`
+	Dur   float64                `json:"dur,omitempty"`
+	PID   int                    `json:"pid"`
+	TID   int                    `json:"tid"`
+	Scope string                 `json:"s,omitempty"`
+	Args  map[string]interface{} `json:"args,omitempty"`
+}
+
+func micros(cycles uint64) float64 {
+	return float64(cycles) / cyclesPerMicrosecond
+}
+
+// Recorder records the routines running on the CPU.
+type Recorder struct {
+	symbols    cpu.Symbolizer
+	start, end uint64
+	stopped    bool
+	open       []cpu.Frame // Outermost first
+	stack      []cpu.Frame // Buffer for the call stack of the CPU
+	events     []traceEvent
+}
+
+// NewRecorder starts recording the routines running on c at cycle. symbols
+// may be nil.
+func NewRecorder(symbols cpu.Symbolizer, cycle uint64, c *cpu.CPU) *Recorder {
+	r := &Recorder{symbols: symbols, start: cycle}
+	if c != nil {
+		r.Step(cycle, c)
+	}
+	return r
+}
+
+func (r *Recorder) name(bank int, addr uint16) string {
+	if r.symbols != nil {
+		if name := r.symbols.Symbolize(bank, addr); name != "" {
+			return name
+		}
+	}
+	return fmt.Sprintf("%02x:%04x", bank, addr)
+}
+
+// Step must be called after c executes each instruction, with the cycle at
+// its end.
+func (r *Recorder) Step(cycle uint64, c *cpu.CPU) {
+	if r.stopped {
+		return
+	}
+	r.stack = c.AppendCallStack(r.stack[:0])
+	r.step(cycle, r.stack)
+}
+
+// step updates the open routines to stack, innermost first.
+func (r *Recorder) step(cycle uint64, stack []cpu.Frame) {
+
+	// Find the frames that are still on the stack.
+	common := 0
+	for common < len(r.open) && common < len(stack) &&
+		r.open[common] == stack[len(stack)-1-common] {
+		common++
+	}
+	for i := len(r.open) - 1; i >= common; i-- {
+		r.events = append(r.events, traceEvent{Phase: "E", TS: micros(cycle), PID: 1, TID: tidCPU})
+	}
+	r.open = r.open[:common]
+	for i := len(stack) - 1 - common; i >= 0; i-- {
+		f := stack[i]
+		r.open = append(r.open, f)
+		r.events = append(r.events, traceEvent{
+			Name:  r.name(f.TargetBank, f.Target),
+			Phase: "B",
+			TS:    micros(cycle),
+			PID:   1,
+			TID:   tidCPU,
+			Args: map[string]interface{}{
+				"kind":   f.Kind.String(),
+				"caller": r.name(f.CallerBank, f.CallerPC),
+			},
+		})
+	}
+}
+
+// Stop stops recording at cycle.
+func (r *Recorder) Stop(cycle uint64) {
+	if r.stopped {
+		return
+	}
+	r.step(cycle, nil)
+	r.end = cycle
+	r.stopped = true
+}
+
+// Span returns the cycles when the recording started and stopped.
+func (r *Recorder) Span() (uint64, uint64) {
+	return r.start, r.end
+}
+
+// WriteJSON writes the trace of the recorded span. events are the hardware
+// events, of which those outside the span are ignored. Recording should
+// have been stopped.
+func (r *Recorder) WriteJSON(w io.Writer, events []eventlog.Event) error {
+	trace := []traceEvent{}
+	for tid := tidCPU; tid <= tidAudio; tid++ {
+		trace = append(trace, traceEvent{
+			Name:  "thread_name",
+			Phase: "M",
+			PID:   1,
+			TID:   tid,
+			Args:  map[string]interface{}{"name": trackNames[tid]},
+		})
+	}
+	trace = append(trace, r.events...)
+
+	var mode *eventlog.Event // The PPU mode being recorded
+	closeMode := func(cycle uint64) {
+		if mode != nil && cycle > mode.Cycle {
+			trace = append(trace, traceEvent{
+				Name:  fmt.Sprintf("Mode %d (%s)", mode.Value, modeNames[mode.Value&3]),
+				Phase: "X",
+				TS:    micros(mode.Cycle),
+				Dur:   micros(cycle - mode.Cycle),
+				PID:   1,
+				TID:   tidPPU,
+				Args:  map[string]interface{}{"ly": mode.LY, "frame": mode.Frame},
+			})
+		}
+		mode = nil
+	}
+
+	for i := range events {
+		e := &events[i]
+		if e.Cycle < r.start || r.end < e.Cycle {
+			continue
+		}
+		switch e.Kind {
+		case eventlog.PPUMode:
+			closeMode(e.Cycle)
+			mode = e
+
+		case eventlog.IRQ:
+			trace = append(trace, traceEvent{
+				Name:  "IRQ " + eventlog.InterruptName(e.Value),
+				Phase: "i",
+				TS:    micros(e.Cycle),
+				PID:   1,
+				TID:   tidInterrupts,
+				Scope: "t",
+				Args:  map[string]interface{}{"ly": e.LY, "dot": e.Dot},
+			})
+
+		case eventlog.Dispatch:
+			trace = append(trace, traceEvent{
+				Name:  "Dispatch " + eventlog.InterruptName(e.Value),
+				Phase: "X",
+				TS:    micros(e.Cycle),
+				Dur:   micros(dispatchCycles),
+				PID:   1,
+				TID:   tidInterrupts,
+				Args:  map[string]interface{}{"ly": e.LY, "dot": e.Dot, "vector": fmt.Sprintf("%04x", e.Addr)},
+			})
+
+		case eventlog.OAMDMA:
+			trace = append(trace, traceEvent{
+				Name:  "OAM DMA",
+				Phase: "X",
+				TS:    micros(e.Cycle),
+				Dur:   micros(oamDMACycles),
+				PID:   1,
+				TID:   tidDMA,
+				Args:  map[string]interface{}{"source": fmt.Sprintf("%04x", e.Addr)},
+			})
+
+		case eventlog.AudioBuffer:
+			trace = append(trace, traceEvent{
+				Name:  "Audio buffer",
+				Phase: "i",
+				TS:    micros(e.Cycle),
+				PID:   1,
+				TID:   tidAudio,
+				Scope: "t",
+			})
+		}
+	}
+	closeMode(r.end)
+
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"traceEvents":     trace,
+		"displayTimeUnit": "ns",
+	})
+}
@@ -0,0 +1,90 @@
+package timeline
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ushitora-anqou/aqboy/cpu"
+	"github.com/ushitora-anqou/aqboy/eventlog"
+)
+
+type testSymbols map[uint16]string
+
+func (s testSymbols) Symbolize(bank int, addr uint16) string {
+	return s[addr]
+}
+
+type testTrace struct {
+	TraceEvents []traceEvent `json:"traceEvents"`
+}
+
+func TestRecorder(t *testing.T) {
+	main := cpu.Frame{Kind: cpu.FrameCall, CallerPC: 0x0150, Target: 0x0200, ReturnAddr: 0x0153, SP: 0xfffc}
+	vblank := cpu.Frame{Kind: cpu.FrameInterrupt, CallerPC: 0x0210, Target: 0x0040, ReturnAddr: 0x0210, SP: 0xfffa}
+	sub := cpu.Frame{Kind: cpu.FrameCall, CallerPC: 0x0220, Target: 0x0300, ReturnAddr: 0x0223, SP: 0xfffa}
+
+	r := NewRecorder(testSymbols{0x0200: "Main", 0x0040: "VBlank"}, 4194304, nil)
+	r.step(4194304, []cpu.Frame{main})
+	r.step(4194304+42, []cpu.Frame{vblank, main})
+	r.step(4194304+84, []cpu.Frame{main})
+	r.step(4194304+126, []cpu.Frame{sub, main})
+	r.Stop(4194304 + 4194304)
+
+	events := []eventlog.Event{
+		{Cycle: 0, Kind: eventlog.IRQ, Value: eventlog.Timer}, // Before the span
+		{Cycle: 4194304 + 20, LY: 144, Kind: eventlog.PPUMode, Value: 1},
+		{Cycle: 4194304 + 22, Kind: eventlog.IRQ, Value: eventlog.VBlank},
+		{Cycle: 4194304 + 42, Kind: eventlog.Dispatch, Addr: 0x0040, Value: eventlog.VBlank},
+		{Cycle: 4194304 + 100, Kind: eventlog.OAMDMA, Addr: 0xc000},
+		{Cycle: 4194304 + 1000, LY: 0, Kind: eventlog.PPUMode, Value: 2},
+		{Cycle: 4194304 + 2000, Kind: eventlog.AudioBuffer},
+		{Cycle: 4194304 + 2001, Kind: eventlog.IOWrite, Addr: 0xff40, Value: 0x91}, // Not shown
+	}
+	var out strings.Builder
+	if err := r.WriteJSON(&out, events); err != nil {
+		t.Fatal(err)
+	}
+	var trace testTrace
+	if err := json.Unmarshal([]byte(out.String()), &trace); err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		name  string
+		phase string
+		ts    float64
+		dur   float64
+		tid   int
+	}
+	var got []entry
+	for _, e := range trace.TraceEvents {
+		if e.Phase == "M" {
+			continue
+		}
+		got = append(got, entry{e.Name, e.Phase, e.TS, e.Dur, e.TID})
+	}
+	us := func(cycles float64) float64 { return cycles / cyclesPerMicrosecond }
+	expected := []entry{
+		{"Main", "B", 1000000, 0, tidCPU},
+		{"VBlank", "B", us(4194304 + 42), 0, tidCPU},
+		{"", "E", us(4194304 + 84), 0, tidCPU},
+		{"00:0300", "B", us(4194304 + 126), 0, tidCPU},
+		{"", "E", 2000000, 0, tidCPU},
+		{"", "E", 2000000, 0, tidCPU},
+		{"IRQ VBlank", "i", us(4194304 + 22), 0, tidInterrupts},
+		{"Dispatch VBlank", "X", us(4194304 + 42), us(dispatchCycles), tidInterrupts},
+		{"OAM DMA", "X", us(4194304 + 100), us(oamDMACycles), tidDMA},
+		{"Mode 1 (V-Blank)", "X", us(4194304 + 20), us(980), tidPPU},
+		{"Audio buffer", "i", us(4194304 + 2000), 0, tidAudio},
+		{"Mode 2 (OAM Search)", "X", us(4194304 + 1000), us(4194304 - 1000), tidPPU},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("Trace events: (got: %v) (expected: %v)", got, expected)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("Trace event %d: (got: %v) (expected: %v)", i, got[i], expected[i])
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package timer
+
+import (
+	"fmt"
+
+	"github.com/ushitora-anqou/aqboy/ioreg"
+)
+
+// The frequencies of TIMA selected by TAC
+var clockFrequencies = []int{4096, 262144, 65536, 16384}
+
+// Registers returns the timer registers with their bitfields decoded.
+func (t *Timer) Registers() []ioreg.Register {
+	return []ioreg.Register{
+		{Addr: 0xff04, Name: "DIV", Value: t.DIV()},
+		{Addr: 0xff05, Name: "TIMA", Value: t.TIMA()},
+		{Addr: 0xff06, Name: "TMA", Value: t.TMA()},
+		{Addr: 0xff07, Name: "TAC", Value: t.TAC(), Fields: []ioreg.Field{
+			{Name: "Enable", Value: ioreg.OnOff(t.timerEnable())},
+			{Name: "Clock", Value: fmt.Sprintf("%d Hz", clockFrequencies[t.inputClockSelect()])},
+		}},
+	}
+}
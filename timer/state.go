@@ -0,0 +1,19 @@
+package timer
+
+// SavedState is the state of the timer saved by SaveState.
+type SavedState struct {
+	timer Timer
+}
+
+// SaveState returns the state of the timer, which can be restored by
+// LoadState.
+func (t *Timer) SaveState() *SavedState {
+	return &SavedState{timer: *t}
+}
+
+// LoadState restores the state saved by SaveState.
+func (t *Timer) LoadState(s *SavedState) {
+	bus := t.bus
+	*t = s.timer
+	t.bus = bus
+}
@@ -2,6 +2,7 @@ package timer
 
 import (
 	"github.com/ushitora-anqou/aqboy/bus"
+	"github.com/ushitora-anqou/aqboy/eventlog"
 )
 
 type Timer struct {
@@ -51,6 +52,9 @@ func (t *Timer) SetTAC(val uint8) {
 func (t *Timer) incTIMA() {
 	val := uint(t.TIMA()) + 1
 	if val > 0xff { // Interrupt
+		if events := t.bus.Events; events != nil {
+			events.Add(eventlog.TimerOverflow, 0xff05, t.TMA())
+		}
 		cpu := t.bus.CPU
 		cpu.SetIF(cpu.IF() | (1 << 2))
 		val = uint(t.TMA())
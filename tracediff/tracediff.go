@@ -0,0 +1,187 @@
+// Package tracediff compares the per-instruction CPU trace with a reference
+// log produced by another emulator in the same format, e.g. the logs of
+// gameboy-doctor:
+//
+//	A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0100 PCMEM:00,C3,13,02
+//
+// Only the fields present in both lines are compared, so that the reference
+// may omit PCMEM and the trace may have labels appended.
+package tracediff
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ushitora-anqou/aqboy/cpu"
+)
+
+// ErrEndOfReference is returned by Differ.Write when the trace goes past the
+// end of the reference without diverging.
+var ErrEndOfReference = errors.New("End of the reference")
+
+// The number of the lines shown before the divergence
+const contextLines = 5
+
+// Divergence is the first line of the trace which differs from the
+// reference. It is returned by Differ.Write as an error.
+type Divergence struct {
+	Line     int      // Line number, i.e. the number of the instruction from 1
+	Expected string   // The line of the reference
+	Got      string   // The line of the trace
+	Context  []string // The lines before it, which agree with the reference
+	Fields   []string // The names of the differing fields, e.g. "A"
+}
+
+func (d *Divergence) Error() string {
+	return fmt.Sprintf("Trace diverges from the reference at instruction %d (%s)",
+		d.Line, strings.Join(d.Fields, ", "))
+}
+
+// Report writes the divergence with the context and the disassembly.
+// Since each line shows the state before the instruction, the instruction on
+// the line before the divergence is the one which has likely gone wrong.
+func (d *Divergence) Report(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%v:\n", d)
+	first := d.Line - len(d.Context)
+	for i, line := range d.Context {
+		fmt.Fprintf(bw, "  %10d  %s  ; %s\n", first+i, line, disassemble(line))
+	}
+	fmt.Fprintf(bw, "- %10d  %s  ; %s\n", d.Line, d.Expected, disassemble(d.Expected))
+	fmt.Fprintf(bw, "+ %10d  %s  ; %s\n", d.Line, d.Got, disassemble(d.Got))
+	for _, name := range d.Fields {
+		if field(d.Got, name) == "" {
+			continue
+		}
+		fmt.Fprintf(bw, "%s: (expected: %s) (got: %s)\n", name, field(d.Expected, name), field(d.Got, name))
+	}
+	if n := len(d.Context); n > 0 {
+		prev := d.Context[n-1]
+		fmt.Fprintf(bw, "Suspect: %s at PC %s (instruction %d)\n", disassemble(prev), field(prev, "PC"), d.Line-1)
+	}
+	return bw.Flush()
+}
+
+// field returns the value of the field name in line, or "" if missing.
+// The name is case-insensitive.
+func field(line, name string) string {
+	for _, f := range strings.Fields(line) {
+		if i := strings.IndexByte(f, ':'); i >= 0 && strings.EqualFold(f[:i], name) {
+			return f[i+1:]
+		}
+	}
+	return ""
+}
+
+// disassemble returns the instruction in PCMEM of line, or "?" if missing.
+func disassemble(line string) string {
+	mem := strings.Split(field(line, "PCMEM"), ",")
+	pc, err := strconv.ParseUint(field(line, "PC"), 16, 16)
+	if len(mem) != 4 || err != nil {
+		return "?"
+	}
+	var code [4]uint8
+	for i, s := range mem {
+		b, err := strconv.ParseUint(s, 16, 8)
+		if err != nil {
+			return "?"
+		}
+		code[i] = uint8(b)
+	}
+	text, _ := cpu.Disassemble(func(addr uint16) uint8 {
+		return code[(addr-uint16(pc))&3]
+	}, uint16(pc))
+	return text
+}
+
+// diff returns the names of the fields which are in both lines but differ.
+// If no field is in both, the lines are considered to differ entirely.
+func diff(expected, got string) []string {
+	var names []string
+	common := 0
+	for _, f := range strings.Fields(expected) {
+		i := strings.IndexByte(f, ':')
+		if i < 0 {
+			continue
+		}
+		name := f[:i]
+		if v := field(got, name); v != "" {
+			common++
+			if !strings.EqualFold(v, f[i+1:]) {
+				names = append(names, name)
+			}
+		}
+	}
+	if common == 0 {
+		return []string{"all fields"}
+	}
+	return names
+}
+
+// Differ is an io.Writer which receives the trace and compares it with the
+// reference line by line.
+type Differ struct {
+	ref     *bufio.Scanner
+	line    int
+	partial []byte // The line being written
+	context []string
+}
+
+func NewDiffer(ref io.Reader) *Differ {
+	return &Differ{ref: bufio.NewScanner(ref)}
+}
+
+// Lines returns the number of the lines which agree with the reference.
+func (d *Differ) Lines() int {
+	return d.line
+}
+
+// Write compares the complete lines in p with the reference. It returns a
+// *Divergence at the first line which differs, or ErrEndOfReference.
+func (d *Differ) Write(p []byte) (int, error) {
+	d.partial = append(d.partial, p...)
+	start := 0
+	for {
+		i := bytes.IndexByte(d.partial[start:], '\n')
+		if i < 0 {
+			break
+		}
+		got := string(d.partial[start : start+i])
+		start += i + 1
+		if err := d.compare(got); err != nil {
+			return len(p), err
+		}
+	}
+	d.partial = append(d.partial[:0], d.partial[start:]...)
+	return len(p), nil
+}
+
+func (d *Differ) compare(got string) error {
+	if !d.ref.Scan() {
+		if err := d.ref.Err(); err != nil {
+			return err
+		}
+		return ErrEndOfReference
+	}
+	expected := strings.TrimSpace(d.ref.Text())
+	if fields := diff(expected, got); len(fields) > 0 {
+		return &Divergence{
+			Line:     d.line + 1,
+			Expected: expected,
+			Got:      got,
+			Context:  append([]string(nil), d.context...),
+			Fields:   fields,
+		}
+	}
+	d.line++
+	if len(d.context) == contextLines {
+		d.context = append(d.context[:0], d.context[1:]...)
+	}
+	d.context = append(d.context, got)
+	return nil
+}
@@ -0,0 +1,80 @@
+package tracediff
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const reference = `A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0100 PCMEM:00,C3,50,01
+A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0101 PCMEM:C3,50,01,CE
+A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0150 PCMEM:80,00,00,00
+A:01 F:00 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0151 PCMEM:00,00,00,00
+`
+
+func TestMatch(t *testing.T) {
+	d := NewDiffer(strings.NewReader(reference))
+
+	// The trace may be written in pieces, may have labels, and may be in
+	// lower case.
+	trace := strings.ToLower(reference[:100]) + reference[100:]
+	trace = strings.Replace(trace, "PC:0150 PCMEM:80,00,00,00", "PC:0150 PCMEM:80,00,00,00 Main", 1)
+	for len(trace) > 0 {
+		n := 7
+		if n > len(trace) {
+			n = len(trace)
+		}
+		if _, err := d.Write([]byte(trace[:n])); err != nil {
+			t.Fatalf("Write: (got: %v) (expected: no error)", err)
+		}
+		trace = trace[n:]
+	}
+	if d.Lines() != 4 {
+		t.Fatalf("Lines: (got: %d) (expected: 4)", d.Lines())
+	}
+
+	_, err := fmt.Fprintln(d, "A:01 F:00 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0152 PCMEM:00,00,00,00")
+	if !errors.Is(err, ErrEndOfReference) {
+		t.Fatalf("Write: (got: %v) (expected: %v)", err, ErrEndOfReference)
+	}
+}
+
+func TestDivergence(t *testing.T) {
+	// The reference may omit PCMEM.
+	ref := strings.Replace(reference, " PCMEM:80,00,00,00", "", 1)
+	d := NewDiffer(strings.NewReader(ref))
+	lines := strings.SplitAfter(reference, "\n")
+	for _, line := range lines[:3] {
+		if _, err := d.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: (got: %v) (expected: no error)", err)
+		}
+	}
+
+	_, err := d.Write([]byte("A:02 F:00 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0151 PCMEM:00,00,00,00\n"))
+	var div *Divergence
+	if !errors.As(err, &div) {
+		t.Fatalf("Write: (got: %v) (expected: a divergence)", err)
+	}
+	if div.Line != 4 || len(div.Context) != 3 || strings.Join(div.Fields, ",") != "A" {
+		t.Fatalf("Divergence: (got: %+v) (expected: A at line 4)", div)
+	}
+
+	var out strings.Builder
+	if err := div.Report(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"Trace diverges from the reference at instruction 4 (A):\n",
+		"           1  A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0100 PCMEM:00,C3,50,01  ; nop\n",
+		"           2  A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0101 PCMEM:C3,50,01,CE  ; jp $0150\n",
+		"-          4  A:01 F:00",
+		"+          4  A:02 F:00",
+		"A: (expected: 01) (got: 02)\n",
+		"Suspect: add a, b at PC 0150 (instruction 3)\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("Report: (got: %q) (expected to contain: %q)", out.String(), expected)
+		}
+	}
+}
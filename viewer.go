@@ -0,0 +1,16 @@
+package main
+
+import "image"
+
+// TileImage renders the tile data at 8000-97FF with the colors given by
+// paletteData, e.g. BGP. See ppu.PPU.TileImage.
+func (a *AQBoy) TileImage(paletteData uint8) *image.Paletted {
+	return a.ppu.TileImage(paletteData)
+}
+
+// TileMapImage renders the background of the tile map at tileMapAddr, 9800
+// or 9C00, or at the one used for BG if 0, with the viewport and the window
+// outlined. See ppu.PPU.TileMapImage.
+func (a *AQBoy) TileMapImage(tileMapAddr uint16) *image.Paletted {
+	return a.ppu.TileMapImage(tileMapAddr)
+}
@@ -0,0 +1,33 @@
+package window
+
+import (
+	"fmt"
+
+	"github.com/ushitora-anqou/aqboy/constant"
+)
+
+// HeadlessWindow keeps the screen in memory and discards audio.
+// It is used to run the emulator without any GUI, e.g. in tests.
+type HeadlessWindow struct {
+	Screen [constant.LCD_WIDTH * constant.LCD_HEIGHT]uint8
+}
+
+func NewHeadlessWindow() *HeadlessWindow {
+	return &HeadlessWindow{}
+}
+
+func (wind *HeadlessWindow) DrawLine(ly int, scanline []uint8) error {
+	if len(scanline) != constant.LCD_WIDTH {
+		return fmt.Errorf(
+			"Invalid length of scanline data: expected %d, got %d",
+			constant.LCD_WIDTH,
+			len(scanline),
+		)
+	}
+	copy(wind.Screen[ly*constant.LCD_WIDTH:(ly+1)*constant.LCD_WIDTH], scanline)
+	return nil
+}
+
+func (wind *HeadlessWindow) EnqueueAudioBuffer(buf []float32) error {
+	return nil
+}
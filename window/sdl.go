@@ -128,6 +128,8 @@ func (wind *SDLWindow) HandleEvents() (bool, *WindowEvent) {
 				switch kbEvent.Keysym.Sym {
 				case sdl.K_ESCAPE:
 					escape = true
+				case sdl.K_F12:
+					we.Debug = true
 				case sdl.K_w:
 					we.Direction |= (1 << constant.DIR_UP)
 				case sdl.K_a:
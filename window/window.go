@@ -2,6 +2,7 @@ package window
 
 type WindowEvent struct {
 	Direction, Action uint8
+	Debug             bool // Enter the debugger
 }
 
 type Window interface {